@@ -0,0 +1,374 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	permRead  = "read"
+	permWrite = "write"
+	permList  = "list"
+	permAdmin = "admin" // Implies every other permission on the same buckets.
+)
+
+// Grants with this user apply to everyone, including anonymous requests.
+const everyone = "*"
+
+const passwordIterations = 10000
+
+type Grant struct {
+	User        string
+	Bucket      string // A path.Match pattern. "*" matches every bucket.
+	Permissions []string
+}
+
+type UserRecord struct {
+	Password string   // See hashPassword.
+	Tokens   []string // Hex sha256 of each bearer token.
+}
+
+// This is the on disk format of the credentials file.
+type credentials struct {
+	Users  map[string]*UserRecord
+	Grants []*Grant
+}
+
+type ACL struct {
+	lock     sync.RWMutex
+	file     string
+	creds    credentials
+	tokens   map[string]string // token hash -> user
+	verified map[string]string // sha256(user, password) -> password hash it was checked against
+}
+
+func loadACL(file string) (*ACL, error) {
+	acl := &ACL{file: file}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &acl.creds); err != nil {
+			return nil, err
+		}
+	}
+	if acl.creds.Users == nil {
+		acl.creds.Users = make(map[string]*UserRecord)
+	}
+	acl.reindex()
+	return acl, nil
+}
+
+// Must be called with the write lock held (or before the ACL is shared).
+func (acl *ACL) reindex() {
+	acl.tokens = make(map[string]string)
+	for name, user := range acl.creds.Users {
+		for _, token := range user.Tokens {
+			acl.tokens[token] = name
+		}
+	}
+	acl.verified = make(map[string]string)
+}
+
+// Writes to a temporary file first so a crash never leaves a half written
+// credentials file behind.
+func (acl *ACL) save() error {
+	data, err := json.MarshalIndent(acl.creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := acl.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, acl.file)
+}
+
+func (acl *ACL) isEmpty() bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	return len(acl.creds.Users) == 0
+}
+
+func (acl *ACL) authenticateBasic(name, password string) bool {
+	acl.lock.RLock()
+	user, ok := acl.creds.Users[name]
+	var hash string
+	if ok {
+		hash = user.Password
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + password))
+	cacheKey := string(sum[:])
+	cached := acl.verified[cacheKey]
+	acl.lock.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	// Checking a password is deliberately slow, so remember the ones that
+	// passed until the password changes.
+	if cached != "" && cached == hash {
+		return true
+	}
+	if !checkPassword(hash, password) {
+		return false
+	}
+
+	acl.lock.Lock()
+	acl.verified[cacheKey] = hash
+	acl.lock.Unlock()
+	return true
+}
+
+func (acl *ACL) authenticateToken(token string) (string, bool) {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	name, ok := acl.tokens[hashToken(token)]
+	return name, ok
+}
+
+// An empty bucket means the operation is not tied to a bucket, which only
+// a grant on "*" covers.
+func (acl *ACL) allowed(user, bucket, permission string) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	for _, grant := range acl.creds.Grants {
+		if grant.User != user && grant.User != everyone {
+			continue
+		}
+		if matched, _ := path.Match(grant.Bucket, bucket); !matched {
+			continue
+		}
+		for _, p := range grant.Permissions {
+			if p == permission || p == permAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (acl *ACL) setPassword(name, password string) error {
+	if name == "" || name == everyone || strings.ContainsAny(name, ":/") {
+		return errors.New("invalid user name")
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	user, ok := acl.creds.Users[name]
+	if !ok {
+		user = new(UserRecord)
+		acl.creds.Users[name] = user
+	}
+	user.Password = hash
+	acl.reindex()
+	return acl.save()
+}
+
+func (acl *ACL) deleteUser(name string) (bool, error) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	if _, ok := acl.creds.Users[name]; !ok {
+		return false, nil
+	}
+	delete(acl.creds.Users, name)
+
+	grants := acl.creds.Grants[:0]
+	for _, grant := range acl.creds.Grants {
+		if grant.User != name {
+			grants = append(grants, grant)
+		}
+	}
+	acl.creds.Grants = grants
+	acl.reindex()
+	return true, acl.save()
+}
+
+// Returns the new token. Only its hash is kept, so this is the one chance
+// to see it.
+func (acl *ACL) newToken(name string) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	user, ok := acl.creds.Users[name]
+	if !ok {
+		return "", nil
+	}
+	user.Tokens = append(user.Tokens, hashToken(token))
+	acl.reindex()
+	return token, acl.save()
+}
+
+func (acl *ACL) revokeTokens(name string) (bool, error) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	user, ok := acl.creds.Users[name]
+	if !ok {
+		return false, nil
+	}
+	user.Tokens = nil
+	acl.reindex()
+	return true, acl.save()
+}
+
+// Replaces the grant for the same user and bucket pattern, if any.
+func (acl *ACL) setGrant(grant *Grant) error {
+	if _, err := path.Match(grant.Bucket, ""); err != nil || grant.Bucket == "" {
+		return errors.New("invalid bucket pattern")
+	}
+	for _, p := range grant.Permissions {
+		if p != permRead && p != permWrite && p != permList && p != permAdmin {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	if _, ok := acl.creds.Users[grant.User]; !ok && grant.User != everyone {
+		return errors.New("unknown user")
+	}
+	for i, existing := range acl.creds.Grants {
+		if existing.User == grant.User && existing.Bucket == grant.Bucket {
+			acl.creds.Grants[i] = grant
+			return acl.save()
+		}
+	}
+	acl.creds.Grants = append(acl.creds.Grants, grant)
+	return acl.save()
+}
+
+func (acl *ACL) deleteGrant(user, bucket string) (bool, error) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	for i, grant := range acl.creds.Grants {
+		if grant.User == user && grant.Bucket == bucket {
+			acl.creds.Grants = append(acl.creds.Grants[:i], acl.creds.Grants[i+1:]...)
+			return true, acl.save()
+		}
+	}
+	return false, nil
+}
+
+type aclListing struct {
+	Users  []string `json:"users"`
+	Grants []*Grant `json:"grants"`
+}
+
+func (acl *ACL) listing() aclListing {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	// The listing is encoded after the lock is released, by when the grants
+	// may have changed under it, so it gets a copy of them.
+	r := aclListing{
+		Users:  make([]string, 0, len(acl.creds.Users)),
+		Grants: append(make([]*Grant, 0, len(acl.creds.Grants)), acl.creds.Grants...),
+	}
+	for name := range acl.creds.Users {
+		r.Users = append(r.Users, name)
+	}
+	return r
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Passwords are stored as "pbkdf2-sha256$<iterations>$<salt>$<key>" with
+// the salt and key base64 encoded.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// PBKDF2 (RFC 2898) with HMAC-SHA256, producing a single 32 byte block.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	prf.Write(salt)
+	prf.Write(block)
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
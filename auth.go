@@ -0,0 +1,297 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+type AuthConfig struct {
+	Enabled         bool
+	CredentialsFile string
+}
+
+type authContextKey struct{}
+
+var acl *ACL
+
+func initializeACL() {
+	if !globalConfig.Auth.Enabled {
+		return
+	}
+
+	var err error
+	if acl, err = loadACL(globalConfig.Auth.CredentialsFile); err != nil {
+		mainLogger.Fatalln("Credentials file error:", err)
+	}
+
+	// Nobody could ever log in to add the first user, so make one up.
+	if acl.isEmpty() {
+		password, err := GenUUID()
+		if err != nil {
+			mainLogger.Fatalln("Generating admin password failed:", err)
+		}
+		if err = acl.setPassword("admin", password); err == nil {
+			err = acl.setGrant(&Grant{User: "admin", Bucket: "*", Permissions: []string{permAdmin}})
+		}
+		if err != nil {
+			mainLogger.Fatalln("Creating admin user failed:", err)
+		}
+		file, err := writeAdminPassword(password)
+		if err != nil {
+			mainLogger.Fatalln("Saving admin password failed:", err)
+		}
+		mainLogger.Println("NOTICE: Created user 'admin', its password is in", file)
+	}
+}
+
+// Keeps the password out of the log, which may be shipped elsewhere or
+// filtered by LogLevel, in a file only the server's user can read.
+func writeAdminPassword(password string) (string, error) {
+	file := path.Join(globalConfig.DatabaseLocation, "admin-password")
+	if err := os.MkdirAll(globalConfig.DatabaseLocation, 0755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of a file that is already there.
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return file, ioutil.WriteFile(file, []byte(password+"\n"), 0600)
+}
+
+// The user the request was authenticated as, or "" if it is anonymous.
+func requestUser(req *http.Request) string {
+	user, _ := req.Context().Value(authContextKey{}).(string)
+	return user
+}
+
+// Whether the request may use the bucket. Always true with auth disabled.
+func canAccess(req *http.Request, bucket, permission string) bool {
+	return acl == nil || acl.allowed(requestUser(req), bucket, permission)
+}
+
+// Works out which bucket and permission a request needs. An empty
+// permission means the handler filters what it returns itself.
+func requiredPermission(req *http.Request) (bucket string, permission string) {
+	p := req.URL.Path
+	switch {
+	case p == "/" || p == "/ping" || p == "/buckets" || p == "/buckets/":
+		return "", ""
+	case strings.HasPrefix(p, "/buckets/"):
+		splitted := strings.Split(p[lenPath:], "/")
+		bucket = splitted[0]
+		switch {
+		case len(splitted) == 2 && splitted[1] == "keys":
+			if req.Method == "GET" {
+				return bucket, permList
+			}
+			return bucket, permWrite
+		case len(splitted) == 3 && splitted[1] == "keys":
+			if req.Method == "GET" || req.Method == "HEAD" {
+				return bucket, permRead
+			}
+			return bucket, permWrite
+		case len(splitted) >= 4 && (splitted[1] == "index" || splitted[1] == "keys"):
+			return bucket, permRead
+		case len(splitted) == 2 && splitted[1] == "props" && req.Method == "GET":
+			return bucket, permRead
+		}
+		return bucket, permAdmin
+	}
+	return "", permAdmin
+}
+
+// Returns the request with the user attached, or nil if a response has
+// already been written because the request was rejected.
+func authorize(w http.ResponseWriter, req *http.Request) *http.Request {
+	if acl == nil {
+		return req
+	}
+
+	user := ""
+	authenticated := false
+	if name, password, ok := req.BasicAuth(); ok {
+		if !acl.authenticateBasic(name, password) {
+			deny(w, req, name, 401)
+			return nil
+		}
+		user, authenticated = name, true
+	} else if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		name, ok := acl.authenticateToken(strings.TrimSpace(header[7:]))
+		if !ok {
+			deny(w, req, "", 401)
+			return nil
+		}
+		user, authenticated = name, true
+	}
+
+	bucket, permission := requiredPermission(req)
+	if permission != "" && !acl.allowed(user, bucket, permission) {
+		if authenticated {
+			deny(w, req, user, 403)
+		} else {
+			deny(w, req, user, 401)
+		}
+		return nil
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), authContextKey{}, user))
+}
+
+func deny(w http.ResponseWriter, req *http.Request, user string, code int) {
+	if user == "" {
+		user = "anonymous"
+	}
+	mainLogger.Println("DENIED:", code, req.RemoteAddr, user, req.Method, req.URL.Path)
+	if code == 401 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="levelupdb"`)
+	}
+	w.WriteHeader(code)
+}
+
+const lenUsersPath = len("/admin/users/")
+
+// GET    /admin/users
+// PUT    /admin/users/<name>         {"password": "..."}
+// DELETE /admin/users/<name>
+// POST   /admin/users/<name>/tokens  returns {"token": "..."}
+// DELETE /admin/users/<name>/tokens
+func userOps(w http.ResponseWriter, req *http.Request) {
+	if acl == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	remaining := ""
+	if len(req.URL.Path) > lenUsersPath {
+		remaining = strings.Trim(req.URL.Path[lenUsersPath:], "/")
+	}
+	if remaining == "" {
+		if req.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
+		writeJSON(w, acl.listing())
+		return
+	}
+
+	splitted := strings.Split(remaining, "/")
+	name := splitted[0]
+	switch {
+	case len(splitted) == 1 && req.Method == "PUT":
+		var body struct {
+			Password string `json:"password"`
+		}
+		if !readJSON(w, req, &body) {
+			return
+		}
+		if err := acl.setPassword(name, body.Password); err != nil {
+			mainLogger.Println("ERROR: Setting password failed with", err)
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(204)
+	case len(splitted) == 1 && req.Method == "DELETE":
+		found, err := acl.deleteUser(name)
+		aclResponse(w, found, err)
+	case len(splitted) == 2 && splitted[1] == "tokens" && req.Method == "POST":
+		token, err := acl.newToken(name)
+		if err != nil || token == "" {
+			aclResponse(w, token != "", err)
+			return
+		}
+		writeJSON(w, map[string]string{"token": token})
+	case len(splitted) == 2 && splitted[1] == "tokens" && req.Method == "DELETE":
+		found, err := acl.revokeTokens(name)
+		aclResponse(w, found, err)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// GET    /admin/grants
+// PUT    /admin/grants  {"User": "...", "Bucket": "...", "Permissions": [...]}
+// DELETE /admin/grants?user=<name>&bucket=<pattern>
+func grantOps(w http.ResponseWriter, req *http.Request) {
+	if acl == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeJSON(w, acl.listing().Grants)
+	case "PUT":
+		grant := new(Grant)
+		if !readJSON(w, req, grant) {
+			return
+		}
+		if err := acl.setGrant(grant); err != nil {
+			mainLogger.Println("ERROR: Setting grant failed with", err)
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		query := req.URL.Query()
+		found, err := acl.deleteGrant(query.Get("user"), query.Get("bucket"))
+		aclResponse(w, found, err)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func aclResponse(w http.ResponseWriter, found bool, err error) {
+	switch {
+	case err != nil:
+		mainLogger.Println("ERROR: Saving credentials failed with", err)
+		w.WriteHeader(500)
+	case !found:
+		w.WriteHeader(404)
+	default:
+		w.WriteHeader(204)
+	}
+}
+
+func readJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	data, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		mainLogger.Println("ERROR: JSON encode failed with", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,351 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRequiredPermission(t *testing.T) {
+	tests := []struct {
+		method, path, bucket, permission string
+	}{
+		{"GET", "/", "", ""},
+		{"GET", "/ping", "", ""},
+		{"GET", "/buckets", "", ""},
+		{"GET", "/buckets/", "", ""},
+		{"GET", "/buckets/b/keys", "b", permList},
+		{"POST", "/buckets/b/keys", "b", permWrite},
+		{"GET", "/buckets/b/keys/k", "b", permRead},
+		{"HEAD", "/buckets/b/keys/k", "b", permRead},
+		{"PUT", "/buckets/b/keys/k", "b", permWrite},
+		{"POST", "/buckets/b/keys/k", "b", permWrite},
+		{"DELETE", "/buckets/b/keys/k", "b", permWrite},
+		{"GET", "/buckets/b/keys/k/_,_,_", "b", permRead},
+		{"GET", "/buckets/b/index/age_int/42", "b", permRead},
+		{"GET", "/buckets/b/index/age_int/40/50", "b", permRead},
+		{"GET", "/buckets/b/props", "b", permRead},
+		{"PUT", "/buckets/b/props", "b", permAdmin},
+		{"DELETE", "/buckets/b/props", "b", permAdmin},
+		{"GET", "/buckets/b", "b", permAdmin},
+		{"GET", "/stats", "", permAdmin},
+		{"GET", "/metrics", "", permAdmin},
+		{"GET", "/admin/users", "", permAdmin},
+		{"PUT", "/admin/grants", "", permAdmin},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		bucket, permission := requiredPermission(req)
+		if bucket != test.bucket || permission != test.permission {
+			t.Errorf("%s %s: expected %q %q, got %q %q", test.method, test.path,
+				test.bucket, test.permission, bucket, permission)
+		}
+	}
+}
+
+func TestGrantMatching(t *testing.T) {
+	acl := &ACL{creds: credentials{Grants: []*Grant{
+		{User: "alice", Bucket: "photos-*", Permissions: []string{permRead, permList}},
+		{User: "alice", Bucket: "inbox", Permissions: []string{permWrite}},
+		{User: "bob", Bucket: "*", Permissions: []string{permAdmin}},
+		{User: "carol", Bucket: "log-20[0-9][0-9]", Permissions: []string{permRead}},
+		{User: everyone, Bucket: "public", Permissions: []string{permRead}},
+	}}}
+	tests := []struct {
+		user, bucket, permission string
+		allowed                  bool
+	}{
+		{"alice", "photos-2012", permRead, true},
+		{"alice", "photos-2012", permList, true},
+		{"alice", "photos-2012", permWrite, false},
+		{"alice", "photos-", permRead, true},
+		{"alice", "photos", permRead, false},
+		{"alice", "inbox", permWrite, true},
+		{"alice", "inbox", permRead, false},
+		{"alice", "inbox2", permWrite, false},
+		{"alice", "", permAdmin, false},
+		{"bob", "anything", permWrite, true},
+		{"bob", "", permAdmin, true},
+		{"carol", "log-2012", permRead, true},
+		{"carol", "log-201x", permRead, false},
+		{"carol", "log-2012", permWrite, false},
+		{"alice", "public", permRead, true},
+		{"", "public", permRead, true},
+		{"", "public", permWrite, false},
+		{"", "photos-2012", permRead, false},
+		{"dave", "public", permRead, true},
+		{"dave", "inbox", permWrite, false},
+	}
+	for _, test := range tests {
+		if allowed := acl.allowed(test.user, test.bucket, test.permission); allowed != test.allowed {
+			t.Errorf("%q %s on %q: expected %v, got %v", test.user, test.permission, test.bucket, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	var err error
+	if acl, err = loadACL(path.Join(t.TempDir(), "credentials.json")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { acl = nil })
+	if err := acl.setPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	for _, grant := range []*Grant{
+		{User: "alice", Bucket: "photos", Permissions: []string{permRead}},
+		{User: everyone, Bucket: "public", Permissions: []string{permRead}},
+	} {
+		if err := acl.setGrant(grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := acl.newToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic := func(name, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(name, password) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	anonymous := func(*http.Request) {}
+
+	tests := []struct {
+		name         string
+		method, path string
+		credentials  func(*http.Request)
+		status       int // 0 means let through.
+		user         string
+	}{
+		{"anonymous ping", "GET", "/ping", anonymous, 0, ""},
+		{"anonymous granted", "GET", "/buckets/public/keys/k", anonymous, 0, ""},
+		{"anonymous not granted", "GET", "/buckets/photos/keys/k", anonymous, 401, ""},
+		{"anonymous write", "PUT", "/buckets/public/keys/k", anonymous, 401, ""},
+		{"basic granted", "GET", "/buckets/photos/keys/k", basic("alice", "secret"), 0, "alice"},
+		{"basic through everyone", "GET", "/buckets/public/keys/k", basic("alice", "secret"), 0, "alice"},
+		{"basic wrong password", "GET", "/buckets/photos/keys/k", basic("alice", "wrong"), 401, ""},
+		{"basic unknown user", "GET", "/ping", basic("mallory", "secret"), 401, ""},
+		{"basic not granted", "PUT", "/buckets/photos/keys/k", basic("alice", "secret"), 403, ""},
+		{"basic other bucket", "GET", "/buckets/secrets/keys/k", basic("alice", "secret"), 403, ""},
+		{"basic admin", "GET", "/admin/users", basic("alice", "secret"), 403, ""},
+		{"bearer granted", "GET", "/buckets/photos/keys/k", bearer(token), 0, "alice"},
+		{"bearer unknown token", "GET", "/buckets/public/keys/k", bearer("nope"), 401, ""},
+		{"bearer not granted", "DELETE", "/buckets/photos/keys/k", bearer(token), 403, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		test.credentials(req)
+		w := httptest.NewRecorder()
+		authorized := authorize(w, req)
+		switch {
+		case test.status == 0 && authorized == nil:
+			t.Errorf("%s: rejected with %d", test.name, w.Code)
+		case test.status == 0 && requestUser(authorized) != test.user:
+			t.Errorf("%s: expected user %q, got %q", test.name, test.user, requestUser(authorized))
+		case test.status != 0 && authorized != nil:
+			t.Errorf("%s: let through, expected %d", test.name, test.status)
+		case test.status != 0 && w.Code != test.status:
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		case w.Code == 401 && w.Header().Get("WWW-Authenticate") == "":
+			t.Errorf("%s: 401 without WWW-Authenticate", test.name)
+		}
+	}
+}
+
+// The inputs of the RFC 6070 test vectors, with the results for HMAC-SHA256
+// rather than HMAC-SHA1 as published alongside RFC 7914, whose own vector
+// is the last one.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a86878c029ac13ee276509d5ae58b6466a724"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+	}
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2([]byte(test.password), []byte(test.salt), test.iterations))
+		if key != test.key {
+			t.Errorf("%q %q %d: expected %s, got %s", test.password, test.salt, test.iterations, test.key, key)
+		}
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "secret") {
+		t.Error("the password does not match its own hash")
+	}
+	if checkPassword(hash, "Secret") {
+		t.Error("a different password matches the hash")
+	}
+	for _, bad := range []string{"", "secret", "pbkdf2-sha256$0$c2FsdA==$a2V5", "md5$1$c2FsdA==$a2V5", "pbkdf2-sha256$1$!$a2V5"} {
+		if checkPassword(bad, "secret") {
+			t.Errorf("malformed hash %q matches", bad)
+		}
+	}
+}
+
+func TestGeneratedAdminPassword(t *testing.T) {
+	globalConfig = defaultConfig()
+	globalConfig.DatabaseLocation = path.Join(t.TempDir(), "databases")
+	globalConfig.Auth = AuthConfig{Enabled: true, CredentialsFile: path.Join(t.TempDir(), "credentials.json")}
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	var logged bytes.Buffer
+	mainLogger.SetOutput(&logged)
+	initializeACL()
+	mainLogger.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { acl = nil })
+
+	file := path.Join(globalConfig.DatabaseLocation, "admin-password")
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("admin-password has mode %o, expected 600", mode)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := strings.TrimSpace(string(data))
+	if !acl.authenticateBasic("admin", password) {
+		t.Error("the password in admin-password does not log in as admin")
+	}
+	if !acl.allowed("admin", "any", permAdmin) {
+		t.Error("admin cannot administer every bucket")
+	}
+	if strings.Contains(logged.String(), password) {
+		t.Errorf("the password was logged: %q", logged.String())
+	}
+	if !strings.Contains(logged.String(), file) {
+		t.Errorf("the log does not say where the password is: %q", logged.String())
+	}
+}
+
+func TestDeniedRequestThroughHandler(t *testing.T) {
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	globalConfig = defaultConfig()
+	// Every request counts as slow, so the slow request log sees the
+	// denied ones too.
+	globalConfig.SlowRequestThreshold = 0
+	slowRequests = newSlowRequestLog(10)
+	var logged bytes.Buffer
+	accessLog = &logged
+	var err error
+	if acl, err = loadACL(path.Join(t.TempDir(), "credentials.json")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { acl, accessLog, slowRequests = nil, nil, nil })
+	if err := acl.setPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	handler := standardHandler(func(w http.ResponseWriter, req *http.Request) { called = true })
+	for _, test := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", 401},
+		{"alice", "wrong", 401},
+		{"alice", "secret", 403},
+	} {
+		req := httptest.NewRequest("GET", "/buckets/photos/keys/k", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.status {
+			t.Errorf("%q: expected %d, got %d", test.user, test.status, w.Code)
+		}
+	}
+	if called {
+		t.Error("a denied request reached the handler")
+	}
+	if lines := strings.Count(logged.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 access log lines, got %q", logged.String())
+	}
+	if recent := slowRequests.recent(); len(recent) != 3 {
+		t.Errorf("expected 3 slow requests, got %v", recent)
+	}
+}
+
+func TestGrantListingIsACopy(t *testing.T) {
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	acl, err := loadACL(path.Join(t.TempDir(), "credentials.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.setPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{"a", "b", "c"} {
+		if err := acl.setGrant(&Grant{User: "alice", Bucket: bucket, Permissions: []string{permRead}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Encoded once the lock is gone, so later changes must not show up.
+	listing := acl.listing()
+	if _, err := acl.deleteGrant("alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.setGrant(&Grant{User: "alice", Bucket: "b", Permissions: []string{permWrite}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Grants) != 3 {
+		t.Fatalf("expected 3 grants, got %d", len(listing.Grants))
+	}
+	for i, bucket := range []string{"a", "b", "c"} {
+		if grant := listing.Grants[i]; grant.Bucket != bucket || grant.Permissions[0] != permRead {
+			t.Errorf("grant %d changed to %+v", i, grant)
+		}
+	}
+}
@@ -18,11 +18,34 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+// go test -engine memory runs the database tests against the memory engine.
+var engineFlag = flag.String("engine", "leveldb", "the storage engine to test the database with")
+
+func testBackends(t *testing.T) *Backends {
+	driver := DriverNamed(*engineFlag)
+	if driver == nil {
+		t.Fatalf("There is no %q engine", *engineFlag)
+	}
+	return SingleBackend(driver)
+}
+
 func TestEncodingDecoding(t *testing.T) {
 	meta := new(Meta)
 	meta.Indexes = make([][2]string, 1)
@@ -31,7 +54,7 @@ func TestEncodingDecoding(t *testing.T) {
 	meta.Meta["test"] = "yay"
 	meta.Indexes[0] = [2]string{"field", "value"}
 
-	metaString, _ := json.Marshal(meta)
+	metaString, _ := meta.MarshalBinary()
 	metaLength := len(metaString)
 
 	myData := []byte{1, 2, 3}
@@ -41,23 +64,24 @@ func TestEncodingDecoding(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var length int32
-	lbuf := bytes.NewBuffer(data[:4])
-	err = binary.Read(lbuf, binary.BigEndian, &length)
+	if data[0] != EnvelopeMagic || data[1] != EnvelopeVersion || EnvelopeVersionOf(data) != EnvelopeVersion {
+		t.Fatal("Encode: Bad envelope header", data[:2])
+	}
 
-	if err != nil {
-		t.Fatal(err)
+	if binary.BigEndian.Uint32(data[2:6]) != crc32.Checksum(data[6:], crc32.MakeTable(crc32.Castagnoli)) {
+		t.Fatal("Encode: Bad checksum")
 	}
 
-	if length != int32(metaLength) {
+	length, n := binary.Uvarint(data[6:])
+	if n <= 0 || length != uint64(metaLength) {
 		t.Fatal("Encode: Length does not equal", length, "!=", metaLength)
 	}
 
-	if !bytes.Equal(data[4:4+metaLength], metaString) {
+	if !bytes.Equal(data[6+n:6+n+metaLength], metaString) {
 		t.Fatal("Encode: Meta does not equal!")
 	}
 
-	if !bytes.Equal(data[4+metaLength:], myData) {
+	if !bytes.Equal(data[6+n+metaLength:], myData) {
 		t.Fatal("Encode: Data does not equal!")
 	}
 
@@ -83,6 +107,207 @@ func TestEncodingDecoding(t *testing.T) {
 	}
 }
 
+// Records written before the envelope: an int32 meta length, the meta and
+// the value.
+func encodeLegacyData(meta *Meta, data []byte) []byte {
+	metaString, _ := json.Marshal(meta)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, int32(len(metaString)))
+	buf.Write(metaString)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestLegacyDecoding(t *testing.T) {
+	meta := &Meta{ContentType: "text/plain", Meta: map[string]string{"test": "yay"}}
+	legacy := encodeLegacyData(meta, []byte{1, 2, 3})
+	if EnvelopeVersionOf(legacy) != 0 {
+		t.Fatal("Decode: Legacy record taken for an envelope")
+	}
+
+	decodedMeta, decodedData, err := DecodeData(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedMeta.ContentType != "text/plain" || decodedMeta.Meta["test"] != "yay" || !bytes.Equal(decodedData, []byte{1, 2, 3}) {
+		t.Fatal("Decode: Legacy record decoded wrong", decodedMeta, decodedData)
+	}
+
+	if _, _, err := DecodeData([]byte{EnvelopeMagic, 99, 0}); err == nil {
+		t.Fatal("Decode: Unknown envelope version accepted")
+	}
+	if _, _, err := DecodeData([]byte{EnvelopeMagic, 1, 100, '{', '}'}); err == nil {
+		t.Fatal("Decode: Truncated envelope accepted")
+	}
+}
+
+// Records written by the first envelope version, with the meta as JSON.
+func encodeV1Data(meta *Meta, data []byte) []byte {
+	metaString, _ := json.Marshal(meta)
+	buf := []byte{EnvelopeMagic, 1}
+	var length [binary.MaxVarintLen64]byte
+	buf = append(buf, length[:binary.PutUvarint(length[:], uint64(len(metaString)))]...)
+	buf = append(buf, metaString...)
+	return append(buf, data...)
+}
+
+func TestV1Decoding(t *testing.T) {
+	meta := &Meta{ContentType: "text/plain", Meta: map[string]string{"test": "yay"}, Modified: 1234}
+	decodedMeta, decodedData, err := DecodeData(encodeV1Data(meta, []byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedMeta.ContentType != "text/plain" || decodedMeta.Meta["test"] != "yay" || decodedMeta.Modified != 1234 || !bytes.Equal(decodedData, []byte{1, 2, 3}) {
+		t.Fatal("Decode: Version 1 record decoded wrong", decodedMeta, decodedData)
+	}
+}
+
+// Version 2 records have binary meta but no checksum.
+func encodeV2Data(meta *Meta, data []byte) []byte {
+	encoded, _ := EncodeData(meta, data)
+	return append([]byte{EnvelopeMagic, 2}, encoded[6:]...)
+}
+
+func TestChecksum(t *testing.T) {
+	meta := &Meta{ContentType: "text/plain"}
+	decodedMeta, decodedData, err := DecodeData(encodeV2Data(meta, []byte{1, 2, 3}))
+	if err != nil || decodedMeta.ContentType != "text/plain" || !bytes.Equal(decodedData, []byte{1, 2, 3}) {
+		t.Fatal("Decode: Version 2 record decoded wrong", decodedMeta, decodedData, err)
+	}
+
+	data, _ := EncodeData(meta, []byte{1, 2, 3})
+	for i := 2; i < len(data); i++ {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0x10
+		if _, _, err := DecodeData(damaged); err != ErrChecksum {
+			t.Fatal("Decode: Flipped bit in byte", i, "gave", err)
+		}
+	}
+	if _, _, err := DecodeData(data[:len(data)-1]); err != ErrChecksum {
+		t.Fatal("Decode: Truncated record gave", err)
+	}
+}
+
+func fullMeta() *Meta {
+	return &Meta{
+		Indexes:     [][2]string{{"field_bin", "value"}, {"age_int", "42"}, {"field_bin", "other"}},
+		Links:       `</buckets/b/keys/k>; riaktag="friend"`,
+		Meta:        map[string]string{"X-Riak-Meta-Colour": "purple", "X-Riak-Meta-Empty": ""},
+		ContentType: "application/json",
+		Modified:    1382400000123456,
+		Manifest:    &Manifest{Id: "0123456789abcdef", Size: 3 << 18, ChunkSize: 1 << 18, Checksums: []uint32{1, 0xdeadbeef, 3}, Codec: CodecGzip},
+		Codec:       CodecSnappy,
+	}
+}
+
+func TestMetaBinary(t *testing.T) {
+	for _, meta := range []*Meta{fullMeta(), {Meta: map[string]string{}}} {
+		encoded, err := meta.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(Meta)
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := json.Marshal(meta)
+		actual, _ := json.Marshal(decoded)
+		if !bytes.Equal(expected, actual) {
+			t.Fatal("Meta: Did not round trip:", string(expected), "!=", string(actual))
+		}
+		if decoded.Meta == nil {
+			t.Fatal("Meta: Decoded without a meta map")
+		}
+
+		// Fields from a newer version are skipped.
+		decoded = new(Meta)
+		if err := decoded.UnmarshalBinary(append([]byte{200, 2, 'h', 'i'}, encoded...)); err != nil {
+			t.Fatal("Meta: Unknown field not skipped:", err)
+		}
+		actual, _ = json.Marshal(decoded)
+		if !bytes.Equal(expected, actual) {
+			t.Fatal("Meta: Unknown field changed the meta:", string(actual))
+		}
+	}
+
+	encoded, _ := fullMeta().MarshalBinary()
+	for i := 1; i < len(encoded); i++ {
+		// Cutting it between two fields leaves valid meta, anywhere else
+		// must be noticed.
+		if err := new(Meta).UnmarshalBinary(encoded[:i]); err != nil {
+			continue
+		}
+		rest := new(Meta)
+		if err := rest.UnmarshalBinary(encoded[i:]); err != nil {
+			t.Fatal("Meta: Truncated at", i, "and accepted")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encoded, mustMarshalBinary(fullMeta())) {
+			t.Fatal("Meta: Encoding is not deterministic")
+		}
+	}
+}
+
+func mustMarshalBinary(meta *Meta) []byte {
+	encoded, err := meta.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+func BenchmarkMetaEncodeJSON(b *testing.B) {
+	meta := fullMeta()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(meta)
+	}
+}
+
+func BenchmarkMetaEncodeBinary(b *testing.B) {
+	meta := fullMeta()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		meta.MarshalBinary()
+	}
+}
+
+func BenchmarkMetaDecodeJSON(b *testing.B) {
+	encoded, _ := json.Marshal(fullMeta())
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		json.Unmarshal(encoded, new(Meta))
+	}
+}
+
+func BenchmarkMetaDecodeBinary(b *testing.B) {
+	encoded := mustMarshalBinary(fullMeta())
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		new(Meta).UnmarshalBinary(encoded)
+	}
+}
+
+// What reading a record costs, with the meta of an object GET needs.
+func BenchmarkDecodeDataV1(b *testing.B) {
+	record := encodeV1Data(&Meta{ContentType: "text/plain", Modified: 1382400000123456}, []byte("value"))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeData(record)
+	}
+}
+
+func BenchmarkDecodeDataV2(b *testing.B) {
+	record, _ := EncodeData(&Meta{ContentType: "text/plain", Modified: 1382400000123456}, []byte("value"))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeData(record)
+	}
+}
+
 func TestKeyBucket(t *testing.T) {
 	keys := [][]byte{[]byte("yay"), []byte("woo!"), []byte("meow")}
 	expectedResult := bytes.Join(keys, []byte{9})
@@ -126,15 +351,15 @@ func TestLinkDecode(t *testing.T) {
 	InitializeLinkRegexp()
 	links := `</riak/list/1>; riaktag="previous"`
 	link := ParseLink(links)
-	if link.bucket != "list" {
+	if link.Bucket != "list" {
 		t.Fatal("Link: bucket decode failure")
 	}
 
-	if link.key != "1" {
+	if link.Key != "1" {
 		t.Fatal("Link: key decode failure")
 	}
 
-	if link.tag != "previous" {
+	if link.Tag != "previous" {
 		t.Fatal("Link: tag decode failure")
 	}
 }
@@ -147,7 +372,7 @@ func TestQueryLinks(t *testing.T) {
 		t.Fatal("QueryLinks: Results not length 1")
 	}
 
-	if results[0].bucket != "list" || results[0].tag != "previous" || results[0].key != "1" {
+	if results[0].Bucket != "list" || results[0].Tag != "previous" || results[0].Key != "1" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
@@ -156,11 +381,11 @@ func TestQueryLinks(t *testing.T) {
 		t.Fatal("QueryLinks: Results not length 2")
 	}
 
-	if results[0].bucket != "list" || results[0].tag != "previous" || results[0].key != "1" {
+	if results[0].Bucket != "list" || results[0].Tag != "previous" || results[0].Key != "1" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
-	if results[1].bucket != "list" || results[1].tag != "next" || results[1].key != "3" {
+	if results[1].Bucket != "list" || results[1].Tag != "next" || results[1].Key != "3" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
@@ -169,11 +394,11 @@ func TestQueryLinks(t *testing.T) {
 		t.Fatal("QueryLinks: Results not length 2")
 	}
 
-	if results[0].bucket != "list" || results[0].tag != "next" || results[0].key != "3" {
+	if results[0].Bucket != "list" || results[0].Tag != "next" || results[0].Key != "3" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
-	if results[1].bucket != "list2" || results[1].tag != "next" || results[1].key != "1" {
+	if results[1].Bucket != "list2" || results[1].Tag != "next" || results[1].Key != "1" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
@@ -183,16 +408,1119 @@ func TestQueryLinks(t *testing.T) {
 		t.Fatal("QueryLinks: Results not length 3")
 	}
 
-	if results[0].bucket != "list" || results[0].tag != "previous" || results[0].key != "1" {
+	if results[0].Bucket != "list" || results[0].Tag != "previous" || results[0].Key != "1" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
-	if results[1].bucket != "list" || results[1].tag != "next" || results[1].key != "3" {
+	if results[1].Bucket != "list" || results[1].Tag != "next" || results[1].Key != "3" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 
-	if results[2].bucket != "list2" || results[2].tag != "next" || results[2].key != "1" {
+	if results[2].Bucket != "list2" || results[2].Tag != "next" || results[2].Key != "1" {
 		t.Fatal("QueryLinks: Wrong result.")
 	}
 }
 
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := OpenQueue(LevelDB, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lane := range []string{"a", "b", "a"} {
+		if err := queue.Push(&QueueEntry{Lane: lane}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lanes []string
+	queue.ForEachPending(func(entry *QueueEntry) bool {
+		lanes = append(lanes, entry.Lane)
+		return true
+	})
+	if strings.Join(lanes, "") != "aba" {
+		t.Fatal("Queue: Pending entries out of order", lanes)
+	}
+
+	if ok, err := queue.Bury(&QueueEntry{Id: 1, Lane: "a", Attempts: 3}); !ok || err != nil {
+		t.Fatal("Queue: Bury failed", err)
+	}
+
+	var dead []*QueueEntry
+	queue.ForEachDead(func(entry *QueueEntry) bool {
+		dead = append(dead, entry)
+		return true
+	})
+	if len(dead) != 1 || dead[0].Id != 1 || dead[0].Attempts != 3 {
+		t.Fatal("Queue: Bury failed")
+	}
+
+	queue.Close()
+	if queue, err = OpenQueue(LevelDB, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if ok, err := queue.Replay(1); !ok || err != nil {
+		t.Fatal("Queue: Replay failed", err)
+	}
+
+	if ok, err := queue.Replay(1); ok || err != nil {
+		t.Fatal("Queue: Replaying an entry twice gave", ok, err)
+	}
+	if err := queue.Push(&QueueEntry{Lane: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replayed entry is back ahead of the rest of its lane.
+	var pending []*QueueEntry
+	queue.ForEachPending(func(entry *QueueEntry) bool {
+		pending = append(pending, entry)
+		return true
+	})
+	if len(pending) != 4 || pending[0].Id != 1 || pending[0].Lane != "a" || pending[0].Attempts != 0 ||
+		pending[2].Id != 3 || pending[3].Id != 4 {
+		t.Fatal("Queue: Replayed entry should keep its place", pending)
+	}
+	dead = nil
+	queue.ForEachDead(func(entry *QueueEntry) bool {
+		dead = append(dead, entry)
+		return true
+	})
+	if len(dead) != 0 {
+		t.Fatal("Queue: Replayed entry is still dead", dead)
+	}
+
+	// A delivery that finishes late finds its entry already gone and must
+	// not bring it back.
+	entry, err := queue.Pending(2)
+	if err != nil || entry == nil || entry.Id != 2 || entry.Lane != "b" {
+		t.Fatal("Queue: Pending gave", entry, err)
+	}
+	if err := queue.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := queue.Pending(2); entry != nil || err != nil {
+		t.Fatal("Queue: Removed entry is still pending", entry, err)
+	}
+	entry.Attempts = 1
+	if ok, err := queue.Update(entry); ok || err != nil {
+		t.Fatal("Queue: Updating a removed entry gave", ok, err)
+	}
+	if ok, err := queue.Bury(entry); ok || err != nil {
+		t.Fatal("Queue: Burying a removed entry gave", ok, err)
+	}
+	if entry, _ := queue.Pending(2); entry != nil {
+		t.Fatal("Queue: Update brought back a removed entry", entry)
+	}
+	queue.ForEachDead(func(entry *QueueEntry) bool {
+		t.Fatal("Queue: Bury buried a removed entry", entry)
+		return false
+	})
+	entry, _ = queue.Pending(3)
+	entry.Attempts = 1
+	if ok, err := queue.Update(entry); !ok || err != nil {
+		t.Fatal("Queue: Update failed", err)
+	}
+	if entry, _ := queue.Pending(3); entry == nil || entry.Attempts != 1 {
+		t.Fatal("Queue: Update was not stored", entry)
+	}
+}
+
+func TestParseQuorum(t *testing.T) {
+	valid := map[string]int{"": QuorumDefault, "default": QuorumDefault, "one": 1, "quorum": 1, "all": 1, "0": 0, "1": 1}
+	for value, expected := range valid {
+		if n, err := ParseQuorum(value); err != nil || n != expected {
+			t.Fatal("ParseQuorum: Wrong result for", value, n, err)
+		}
+	}
+
+	for _, value := range []string{"2", "-1", "most"} {
+		if _, err := ParseQuorum(value); err == nil {
+			t.Fatal("ParseQuorum: Accepted", value)
+		}
+	}
+}
+
+func TestParseLevelDBStats(t *testing.T) {
+	stats := "                               Compactions\n" +
+		"Level  Files Size(MB) Time(sec) Read(MB) Write(MB)\n" +
+		"--------------------------------------------------\n" +
+		"  0        2        1         0        0         1\n" +
+		"  1        5       10         3       12        11\n"
+
+	levels := ParseLevelDBStats(stats)
+	if len(levels) != 2 {
+		t.Fatal("LevelDBStats: Expected 2 levels, got", len(levels))
+	}
+
+	expected := LevelStats{Level: 1, Files: 5, SizeMB: 10, TimeSeconds: 3, ReadMB: 12, WriteMB: 11}
+	if levels[1] != expected {
+		t.Fatal("LevelDBStats: Wrong result", levels[1])
+	}
+}
+
+func TestLargeObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", testBackends(t), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", testBackends(t), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	value := bytes.Repeat([]byte("0123456789"), 25) // 250 bytes, 3 chunks of 100.
+	meta := &Meta{Indexes: [][2]string{{"size_int", "250"}}}
+	size, err := database.StoreLargeObject("b", "k", meta, bytes.NewReader(value), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 250 {
+		t.Fatal("Chunks: Stored size is", size)
+	}
+
+	stored, data, err := database.GetObject("b", "k")
+	if err != nil || stored == nil || stored.Manifest == nil {
+		t.Fatal("Chunks: Manifest missing", stored, err)
+	}
+	if len(data) != 0 || stored.Manifest.Chunks() != 3 {
+		t.Fatal("Chunks: Bad manifest", stored.Manifest, len(data))
+	}
+	keys, _ := database.GetAllKeys("b")
+	if len(keys) != 1 {
+		t.Fatal("Chunks: Chunks leaked into the bucket", keys)
+	}
+
+	reader, err := database.OpenChunks("b", stored.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(read, value) {
+		t.Fatal("Chunks: Read back", len(read), "bytes", err)
+	}
+	reader.Seek(195, 0)
+	part := make([]byte, 10)
+	if n, _ := reader.Read(part); string(part[:n]) != "56789" {
+		t.Fatal("Chunks: Read across a chunk boundary gave", string(part[:n]))
+	}
+	reader.Close()
+
+	// A damaged chunk is noticed when it is read.
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate("b")
+	chunk, _ := chunkDb.Get(ChunkKey(stored.Manifest.Id, 1))
+	chunk[0] ^= 1
+	chunkDb.Put(ChunkKey(stored.Manifest.Id, 1), chunk, false)
+	reader, err = database.OpenChunks("b", stored.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ioutil.ReadAll(reader); err == nil || len(read) != 100 {
+		t.Fatal("Chunks: Reading a damaged chunk gave", len(read), "bytes and", err)
+	}
+	reader.Close()
+
+	// Replacing the value with a small one drops the old chunks.
+	if err := database.StoreObject("b", "k", &Meta{}, []byte("small"), false); err != nil {
+		t.Fatal(err)
+	}
+	if chunk, _ := chunkDb.Get(ChunkKey(stored.Manifest.Id, 0)); chunk != nil {
+		t.Fatal("Chunks: Old chunks were not removed")
+	}
+
+	// And so does deleting a large one.
+	database.StoreLargeObject("b", "k", &Meta{}, bytes.NewReader(value), 100, false)
+	stored, _, _ = database.GetObject("b", "k")
+	if code, err := database.DeleteObject("b", "k", false); code != 204 || err != nil {
+		t.Fatal("Chunks: Delete failed with", code, err)
+	}
+	if chunk, _ := chunkDb.Get(ChunkKey(stored.Manifest.Id, 2)); chunk != nil {
+		t.Fatal("Chunks: Chunks of a deleted object were not removed")
+	}
+
+	// Someone who read a manifest can still read its chunks after the
+	// value is replaced, until they let go.
+	database.StoreLargeObject("b", "k", &Meta{}, bytes.NewReader(value), 100, false)
+	release := database.HoldChunks()
+	stored, _, _ = database.GetObject("b", "k")
+	later := database.HoldChunks()
+	if _, err := database.StoreLargeObject("b", "k", &Meta{}, bytes.NewReader(value), 100, false); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	reader, err = database.OpenChunks("b", stored.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(read, value) {
+		t.Fatal("Chunks: Replaced value read back", len(read), "bytes", err)
+	}
+	reader.Close()
+	later()
+	if chunk, _ := chunkDb.Get(ChunkKey(stored.Manifest.Id, 0)); chunk != nil {
+		t.Fatal("Chunks: Chunks of a replaced value were kept after every reader let go")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := bytes.Repeat([]byte("purple "), 100)
+	for _, codec := range []string{CodecNone, CodecGzip, CodecDeflate, CodecSnappy} {
+		compressed, err := Compress(codec, value)
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		if codec != CodecNone && len(compressed) >= len(value) {
+			t.Fatal("Compression:", codec, "did not compress")
+		}
+		decompressed, err := Decompress(codec, compressed)
+		if err != nil || !bytes.Equal(decompressed, value) {
+			t.Fatal("Compression:", codec, "did not round trip", err)
+		}
+	}
+	if _, err := Compress("zip", value); err == nil {
+		t.Fatal("Compression: Unknown codec accepted")
+	}
+}
+
+func TestMigrateBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir, testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	db, err := database.GetBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &Meta{ContentType: "text/plain"}
+	for _, key := range []string{"a", "b"} {
+		db.Put([]byte(key), encodeLegacyData(meta, []byte(key)), false)
+	}
+	db.Put([]byte("c"), encodeV1Data(meta, []byte("c")), false)
+	db.Put([]byte("e"), encodeV2Data(meta, []byte("e")), false)
+	current, _ := EncodeData(meta, []byte("d"))
+	db.Put([]byte("d"), current, false)
+	// A legacy record whose meta length runs past its end, ahead of the
+	// others it must not hold up.
+	damagedRecord := []byte{0, 0, 0x7f, 0, '{', '}'}
+	db.Put([]byte("0"), damagedRecord, false)
+
+	var damaged []string
+	scanned, migrated, err := database.MigrateBucket(context.Background(), "b", func(key []byte, err error) {
+		damaged = append(damaged, string(key))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 6 || migrated != 4 {
+		t.Fatal("Migrate: Scanned", scanned, "and migrated", migrated)
+	}
+	if len(damaged) != 1 || damaged[0] != "0" {
+		t.Fatal("Migrate: Reported", damaged, "as damaged")
+	}
+	if record, _ := db.Get([]byte("0")); !bytes.Equal(record, damagedRecord) {
+		t.Fatal("Migrate: The damaged record was changed", record)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		record, _ := db.Get([]byte(key))
+		if EnvelopeVersionOf(record) != EnvelopeVersion {
+			t.Fatal("Migrate: Record", key, "was not migrated")
+		}
+		decodedMeta, data, err := DecodeData(record)
+		if err != nil || decodedMeta.ContentType != "text/plain" || string(data) != key {
+			t.Fatal("Migrate: Record", key, "changed", decodedMeta, data, err)
+		}
+	}
+
+	if _, migrated, _ = database.MigrateBucket(context.Background(), "b", nil); migrated != 0 {
+		t.Fatal("Migrate: Second run migrated", migrated)
+	}
+}
+
+func TestScrubBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", testBackends(t), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", testBackends(t), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	for _, key := range []string{"good", "flipped"} {
+		if err := database.StoreObject("b", key, &Meta{ContentType: "text/plain"}, []byte("value"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"large", "rotten"} {
+		if _, err := database.StoreLargeObject("b", key, &Meta{}, strings.NewReader(strings.Repeat("x", 250)), 100, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := database.GetBucketNoCreate("b")
+	record, _ := db.Get([]byte("flipped"))
+	record[len(record)-1] ^= 1
+	db.Put([]byte("flipped"), record, false)
+	large, _, _ := database.GetObject("b", "large")
+	database.ChunkDatabase.GetBucketNoCreate("b").Delete(ChunkKey(large.Manifest.Id, 1), false)
+	rotten, _, _ := database.GetObject("b", "rotten")
+	database.ChunkDatabase.GetBucketNoCreate("b").Put(ChunkKey(rotten.Manifest.Id, 0), []byte(strings.Repeat("y", 100)), false)
+
+	if _, _, err := database.GetObject("b", "flipped"); err != ErrChecksum {
+		t.Fatal("Scrub: Reading a damaged object gave", err)
+	}
+
+	var damaged []Damage
+	read := 0
+	scanned, err := database.ScrubBucket(context.Background(), "b", func(n int) { read += n }, func(damage Damage) {
+		damaged = append(damaged, damage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 4 || read < 200 {
+		t.Fatal("Scrub: Scanned", scanned, "records and read", read, "bytes")
+	}
+	if len(damaged) != 3 || damaged[0].Key != "flipped" || damaged[0].Problem != ErrChecksum.Error() ||
+		damaged[1].Key != "large" || damaged[1].Problem != "chunk 1 is missing" ||
+		damaged[2].Key != "rotten" || damaged[2].Problem != "chunk 0 does not match its checksum" {
+		t.Fatal("Scrub: Found", damaged)
+	}
+
+	// Damaged objects can be repaired by writing them again.
+	if err := database.StoreObject("b", "flipped", &Meta{}, []byte("new"), false); err != nil {
+		t.Fatal("Scrub: Overwriting a damaged object failed:", err)
+	}
+	if _, data, err := database.GetObject("b", "flipped"); err != nil || string(data) != "new" {
+		t.Fatal("Scrub: Overwritten object reads", string(data), err)
+	}
+}
+
+// bitcask only finds a damaged record when it reads it, which must not end
+// the scrub.
+func TestScrubBitcask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-scrub-bitcask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", SingleBackend(Bitcask), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", SingleBackend(Bitcask), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", SingleBackend(Bitcask), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := database.StoreObject("b", key, &Meta{}, []byte("value of "+key), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := bitcaskPath(dir+"/data/b", 0, bitcaskDataSuffix)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := bytes.Index(data, []byte("value of b"))
+	if at < 0 {
+		t.Fatal("Scrub: The value is not in the data file")
+	}
+	data[at] ^= 1
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var damaged []Damage
+	scanned, err := database.ScrubBucket(context.Background(), "b", nil, func(damage Damage) {
+		damaged = append(damaged, damage)
+	})
+	if err != nil {
+		t.Fatal("Scrub: A corrupt record ended the scrub:", err)
+	}
+	if scanned != 3 || len(damaged) != 1 || damaged[0].Key != "b" ||
+		damaged[0].Problem != "reading the record failed: "+errBitcaskCorrupt.Error() {
+		t.Fatal("Scrub: Scanned", scanned, "and found", damaged)
+	}
+}
+
+func TestReindexBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", testBackends(t), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", testBackends(t), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		meta := &Meta{Indexes: [][2]string{{"colour_bin", "purple,green"}}}
+		if err := database.StoreObject("b", key, meta, []byte(key), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Drift: b is missing from one entry, a gone key and a duplicate are
+	// listed in another, and a third is made up entirely.
+	indexDb := database.IndexDatabase.GetBucketNoCreate("b")
+	indexDb.Put([]byte("colour_bin~purple"), []byte("a\tc"), false)
+	indexDb.Put([]byte("colour_bin~green"), []byte("a\tb\tc\tgone\ta"), false)
+	indexDb.Put([]byte("colour_bin~red"), []byte("a"), false)
+
+	result, err := database.ReindexBucket(context.Background(), "b", ReindexReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Scanned != 3 || result.Entries != 2 || len(result.Diffs) != 3 {
+		t.Fatalf("Reindex: Reported %+v", result)
+	}
+	byValue := make(map[string]IndexDiff)
+	for _, diff := range result.Diffs {
+		byValue[diff.Value] = diff
+	}
+	if diff := byValue["purple"]; len(diff.Missing) != 1 || diff.Missing[0] != "b" || len(diff.Extra) != 0 {
+		t.Fatalf("Reindex: Bad purple diff %+v", diff)
+	}
+	if diff := byValue["green"]; len(diff.Missing) != 0 || strings.Join(diff.Extra, ",") != "gone,a" {
+		t.Fatalf("Reindex: Bad green diff %+v", diff)
+	}
+	if diff := byValue["red"]; diff.Field != "colour_bin" || strings.Join(diff.Extra, ",") != "a" {
+		t.Fatalf("Reindex: Bad red diff %+v", diff)
+	}
+	if keys, _ := indexDb.Get([]byte("colour_bin~red")); keys == nil {
+		t.Fatal("Reindex: Reporting changed the index")
+	}
+
+	for _, mode := range []int{ReindexRepair, ReindexRebuild} {
+		if _, err := database.ReindexBucket(context.Background(), "b", mode); err != nil {
+			t.Fatal(err)
+		}
+		indexDb = database.IndexDatabase.GetBucketNoCreate("b")
+		for entry, expected := range map[string]string{"colour_bin~purple": "a\tb\tc", "colour_bin~green": "a\tb\tc", "colour_bin~red": ""} {
+			if keys, _ := indexDb.Get([]byte(entry)); string(keys) != expected {
+				t.Fatalf("Reindex: Mode %d left %s as %q", mode, entry, keys)
+			}
+		}
+		if result, _ := database.ReindexBucket(context.Background(), "b", ReindexReport); len(result.Diffs) != 0 {
+			t.Fatalf("Reindex: Mode %d left differences %+v", mode, result.Diffs)
+		}
+	}
+}
+
+// A reindex holds up writes to its own bucket and no other.
+func TestReindexLocksOneBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-reindex-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", testBackends(t), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", testBackends(t), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	lock := database.bucketLock("reindexed")
+	lock.Lock()
+	stored := make(chan error)
+	go func() {
+		// Enough buckets that one sharing a lock with it would turn up.
+		for i := 0; i < 100; i++ {
+			if err := database.StoreObject(fmt.Sprintf("b%d", i), "k", &Meta{}, []byte("v"), false); err != nil {
+				stored <- err
+				return
+			}
+		}
+		stored <- nil
+	}()
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reindex: Writes to other buckets waited for the reindex")
+	}
+
+	go func() {
+		stored <- database.StoreObject("reindexed", "k", &Meta{}, []byte("v"), false)
+	}()
+	select {
+	case <-stored:
+		t.Fatal("Reindex: A write to the bucket did not wait for the reindex")
+	case <-time.After(50 * time.Millisecond):
+	}
+	lock.Unlock()
+	if err := <-stored; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckBucket(t *testing.T) {
+	InitializeLinkRegexp()
+	dir, err := ioutil.TempDir("", "levelupdb-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir+"/data", testBackends(t), EngineOptions{}, nil)
+	database.IndexDatabase = NewDatabase(dir+"/_indexes", testBackends(t), EngineOptions{}, nil)
+	database.ChunkDatabase = NewDatabase(dir+"/_chunks", testBackends(t), EngineOptions{}, nil)
+	defer database.Close()
+	defer database.IndexDatabase.Close()
+	defer database.ChunkDatabase.Close()
+
+	meta := &Meta{Indexes: [][2]string{{"colour_bin", "purple"}}, Links: `</buckets/b/keys/a>; riaktag="self", </buckets/b/keys/nobody>; riaktag="friend"`}
+	for _, key := range []string{"a", "b"} {
+		if err := database.StoreObject("b", key, meta, []byte(key), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.StoreObject("b", "plain", &Meta{}, nil, false)
+	if _, err := database.StoreLargeObject("b", "large", &Meta{}, strings.NewReader("0123456789"), 4, false); err != nil {
+		t.Fatal(err)
+	}
+
+	indexDb := database.IndexDatabase.GetBucketNoCreate("b")
+	indexDb.Put([]byte("colour_bin~purple"), []byte("a\ta\tgone\tplain"), false)
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate("b")
+	chunkDb.Put(ChunkKey("deadbeefdeadbeef", 0), []byte("left"), false)
+	chunkDb.Put(ChunkKey("deadbeefdeadbeef", 1), []byte("over"), false)
+
+	check := func(fix bool) map[string][]Problem {
+		problems := make(map[string][]Problem)
+		scanned, err := database.CheckBucket(context.Background(), "b", fix, func(problem Problem) {
+			problems[problem.Type] = append(problems[problem.Type], problem)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanned != 4 {
+			t.Fatal("Fsck: Scanned", scanned)
+		}
+		return problems
+	}
+
+	problems := check(false)
+	expected := map[string]string{
+		ProblemMissingIndex:  "b",
+		ProblemDuplicateKey:  "a",
+		ProblemMissingObject: "gone",
+		ProblemStaleIndex:    "plain",
+		ProblemDanglingLink:  "a,b",
+	}
+	for kind, keys := range expected {
+		var found []string
+		for _, problem := range problems[kind] {
+			found = append(found, problem.Key)
+		}
+		if strings.Join(found, ",") != keys {
+			t.Fatal("Fsck:", kind, "found for", found, "instead of", keys)
+		}
+	}
+	if link := problems[ProblemDanglingLink][0].Link; link != "b/nobody" {
+		t.Fatal("Fsck: Dangling link to", link)
+	}
+	if orphans := problems[ProblemOrphanChunks]; len(orphans) != 1 || orphans[0].Upload != "deadbeefdeadbeef" || orphans[0].Fixed {
+		t.Fatal("Fsck: Orphan chunks", orphans)
+	}
+
+	problems = check(true)
+	if len(problems[ProblemOrphanChunks]) != 1 || !problems[ProblemOrphanChunks][0].Fixed || !problems[ProblemStaleIndex][0].Fixed {
+		t.Fatal("Fsck: Fix did not report fixing", problems)
+	}
+	problems = check(false)
+	if len(problems) != 1 || len(problems[ProblemDanglingLink]) != 2 {
+		t.Fatal("Fsck: Left after fixing", problems)
+	}
+	large, _, err := database.GetObject("b", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := database.OpenChunks("b", large.Manifest)
+	if err != nil {
+		t.Fatal("Fsck: Large object lost chunks", err)
+	}
+	defer reader.Close()
+	if value, _ := ioutil.ReadAll(reader); string(value) != "0123456789" {
+		t.Fatal("Fsck: Large object reads", string(value))
+	}
+}
+
+// Checks what every engine has to do the same way.
+func testEngine(t *testing.T, driver Driver) {
+	dir, err := ioutil.TempDir("", "levelupdb-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := driver.Open(dir, EngineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := []byte("1")
+	for _, key := range []string{"b", "d", "a", "c"} {
+		if err := db.Put([]byte(key), value, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value[0] = '2' // The engine has its own copy.
+	if got, err := db.Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Fatal("Engine: Get returned", string(got), err)
+	}
+	if got, err := db.Get([]byte("x")); got != nil || err != nil {
+		t.Fatal("Engine: Get of a missing key returned", got, err)
+	}
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	batch := new(Batch)
+	batch.Put([]byte("e"), []byte("5"))
+	batch.Delete([]byte("b"))
+	batch.Put([]byte("a"), []byte("0"))
+	if err := db.Write(batch, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(new(Batch), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("d"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(it Iterator) string {
+		defer it.Close()
+		var keys []string
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		if err := it.GetError(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	if got := keys(db.NewIterator(true)); got != "a=0 c=1 e=5" {
+		t.Fatal("Engine: Iterated over", got)
+	}
+	if got := keys(snapshot.NewIterator(false)); got != "a=1 b=1 c=1 d=1" {
+		t.Fatal("Engine: Snapshot iterated over", got)
+	}
+	if got, _ := snapshot.Get([]byte("d")); string(got) != "1" {
+		t.Fatal("Engine: Snapshot lost a deleted key")
+	}
+
+	it := db.NewIterator(true)
+	defer it.Close()
+	if it.Seek([]byte("b")); !it.Valid() || string(it.Key()) != "c" {
+		t.Fatal("Engine: Seek did not stop at the next key")
+	}
+	if it.Prev(); !it.Valid() || string(it.Key()) != "a" {
+		t.Fatal("Engine: Prev did not go back")
+	}
+	if it.Prev(); it.Valid() {
+		t.Fatal("Engine: Prev went before the first key")
+	}
+	if it.SeekToLast(); !it.Valid() || string(it.Key()) != "e" {
+		t.Fatal("Engine: SeekToLast did not find the last key")
+	}
+	if it.Seek([]byte("f")); it.Valid() {
+		t.Fatal("Engine: Seek past the end is valid")
+	}
+
+	// An empty value is still a value, and can be deleted like any other.
+	for _, empty := range [][]byte{{}, nil} {
+		if err := db.Put([]byte("empty"), empty, false); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.Get([]byte("empty")); got == nil || len(got) != 0 || err != nil {
+			t.Fatalf("Engine: Get of an empty value returned %#v, %v", got, err)
+		}
+		emptySnapshot := db.NewSnapshot()
+		got, err := emptySnapshot.Get([]byte("empty"))
+		emptySnapshot.Release()
+		if got == nil || len(got) != 0 || err != nil {
+			t.Fatalf("Engine: Snapshot Get of an empty value returned %#v, %v", got, err)
+		}
+		if got := keys(db.NewIterator(true)); got != "a=0 c=1 e=5 empty=" {
+			t.Fatal("Engine: Iterated over", got)
+		}
+		if err := db.Delete([]byte("empty"), false); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.Get([]byte("empty")); got != nil || err != nil {
+			t.Fatal("Engine: Get of a deleted empty value returned", got, err)
+		}
+		if got := keys(db.NewIterator(true)); got != "a=0 c=1 e=5" {
+			t.Fatal("Engine: Deleting an empty value left", got)
+		}
+	}
+}
+
+func TestLevelDBEngine(t *testing.T) {
+	testEngine(t, LevelDB)
+}
+
+func TestMemoryEngine(t *testing.T) {
+	testEngine(t, Memory)
+}
+
+// Puts and deletes a lot in random order to go through every way the
+// memory engine's tree splits and merges, checking it against a map.
+func TestMemoryEngineRandom(t *testing.T) {
+	db, _ := Memory.Open("", EngineOptions{})
+	defer db.Close()
+	random := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	check := func(it Iterator, want map[string]string) {
+		defer it.Close()
+		keys := make([]string, 0, len(want))
+		for key := range want {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if i >= len(keys) || string(it.Key()) != keys[i] || string(it.Value()) != want[keys[i]] {
+				t.Fatalf("Memory: Item %d is %s, expected %s", i, it.Key(), keys[i])
+			}
+			i++
+		}
+		if i != len(keys) {
+			t.Fatalf("Memory: Iterated over %d keys instead of %d", i, len(keys))
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			i--
+			if string(it.Key()) != keys[i] {
+				t.Fatalf("Memory: Item %d going back is %s, expected %s", i, it.Key(), keys[i])
+			}
+		}
+		if i != 0 {
+			t.Fatalf("Memory: Going back stopped %d keys early", i)
+		}
+		for probe := 0; probe < 50; probe++ {
+			key := fmt.Sprintf("%05d", random.Intn(5000))
+			i := sort.SearchStrings(keys, key)
+			if it.Seek([]byte(key)); it.Valid() != (i < len(keys)) || (i < len(keys) && string(it.Key()) != keys[i]) {
+				t.Fatalf("Memory: Seek to %s did not find %d", key, i)
+			}
+			if !it.Valid() {
+				continue
+			}
+			if it.Prev(); it.Valid() != (i > 0) || (i > 0 && string(it.Key()) != keys[i-1]) {
+				t.Fatalf("Memory: Prev after seeking to %s did not find %d", key, i-1)
+			}
+			if it.Valid() {
+				if it.Next(); string(it.Key()) != keys[i] {
+					t.Fatalf("Memory: Next after Prev did not come back to %d", i)
+				}
+			}
+		}
+	}
+
+	var snapshot Snapshot
+	var snapshotted map[string]string
+	for round := 0; round < 20000; round++ {
+		key := fmt.Sprintf("%05d", random.Intn(5000))
+		batch := new(Batch)
+		if random.Intn(3) == 0 {
+			batch.Delete([]byte(key))
+			delete(want, key)
+		} else {
+			value := strconv.Itoa(round)
+			batch.Put([]byte(key), []byte(value))
+			want[key] = value
+		}
+		if err := db.Write(batch, false); err != nil {
+			t.Fatal(err)
+		}
+		if round%2500 == 0 {
+			check(db.NewIterator(true), want)
+			if snapshot != nil {
+				check(snapshot.NewIterator(true), snapshotted)
+				snapshot.Release()
+			}
+			snapshot, snapshotted = db.NewSnapshot(), make(map[string]string)
+			for key, value := range want {
+				snapshotted[key] = value
+			}
+		}
+	}
+	check(db.NewIterator(true), want)
+	check(snapshot.NewIterator(true), snapshotted)
+
+	for key := range want {
+		db.Delete([]byte(key), false)
+	}
+	check(db.NewIterator(true), nil)
+}
+
+func TestBitcaskEngine(t *testing.T) {
+	testEngine(t, bitcaskDriver{maxFileSize: 64})
+}
+
+// Overwrites and deletes over lots of small files, which merge as they go,
+// then checks it all comes back on opening again, with hints and without,
+// and that a batch cut short counts for nothing.
+func TestBitcaskRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-bitcask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	driver := bitcaskDriver{maxFileSize: 256}
+	db, err := driver.Open(dir, EngineOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db interface {
+		Get([]byte) ([]byte, error)
+		NewIterator(bool) Iterator
+	}, want map[string]string) {
+		it := db.NewIterator(false)
+		defer it.Close()
+		n := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if value := string(it.Value()); value != want[string(it.Key())] {
+				t.Fatalf("Bitcask: %s is %q, expected %q", it.Key(), value, want[string(it.Key())])
+			}
+			n++
+		}
+		if err := it.GetError(); err != nil || n != len(want) {
+			t.Fatalf("Bitcask: Iterated over %d keys instead of %d: %v", n, len(want), err)
+		}
+		for key, value := range want {
+			if got, err := db.Get([]byte(key)); err != nil || string(got) != value {
+				t.Fatalf("Bitcask: Get %s returned %q, %v", key, got, err)
+			}
+		}
+	}
+
+	random := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+	var snapshot Snapshot
+	var snapshotted map[string]string
+	written := 0
+	for round := 0; round < 3000; round++ {
+		key := fmt.Sprintf("%03d", random.Intn(100))
+		if random.Intn(4) == 0 {
+			err = db.Delete([]byte(key), false)
+			delete(want, key)
+		} else {
+			err = db.Put([]byte(key), []byte(strconv.Itoa(round)), false)
+			want[key] = strconv.Itoa(round)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += bitcaskHeaderSize + 3 + len(want[key])
+		if round == 1000 {
+			snapshot, snapshotted = db.NewSnapshot(), make(map[string]string)
+			for key, value := range want {
+				snapshotted[key] = value
+			}
+		}
+	}
+	if err := db.(*bitcask).mergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	check(db, want)
+	// Merges removed the files the snapshot reads from, but not for it.
+	check(snapshot, snapshotted)
+	snapshot.Release()
+	if size := db.(Introspector).ApproximateSize(); size == 0 || size > uint64(written)/4 {
+		t.Fatalf("Bitcask: %d bytes on disk after writing %d, expected merging to take most of it", size, written)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func() {
+		if db, err = driver.Open(dir, EngineOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		check(db, want)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen()
+	hints, _ := filepath.Glob(dir + "/*" + bitcaskHintSuffix)
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+	reopen()
+	if rewritten, _ := filepath.Glob(dir + "/*" + bitcaskHintSuffix); len(rewritten) != len(hints) {
+		t.Fatalf("Bitcask: %d hints were written again, expected %d", len(rewritten), len(hints))
+	}
+
+	ids, _ := bitcaskFileIDs(dir)
+	last := ids[len(ids)-1]
+	f, err := os.OpenFile(bitcaskPath(dir, last, bitcaskDataSuffix), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := appendBitcaskRecord(nil, 0, []byte("000"), []byte("torn"))
+	torn = appendBitcaskRecord(torn, bitcaskBatchEnd, []byte("001"), []byte("torn"))
+	f.Write(torn[:len(torn)-2])
+	f.Close()
+	os.Remove(bitcaskPath(dir, last, bitcaskHintSuffix))
+	reopen()
+}
+
+// Overwriting the same keys merges the garbage away before the active file
+// fills up, depending on the file size the options ask for.
+func TestBitcaskMergeTrigger(t *testing.T) {
+	for _, test := range []struct {
+		maxFileSize int
+		merged      bool
+	}{
+		{4096, true},
+		{0, false}, // 256 MB
+	} {
+		dir, err := ioutil.TempDir("", "levelupdb-bitcask")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := Bitcask.Open(dir, EngineOptions{Bitcask: BitcaskOptions{MaxFileSize: test.maxFileSize}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value := bytes.Repeat([]byte("v"), 100)
+		written := 0
+		for i := 0; i < 30; i++ {
+			if err := db.Put([]byte("k"), value, false); err != nil {
+				t.Fatal(err)
+			}
+			written += bitcaskHeaderSize + 1 + len(value)
+		}
+		db.(*bitcask).merges.Wait()
+		if got, err := db.Get([]byte("k")); err != nil || !bytes.Equal(got, value) {
+			t.Fatal("Bitcask: Get after merging returned", len(got), "bytes", err)
+		}
+		size := db.(Introspector).ApproximateSize()
+		if merged := size < uint64(written); merged != test.merged {
+			t.Errorf("Bitcask: %d bytes on disk after writing %d to files of %d", size, written, test.maxFileSize)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (BitcaskOptions{MaxFileSize: -1}).Validate(); err == nil {
+		t.Error("Bitcask: A negative file size is valid")
+	}
+}
+
+func TestBucketOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	props, err := OpenPropsStore(Memory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer props.Close()
+	backends := &Backends{Default: LevelDB, Props: props, Named: map[string]Backend{
+		"hot": {Engine: "bitcask", Bitcask: BitcaskOptions{MaxFileSize: 2048}},
+	}}
+	defaults := EngineOptions{LevelDB: LevelDBOptions{BlockCacheSize: 100}, Bitcask: BitcaskOptions{MaxFileSize: 1024}}
+	database := NewDatabase(dir, backends, defaults, props)
+
+	// Defaults, then the backend's, then the bucket's own.
+	for bucket, bucketProps := range map[string]*BucketProps{
+		"plain": {},
+		"hot":   {Backend: "hot"},
+		"own":   {Backend: "hot", Bitcask: BitcaskOptions{MaxFileSize: 4096}},
+	} {
+		if err := props.Set(bucket, bucketProps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for bucket, expected := range map[string]int{"plain": 1024, "hot": 2048, "own": 4096} {
+		options, err := database.BucketOptions(bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options.Bitcask.MaxFileSize != expected || options.LevelDB.BlockCacheSize != 100 {
+			t.Errorf("Options: %s got %+v, expected a max file size of %d", bucket, options, expected)
+		}
+	}
+
+	if err := props.Set("bad", &BucketProps{Bitcask: BitcaskOptions{MaxFileSize: -1}}); err == nil {
+		t.Error("Options: A negative bitcask file size was accepted")
+	}
+}
+
+// A bucket whose backend changed under it, say by editing the config, is
+// not opened in an engine that cannot see what it holds.
+func TestBucketStoredByAnotherEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelupdb-stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewDatabase(dir, SingleBackend(Bitcask), EngineOptions{}, nil)
+	db, err := database.GetBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k"), []byte("v"), true)
+	database.Close()
+	if stored := StoredBy(dir + "/b"); stored != "bitcask" {
+		t.Fatalf("Expected the bucket to be stored by bitcask, not %q", stored)
+	}
+
+	database = NewDatabase(dir+"/empty", SingleBackend(LevelDB), EngineOptions{}, nil)
+	os.MkdirAll(dir+"/empty/b", 0755)
+	if _, err := database.GetBucket("b"); err != nil {
+		t.Fatal("An empty directory is anyone's:", err)
+	}
+	database.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Opened a bitcask bucket with leveldb")
+		}
+	}()
+	NewDatabase(dir, SingleBackend(LevelDB), EngineOptions{}, nil)
+}
@@ -0,0 +1,106 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A named engine configuration, like one of the backends of Riak's
+// riak_kv_multi_backend. Buckets are kept in it by setting their backend
+// property to its name.
+type Backend struct {
+	Engine  string         // See DriverNamed.
+	LevelDB LevelDBOptions // Over the defaults. A bucket's own go over these.
+	Bitcask BitcaskOptions // Likewise.
+}
+
+func (backend Backend) Options() EngineOptions {
+	return EngineOptions{LevelDB: backend.LevelDB, Bitcask: backend.Bitcask}
+}
+
+func (backend Backend) Validate() error {
+	if DriverNamed(backend.Engine) == nil {
+		return fmt.Errorf("Engine must be leveldb, memory or bitcask, not %q", backend.Engine)
+	}
+	return backend.Options().Validate()
+}
+
+// Where the buckets of a database, and their indexes and chunks, are kept.
+// A bucket whose backend property is empty is kept in Default. Besides the
+// Named backends the property can name a driver, which then has no options
+// of its own.
+type Backends struct {
+	Default Driver
+	Named   map[string]Backend
+	Props   *PropsStore // nil means every bucket is kept in Default.
+}
+
+// Backends that keep every bucket in driver.
+func SingleBackend(driver Driver) *Backends {
+	return &Backends{Default: driver}
+}
+
+// The driver and options of the backend called name, or false if there is
+// no such backend.
+func (backends *Backends) Lookup(name string) (Driver, EngineOptions, bool) {
+	if name == "" {
+		return backends.Default, EngineOptions{}, true
+	}
+	if backend, ok := backends.Named[name]; ok {
+		return DriverNamed(backend.Engine), backend.Options(), true
+	}
+	driver := DriverNamed(name)
+	return driver, EngineOptions{}, driver != nil
+}
+
+// Whether a bucket's backend property may be set to name.
+func (backends *Backends) Check(name string) error {
+	if _, _, ok := backends.Lookup(name); ok {
+		return nil
+	}
+	names := make([]string, 0, len(backends.Named)+len(drivers))
+	for named := range backends.Named {
+		names = append(names, named)
+	}
+	for driver := range drivers {
+		names = append(names, driver)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("backend must be one of %s, not %q", strings.Join(names, ", "), name)
+}
+
+// The name of the backend bucket is kept in, "" for Default, with its
+// driver and options. A backend that was taken out of the configuration
+// is an error rather than Default, which would lose the bucket's data.
+func (backends *Backends) Bucket(bucket string) (string, Driver, EngineOptions, error) {
+	name := ""
+	if backends.Props != nil {
+		props, err := backends.Props.Get(bucket)
+		if err != nil {
+			return "", nil, EngineOptions{}, err
+		}
+		name = props.Backend
+	}
+	driver, options, ok := backends.Lookup(name)
+	if !ok {
+		return "", nil, EngineOptions{}, fmt.Errorf("bucket %s is kept in backend %q, which is not configured", bucket, name)
+	}
+	return name, driver, options, nil
+}
@@ -0,0 +1,858 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Riak's default backend. Every write is appended to the active data file
+// and the keydir, kept in memory, says where the latest value of each key
+// is, so a read is one lookup and one disk read. Once more than half of
+// the files is overwritten or deleted they are merged into one holding
+// only what is still live. The keydir is ordered, so iterators and
+// snapshots work as they do with the other engines, only slower.
+var Bitcask Driver = bitcaskDriver{maxFileSize: 256 << 20}
+
+type bitcaskDriver struct {
+	maxFileSize int64 // Unless the options have their own MaxFileSize.
+}
+
+var (
+	errBitcaskClosed  = errors.New("bitcask engine is closed")
+	errBitcaskCorrupt = errors.New("bitcask record is corrupt")
+)
+
+// A record is a CRC-32 of the rest of it, its flags, the key and value
+// lengths, the key and the value, all big endian. A hint file has what the
+// records of its data file have but their values and checksums, followed by
+// a CRC-32 of all of it.
+const (
+	bitcaskHeaderSize = 4 + 1 + 4 + 4
+	bitcaskHintSize   = 1 + 4 + 4 + 8
+
+	bitcaskTombstone = 1 // The key was deleted.
+	bitcaskBatchEnd  = 2 // The last record of a batch. The ones before it count only once it is there.
+
+	bitcaskDataSuffix = ".bitcask.data"
+	bitcaskHintSuffix = ".bitcask.hint"
+)
+
+// Where a value is. Positions are what the keydir maps keys to.
+type bitcaskPosition struct {
+	file   uint32
+	offset int64  // Of the record.
+	size   uint32 // Of the value.
+}
+
+func (position bitcaskPosition) encode() []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint32(data, position.file)
+	binary.BigEndian.PutUint64(data[4:], uint64(position.offset))
+	binary.BigEndian.PutUint32(data[12:], position.size)
+	return data
+}
+
+func decodeBitcaskPosition(data []byte) bitcaskPosition {
+	return bitcaskPosition{
+		file:   binary.BigEndian.Uint32(data),
+		offset: int64(binary.BigEndian.Uint64(data[4:])),
+		size:   binary.BigEndian.Uint32(data[12:]),
+	}
+}
+
+func (position bitcaskPosition) recordSize(key []byte) int64 {
+	return bitcaskHeaderSize + int64(len(key)) + int64(position.size)
+}
+
+// A record as the keydir sees it.
+type bitcaskEntry struct {
+	key       []byte
+	position  bitcaskPosition
+	tombstone bool
+}
+
+type bitcaskFile struct {
+	id   uint32
+	file *os.File
+	size int64 // These two are guarded by the engine's writeLock.
+	dead int64 // Bytes of records something later replaced.
+	refs int32 // The engine's, and those of snapshots and merges using the file.
+}
+
+func (file *bitcaskFile) acquire() {
+	atomic.AddInt32(&file.refs, 1)
+}
+
+// The file is closed once nothing uses it. Merged files are removed from
+// disk while snapshots may still read them, which they can until then.
+func (file *bitcaskFile) release() {
+	if atomic.AddInt32(&file.refs, -1) == 0 {
+		file.file.Close()
+	}
+}
+
+// Reads the value at position and checks it is key's and intact.
+func (file *bitcaskFile) read(position bitcaskPosition, key []byte) ([]byte, error) {
+	record := make([]byte, position.recordSize(key))
+	if _, err := file.file.ReadAt(record, position.offset); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(record) != crc32.ChecksumIEEE(record[4:]) ||
+		!bytes.Equal(record[bitcaskHeaderSize:bitcaskHeaderSize+len(key)], key) {
+		return nil, errBitcaskCorrupt
+	}
+	return record[bitcaskHeaderSize+len(key):], nil
+}
+
+type bitcask struct {
+	location    string
+	maxFileSize int64 // The active file is rolled over once it would grow past this.
+	keydir      *memoryEngine
+	diskSize    int64 // Atomic.
+	closing     int32 // Atomic. Set once Close has begun, which merges give way to.
+	merges      sync.WaitGroup
+
+	writeLock  sync.Mutex // Serializes writers, rolling over and finishing merges.
+	active     *bitcaskFile
+	activeHint []byte // The hint for the active file, written once it is done.
+	nextID     uint32
+	merging    chan struct{} // Closed once the running merge is done, nil if there is none.
+	mergeErr   error         // Of the last merge.
+
+	lock  sync.RWMutex
+	files map[uint32]*bitcaskFile // Replaced, never changed. nil once closed.
+}
+
+func bitcaskPath(location string, id uint32, suffix string) string {
+	return path.Join(location, fmt.Sprintf("%09d%s", id, suffix))
+}
+
+func (driver bitcaskDriver) Open(location string, options EngineOptions) (Engine, error) {
+	if err := os.MkdirAll(location, 0755); err != nil {
+		return nil, err
+	}
+	ids, err := bitcaskFileIDs(location)
+	if err != nil {
+		return nil, err
+	}
+
+	engine := &bitcask{location: location, maxFileSize: driver.maxFileSize, keydir: newMemoryEngine()}
+	if options.Bitcask.MaxFileSize > 0 {
+		engine.maxFileSize = int64(options.Bitcask.MaxFileSize)
+	}
+	engine.files = make(map[uint32]*bitcaskFile)
+	for _, id := range ids {
+		if err = engine.load(id); err != nil {
+			break
+		}
+		engine.nextID = id + 1
+	}
+	// What was active before is never appended to again, so its hint
+	// stays right.
+	if err == nil {
+		engine.writeLock.Lock()
+		err = engine.startActive()
+		engine.writeLock.Unlock()
+	}
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (bitcaskDriver) Destroy(location string) error {
+	return os.RemoveAll(location)
+}
+
+func (bitcaskDriver) Holds(location string) bool {
+	names, _ := filepath.Glob(path.Join(location, "*"+bitcaskDataSuffix))
+	return len(names) > 0
+}
+
+// The ids of the data files in location, in the order they were written.
+// Files a crash left half written are removed.
+func bitcaskFileIDs(location string) ([]uint32, error) {
+	infos, err := ioutil.ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path.Join(location, name))
+			continue
+		}
+		if !strings.HasSuffix(name, bitcaskDataSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, bitcaskDataSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// Adds a data file to the keydir, from its hint if it has a good one, and
+// makes one if it does not.
+func (engine *bitcask) load(id uint32) error {
+	f, err := os.Open(bitcaskPath(engine.location, id, bitcaskDataSuffix))
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file := &bitcaskFile{id: id, file: f, size: info.Size(), refs: 1}
+	engine.files[id] = file
+	atomic.AddInt64(&engine.diskSize, file.size)
+
+	entries, ok := readBitcaskHint(bitcaskPath(engine.location, id, bitcaskHintSuffix), id)
+	if !ok {
+		var hint []byte
+		if entries, hint, err = scanBitcaskData(f, id, file.size); err != nil {
+			return err
+		}
+		if err = writeBitcaskHint(bitcaskPath(engine.location, id, bitcaskHintSuffix), hint); err != nil {
+			return err
+		}
+	}
+	return engine.apply(entries)
+}
+
+// The records of a data file up to the first one that is torn or corrupt,
+// less those of the batch that was being written then, with the hint that
+// goes with them.
+func scanBitcaskData(f *os.File, id uint32, size int64) (entries []bitcaskEntry, hint []byte, err error) {
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	var pending []bitcaskEntry
+	var pendingHint []byte
+	header := make([]byte, bitcaskHeaderSize)
+	for offset := int64(0); ; {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		flags := header[4]
+		keySize := int64(binary.BigEndian.Uint32(header[5:]))
+		valueSize := int64(binary.BigEndian.Uint32(header[9:]))
+		if offset+bitcaskHeaderSize+keySize+valueSize > size {
+			break
+		}
+		body := make([]byte, keySize+valueSize)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return nil, nil, err
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, body)
+		if crc != binary.BigEndian.Uint32(header) {
+			break
+		}
+
+		entry := bitcaskEntry{key: body[:keySize], tombstone: flags&bitcaskTombstone != 0}
+		entry.position = bitcaskPosition{file: id, offset: offset, size: uint32(valueSize)}
+		pending = append(pending, entry)
+		pendingHint = appendBitcaskHint(pendingHint, entry)
+		if flags&bitcaskBatchEnd != 0 {
+			entries = append(entries, pending...)
+			hint = append(hint, pendingHint...)
+			pending, pendingHint = pending[:0], pendingHint[:0]
+		}
+		offset += bitcaskHeaderSize + keySize + valueSize
+	}
+	return entries, hint, nil
+}
+
+func appendBitcaskRecord(data []byte, flags byte, key, value []byte) []byte {
+	start := len(data)
+	var header [bitcaskHeaderSize]byte
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(value)))
+	data = append(data, header[:]...)
+	data = append(data, key...)
+	data = append(data, value...)
+	binary.BigEndian.PutUint32(data[start:], crc32.ChecksumIEEE(data[start+4:]))
+	return data
+}
+
+func appendBitcaskHint(hint []byte, entry bitcaskEntry) []byte {
+	var header [bitcaskHintSize]byte
+	if entry.tombstone {
+		header[0] = bitcaskTombstone
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(entry.key)))
+	binary.BigEndian.PutUint32(header[5:], entry.position.size)
+	binary.BigEndian.PutUint64(header[9:], uint64(entry.position.offset))
+	hint = append(hint, header[:]...)
+	return append(hint, entry.key...)
+}
+
+// Hints only save reading the data file, so they are not synced; a torn
+// one fails its checksum and the data file is read instead.
+func writeBitcaskHint(name string, hint []byte) error {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(hint))
+	data := append(hint[:len(hint):len(hint)], crc[:]...)
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// The entries of a hint file, or false if it is missing or not intact.
+func readBitcaskHint(name string, id uint32) ([]bitcaskEntry, bool) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil || len(data) < 4 {
+		return nil, false
+	}
+	hint := data[:len(data)-4]
+	if binary.BigEndian.Uint32(data[len(hint):]) != crc32.ChecksumIEEE(hint) {
+		return nil, false
+	}
+	var entries []bitcaskEntry
+	for len(hint) > 0 {
+		if len(hint) < bitcaskHintSize {
+			return nil, false
+		}
+		keySize := int(binary.BigEndian.Uint32(hint[1:]))
+		if len(hint) < bitcaskHintSize+keySize {
+			return nil, false
+		}
+		entry := bitcaskEntry{key: hint[bitcaskHintSize : bitcaskHintSize+keySize], tombstone: hint[0]&bitcaskTombstone != 0}
+		entry.position = bitcaskPosition{
+			file:   id,
+			offset: int64(binary.BigEndian.Uint64(hint[9:])),
+			size:   binary.BigEndian.Uint32(hint[5:]),
+		}
+		entries = append(entries, entry)
+		hint = hint[bitcaskHintSize+keySize:]
+	}
+	return entries, true
+}
+
+// Points the keydir at records just written, in order, and counts what
+// they replace as dead. Must be called with writeLock held, or while the
+// engine is being opened.
+func (engine *bitcask) apply(entries []bitcaskEntry) error {
+	before := engine.keydir.current().root
+	replaced := make(map[string]*bitcaskEntry) // By the entries before.
+	batch := new(Batch)
+	for i := range entries {
+		entry := &entries[i]
+		if last, ok := replaced[string(entry.key)]; ok {
+			if !last.tombstone {
+				engine.files[last.position.file].dead += last.position.recordSize(last.key)
+			}
+		} else if old := before.get(entry.key); old != nil {
+			position := decodeBitcaskPosition(old)
+			engine.files[position.file].dead += position.recordSize(entry.key)
+		}
+		replaced[string(entry.key)] = entry
+
+		if entry.tombstone {
+			// Needed only until the records it deletes are merged away.
+			engine.files[entry.position.file].dead += entry.position.recordSize(entry.key)
+			batch.Delete(entry.key)
+		} else {
+			batch.Put(entry.key, entry.position.encode())
+		}
+	}
+	return engine.keydir.Write(batch, false)
+}
+
+func (engine *bitcask) Get(key []byte) ([]byte, error) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	if engine.files == nil {
+		return nil, errBitcaskClosed
+	}
+	return readBitcask(engine.files, engine.keydir.current().root, key)
+}
+
+func readBitcask(files map[uint32]*bitcaskFile, keydir *memoryNode, key []byte) ([]byte, error) {
+	data := keydir.get(key)
+	if data == nil {
+		return nil, nil
+	}
+	position := decodeBitcaskPosition(data)
+	return files[position.file].read(position, key)
+}
+
+func (engine *bitcask) Put(key, value []byte, sync bool) error {
+	batch := new(Batch)
+	batch.Put(key, value)
+	return engine.Write(batch, sync)
+}
+
+func (engine *bitcask) Delete(key []byte, sync bool) error {
+	batch := new(Batch)
+	batch.Delete(key)
+	return engine.Write(batch, sync)
+}
+
+// A batch is appended in one go and never split between files. Should the
+// engine stop halfway through, the records written count for nothing.
+func (engine *bitcask) Write(batch *Batch, sync bool) error {
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	if engine.active == nil {
+		return errBitcaskClosed
+	}
+	if batch.Len() == 0 {
+		if sync {
+			return engine.active.file.Sync()
+		}
+		return nil
+	}
+
+	var data []byte
+	entries := make([]bitcaskEntry, 0, batch.Len())
+	add := func(flags byte, key, value []byte) {
+		if len(entries) == batch.Len()-1 {
+			flags |= bitcaskBatchEnd
+		}
+		entry := bitcaskEntry{key: key, tombstone: flags&bitcaskTombstone != 0}
+		entry.position = bitcaskPosition{offset: int64(len(data)), size: uint32(len(value))}
+		entries = append(entries, entry)
+		data = appendBitcaskRecord(data, flags, key, value)
+	}
+	batch.Replay(func(key, value []byte) {
+		add(0, key, value)
+	}, func(key []byte) {
+		add(bitcaskTombstone, key, nil)
+	})
+
+	if engine.active.size > 0 && engine.active.size+int64(len(data)) > engine.maxFileSize {
+		if err := engine.roll(); err != nil {
+			return err
+		}
+	}
+	active := engine.active
+	if _, err := active.file.WriteAt(data, active.size); err != nil {
+		return err
+	}
+	if sync {
+		if err := active.file.Sync(); err != nil {
+			return err
+		}
+	}
+	for i := range entries {
+		entries[i].position.file = active.id
+		entries[i].position.offset += active.size
+		engine.activeHint = appendBitcaskHint(engine.activeHint, entries[i])
+	}
+	active.size += int64(len(data))
+	atomic.AddInt64(&engine.diskSize, int64(len(data)))
+	if err := engine.apply(entries); err != nil {
+		return err
+	}
+
+	// Rolling over starts a merge when one is due. Waiting for the active
+	// file to fill up would leave a store that mostly overwrites the same
+	// keys with its garbage for as long as that takes. Small stores wait
+	// for a quarter of a file's worth, so they do not merge every few
+	// writes, and after a merge failed the next roll tries again.
+	if engine.merging == nil && engine.mergeErr == nil {
+		if size, dead := engine.usage(); mergeDue(size, dead) && dead >= engine.maxFileSize/4 {
+			return engine.roll()
+		}
+	}
+	return nil
+}
+
+// The bytes in every file, and how many of them are dead. Must be called
+// with writeLock held.
+func (engine *bitcask) usage() (size, dead int64) {
+	for _, file := range engine.files {
+		size += file.size
+		dead += file.dead
+	}
+	return size, dead
+}
+
+func mergeDue(size, dead int64) bool {
+	return dead*2 > size
+}
+
+// Finishes the active file and starts another. Must be called with
+// writeLock held.
+func (engine *bitcask) roll() error {
+	if err := engine.finishActive(); err != nil {
+		return err
+	}
+	return engine.startActive()
+}
+
+// Syncs the active file and writes its hint, or removes it if nothing was
+// written to it.
+func (engine *bitcask) finishActive() error {
+	active := engine.active
+	if active.size == 0 {
+		engine.removeFiles(active)
+		os.Remove(bitcaskPath(engine.location, active.id, bitcaskDataSuffix))
+		engine.active = nil
+		return nil
+	}
+	if err := active.file.Sync(); err != nil {
+		return err
+	}
+	if err := writeBitcaskHint(bitcaskPath(engine.location, active.id, bitcaskHintSuffix), engine.activeHint); err != nil {
+		return err
+	}
+	engine.active, engine.activeHint = nil, nil
+	return nil
+}
+
+// Starts a merge of every file there is if that is due, then creates the
+// next active file. The merge's file goes before the active one, so that
+// what is written while it runs wins when the files are next loaded.
+func (engine *bitcask) startActive() error {
+	return engine.startActiveMerging(false)
+}
+
+func (engine *bitcask) startActiveMerging(force bool) error {
+	var inputs []*bitcaskFile
+	for _, file := range engine.files {
+		inputs = append(inputs, file)
+	}
+	size, dead := engine.usage()
+	if engine.merging == nil && (force || mergeDue(size, dead)) && len(inputs) > 0 && atomic.LoadInt32(&engine.closing) == 0 {
+		sort.Slice(inputs, func(i, j int) bool { return inputs[i].id < inputs[j].id })
+		for _, file := range inputs {
+			file.acquire()
+		}
+		engine.merging = make(chan struct{})
+		engine.merges.Add(1)
+		go engine.merge(inputs, engine.nextID, engine.keydir.current().root)
+		engine.nextID++
+	}
+
+	id := engine.nextID
+	f, err := os.OpenFile(bitcaskPath(engine.location, id, bitcaskDataSuffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	engine.nextID++
+	engine.active = &bitcaskFile{id: id, file: f, refs: 1}
+	engine.addFiles(engine.active)
+	return nil
+}
+
+// The files map is replaced rather than changed, so snapshots can keep the
+// one they were taken with.
+func (engine *bitcask) addFiles(added ...*bitcaskFile) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	files := make(map[uint32]*bitcaskFile, len(engine.files)+len(added))
+	for id, file := range engine.files {
+		files[id] = file
+	}
+	for _, file := range added {
+		files[file.id] = file
+	}
+	engine.files = files
+}
+
+func (engine *bitcask) removeFiles(removed ...*bitcaskFile) {
+	engine.lock.Lock()
+	files := make(map[uint32]*bitcaskFile, len(engine.files))
+	for id, file := range engine.files {
+		files[id] = file
+	}
+	for _, file := range removed {
+		delete(files, file.id)
+	}
+	engine.files = files
+	engine.lock.Unlock()
+	for _, file := range removed {
+		file.release()
+	}
+}
+
+// Writes the live records of inputs into a file of its own, which then
+// takes their place. keydir is what the keydir was when the inputs were
+// all there was.
+func (engine *bitcask) merge(inputs []*bitcaskFile, id uint32, keydir *memoryNode) {
+	defer engine.merges.Done()
+	name := bitcaskPath(engine.location, id, bitcaskDataSuffix)
+	err := engine.mergeInto(inputs, id, name, keydir)
+	if err != nil {
+		os.Remove(name)
+		os.Remove(bitcaskPath(engine.location, id, bitcaskHintSuffix))
+	}
+	for _, file := range inputs {
+		file.release()
+	}
+	engine.writeLock.Lock()
+	close(engine.merging)
+	engine.merging, engine.mergeErr = nil, err
+	engine.writeLock.Unlock()
+}
+
+// Merges every file there is, however little of it is dead, and waits for
+// that to finish. A merge already running is waited for first.
+func (engine *bitcask) mergeAll() error {
+	engine.writeLock.Lock()
+	for engine.merging != nil {
+		running := engine.merging
+		engine.writeLock.Unlock()
+		<-running
+		engine.writeLock.Lock()
+	}
+	if engine.active == nil {
+		engine.writeLock.Unlock()
+		return errBitcaskClosed
+	}
+	err := engine.finishActive()
+	if err == nil {
+		err = engine.startActiveMerging(true)
+	}
+	running := engine.merging
+	engine.writeLock.Unlock()
+	if err != nil || running == nil {
+		return err
+	}
+
+	<-running
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	return engine.mergeErr
+}
+
+func (engine *bitcask) mergeInto(inputs []*bitcaskFile, id uint32, name string, keydir *memoryNode) (err error) {
+	files := make(map[uint32]*bitcaskFile, len(inputs))
+	for _, file := range inputs {
+		files[file.id] = file
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	output := &bitcaskFile{id: id, file: f, refs: 1}
+	installed := false
+	defer func() {
+		if !installed {
+			f.Close()
+		}
+	}()
+
+	// The keys whose records moved, with where they were and are now.
+	type move struct {
+		key, from, to []byte
+	}
+	var moves []move
+	var hint []byte
+	writer := bufio.NewWriter(f)
+	it := &memoryIterator{root: keydir}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if atomic.LoadInt32(&engine.closing) != 0 {
+			return errBitcaskClosed
+		}
+		position := decodeBitcaskPosition(it.Value())
+		var value []byte
+		if value, err = files[position.file].read(position, it.Key()); err != nil {
+			return err
+		}
+		entry := bitcaskEntry{key: it.Key(), position: bitcaskPosition{file: id, offset: output.size, size: position.size}}
+		record := appendBitcaskRecord(nil, bitcaskBatchEnd, entry.key, value)
+		if _, err = writer.Write(record); err != nil {
+			return err
+		}
+		output.size += int64(len(record))
+		hint = appendBitcaskHint(hint, entry)
+		moves = append(moves, move{entry.key, it.Value(), entry.position.encode()})
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = writeBitcaskHint(bitcaskPath(engine.location, id, bitcaskHintSuffix), hint); err != nil {
+		return err
+	}
+
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	if atomic.LoadInt32(&engine.closing) != 0 {
+		return errBitcaskClosed
+	}
+	// Keys written since the merge started keep their new values.
+	current := engine.keydir.current().root
+	batch := new(Batch)
+	for _, move := range moves {
+		if bytes.Equal(current.get(move.key), move.from) {
+			batch.Put(move.key, move.to)
+		} else {
+			output.dead += bitcaskHeaderSize + int64(len(move.key)) + int64(decodeBitcaskPosition(move.to).size)
+		}
+	}
+	// Readers must never see the keydir point at a file that is not there.
+	engine.addFiles(output)
+	installed = true
+	if err = engine.keydir.Write(batch, false); err != nil {
+		engine.removeFiles(output)
+		return err
+	}
+	engine.removeFiles(inputs...)
+	atomic.AddInt64(&engine.diskSize, output.size)
+
+	// Oldest first: until a file with a tombstone goes, so have the files
+	// with the records it deleted.
+	for _, file := range inputs {
+		os.Remove(bitcaskPath(engine.location, file.id, bitcaskHintSuffix))
+		os.Remove(bitcaskPath(engine.location, file.id, bitcaskDataSuffix))
+		atomic.AddInt64(&engine.diskSize, -file.size)
+	}
+	return nil
+}
+
+// Iterators read the keydir as it was when they were made, and values from
+// the files that were there then.
+func (engine *bitcask) NewIterator(fillCache bool) Iterator {
+	snapshot := engine.NewSnapshot().(*bitcaskSnapshot)
+	it := snapshot.NewIterator(fillCache).(*bitcaskIterator)
+	it.owned = true
+	return it
+}
+
+func (engine *bitcask) NewSnapshot() Snapshot {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	if engine.files == nil {
+		return &bitcaskSnapshot{}
+	}
+	for _, file := range engine.files {
+		file.acquire()
+	}
+	return &bitcaskSnapshot{keydir: engine.keydir.current().root, files: engine.files}
+}
+
+// Waits for a merge to give up, then closes the active file like any other.
+func (engine *bitcask) Close() error {
+	atomic.StoreInt32(&engine.closing, 1)
+	// No merge starts once closing is set and this lock has been had.
+	engine.writeLock.Lock()
+	engine.writeLock.Unlock()
+	engine.merges.Wait()
+
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	var err error
+	if engine.active != nil {
+		err = engine.finishActive()
+	}
+	engine.active = nil
+
+	engine.lock.Lock()
+	files := engine.files
+	engine.files = nil
+	engine.lock.Unlock()
+	for _, file := range files {
+		file.release()
+	}
+	engine.keydir.Close()
+	return err
+}
+
+func (engine *bitcask) Property(name string) string {
+	return ""
+}
+
+func (engine *bitcask) ApproximateSize() uint64 {
+	return uint64(atomic.LoadInt64(&engine.diskSize))
+}
+
+func (engine *bitcask) CacheCapacity() uint64 {
+	return 0
+}
+
+type bitcaskSnapshot struct {
+	keydir *memoryNode
+	files  map[uint32]*bitcaskFile // nil if the engine was closed, or once released.
+}
+
+func (snapshot *bitcaskSnapshot) Get(key []byte) ([]byte, error) {
+	if snapshot.files == nil {
+		return nil, errBitcaskClosed
+	}
+	return readBitcask(snapshot.files, snapshot.keydir, key)
+}
+
+func (snapshot *bitcaskSnapshot) NewIterator(fillCache bool) Iterator {
+	it := &bitcaskIterator{memoryIterator: &memoryIterator{root: snapshot.keydir}, snapshot: snapshot}
+	if snapshot.files == nil {
+		it.err = errBitcaskClosed
+	}
+	return it
+}
+
+func (snapshot *bitcaskSnapshot) Release() {
+	for _, file := range snapshot.files {
+		file.release()
+	}
+	snapshot.files = nil
+}
+
+// Walks the keydir, reading values only when asked for them.
+type bitcaskIterator struct {
+	*memoryIterator
+	snapshot *bitcaskSnapshot
+	owned    bool // The snapshot was made for the iterator and goes with it.
+	err      error
+}
+
+func (it *bitcaskIterator) Value() []byte {
+	position := decodeBitcaskPosition(it.memoryIterator.Value())
+	value, err := it.snapshot.files[position.file].read(position, it.Key())
+	if err != nil {
+		it.err = err
+	}
+	return value
+}
+
+func (it *bitcaskIterator) GetError() error {
+	return it.err
+}
+
+func (it *bitcaskIterator) Close() {
+	it.memoryIterator.Close()
+	if it.owned {
+		it.snapshot.Release()
+	}
+}
@@ -0,0 +1,350 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Large values are split into fixed size chunks kept in ChunkDatabase, one
+// bucket there per bucket here. Each upload gets a random id and its chunks
+// are stored under that id followed by the chunk number, so a new upload
+// never touches the chunks of the value it replaces. The object itself only
+// holds its Meta, whose Manifest says where the value went.
+type Manifest struct {
+	Id        string `json:"i"`
+	Size      int64  `json:"s"`
+	ChunkSize int    `json:"c"`
+
+	// The CRC32C of each chunk. The record checksum only covers the
+	// manifest, so without these a damaged chunk would go unnoticed.
+	// Manifests written before there were any have none.
+	Checksums []uint32 `json:"k,omitempty"`
+
+	// The codec each chunk is compressed with on its own, so that any one
+	// of them can be read without the others. The checksums are of the
+	// chunks as stored.
+	Codec string `json:"z,omitempty"`
+}
+
+func (manifest *Manifest) Chunks() int64 {
+	return (manifest.Size + int64(manifest.ChunkSize) - 1) / int64(manifest.ChunkSize)
+}
+
+// Whether chunk n holds what was stored in it, as far as the manifest knows.
+func (manifest *Manifest) Verify(n int64, chunk []byte) bool {
+	return n >= int64(len(manifest.Checksums)) || manifest.Checksums[n] == crc32.Checksum(chunk, crcTable)
+}
+
+func ChunkKey(id string, n int64) []byte {
+	key := make([]byte, len(id)+8)
+	copy(key, id)
+	binary.BigEndian.PutUint64(key[len(id):], uint64(n))
+	return key
+}
+
+func newUploadId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Streams value into chunks, compressed with the bucket's codec, then
+// stores the object with a manifest for them. Until the manifest is written
+// readers keep seeing the old value, and the old value's chunks are removed
+// once nobody reads them any more. Returns the value's size.
+func (database *Database) StoreLargeObject(bucket, key string, meta *Meta, value io.Reader, chunkSize int, durable bool) (int64, error) {
+	if chunkSize < 1 {
+		return 0, errors.New("chunk size must be positive")
+	}
+	chunkDb, err := database.ChunkDatabase.GetBucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	id, err := newUploadId()
+	if err != nil {
+		return 0, err
+	}
+
+	codec, err := database.bucketCodec(bucket)
+	if err != nil {
+		return 0, err
+	}
+	manifest := &Manifest{Id: id, ChunkSize: chunkSize}
+	chunk := make([]byte, chunkSize)
+	for n := int64(0); ; n++ {
+		read, err := io.ReadFull(value, chunk)
+		if read > 0 {
+			stored, err := compressChunk(bucket, codec, manifest, chunk[:read])
+			if err == nil {
+				err = chunkDb.Put(ChunkKey(id, n), stored, false)
+			}
+			if err != nil {
+				database.DeleteChunks(bucket, manifest)
+				return 0, err
+			}
+			manifest.Size += int64(read)
+			manifest.Checksums = append(manifest.Checksums, crc32.Checksum(stored, crcTable))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			database.DeleteChunks(bucket, manifest)
+			return 0, err
+		}
+	}
+
+	// The chunks have to be on disk before a manifest that points at them.
+	if durable {
+		if err := database.sync(chunkDb); err != nil {
+			database.DeleteChunks(bucket, manifest)
+			return 0, err
+		}
+	}
+
+	meta.Manifest = manifest
+	if err := database.StoreObject(bucket, key, meta, nil, durable); err != nil {
+		database.DeleteChunks(bucket, manifest)
+		return 0, err
+	}
+	return manifest.Size, nil
+}
+
+// Compresses the next chunk of manifest with codec. The manifest has one
+// codec for all of its chunks, so the first chunk decides: if it does not
+// get any smaller, none of them are compressed.
+func compressChunk(bucket, codec string, manifest *Manifest, chunk []byte) ([]byte, error) {
+	if codec == "" || codec == CodecNone || (manifest.Size > 0 && manifest.Codec == "") {
+		return chunk, nil
+	}
+	compressed, err := Compress(codec, chunk)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Size == 0 && len(compressed) >= len(chunk) {
+		compressionStats.add(bucket, len(chunk), len(chunk))
+		return chunk, nil
+	}
+	compressionStats.add(bucket, len(chunk), len(compressed))
+	manifest.Codec = codec
+	return compressed, nil
+}
+
+// Decompresses chunk n of manifest as stored, checking that it holds as
+// many bytes as it should.
+func (manifest *Manifest) decompressChunk(n int64, chunk []byte) ([]byte, error) {
+	if manifest.Codec == "" {
+		return chunk, nil
+	}
+	data, err := Decompress(manifest.Codec, chunk)
+	if err != nil {
+		return nil, err
+	}
+	expected := manifest.Size - n*int64(manifest.ChunkSize)
+	if expected > int64(manifest.ChunkSize) {
+		expected = int64(manifest.ChunkSize)
+	}
+	if int64(len(data)) != expected {
+		return nil, fmt.Errorf("holds %d bytes instead of %d", len(data), expected)
+	}
+	return data, nil
+}
+
+// Makes everything written to db so far durable.
+func (database *Database) sync(db Engine) error {
+	if database.GroupCommit != nil {
+		return database.GroupCommit.Sync(db)
+	}
+	return db.Write(new(Batch), true)
+}
+
+// A reader learns of a manifest from the object before it can open its
+// chunks, which are in another engine, so no one snapshot covers both. The
+// chunks of a replaced or deleted value are therefore kept until everyone
+// who may have read its manifest by then is done reading.
+type chunkReaders struct {
+	lock    sync.Mutex
+	next    uint64          // Number of the next reader.
+	active  map[uint64]bool // Readers that have not let go yet.
+	pending []pendingChunks // Oldest first.
+}
+
+type pendingChunks struct {
+	before   uint64 // Waits for every reader numbered below this.
+	bucket   string
+	manifest *Manifest
+}
+
+// Keeps the chunks of any manifest read from here on until the returned
+// function is called.
+func (database *Database) HoldChunks() func() {
+	readers := &database.chunkReaders
+	readers.lock.Lock()
+	defer readers.lock.Unlock()
+	if readers.active == nil {
+		readers.active = make(map[uint64]bool)
+	}
+	reader := readers.next
+	readers.next++
+	readers.active[reader] = true
+
+	var once sync.Once
+	return func() { once.Do(func() { database.releaseChunks(reader) }) }
+}
+
+func (database *Database) releaseChunks(reader uint64) {
+	readers := &database.chunkReaders
+	readers.lock.Lock()
+	delete(readers.active, reader)
+	oldest := readers.next
+	for active := range readers.active {
+		if active < oldest {
+			oldest = active
+		}
+	}
+	ready := 0
+	for ready < len(readers.pending) && readers.pending[ready].before <= oldest {
+		ready++
+	}
+	deletions := readers.pending[:ready]
+	readers.pending = readers.pending[ready:]
+	readers.lock.Unlock()
+
+	// Should a deletion fail, fsck finds the chunks nothing points at.
+	for _, deletion := range deletions {
+		database.DeleteChunks(deletion.bucket, deletion.manifest)
+	}
+}
+
+// Deletes the chunks of a value that was replaced or deleted, right away
+// unless someone may still be about to read them.
+func (database *Database) dropChunks(bucket string, manifest *Manifest) error {
+	readers := &database.chunkReaders
+	readers.lock.Lock()
+	if len(readers.active) > 0 {
+		readers.pending = append(readers.pending, pendingChunks{readers.next, bucket, manifest})
+		readers.lock.Unlock()
+		return nil
+	}
+	readers.lock.Unlock()
+	return database.DeleteChunks(bucket, manifest)
+}
+
+func (database *Database) DeleteChunks(bucket string, manifest *Manifest) error {
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate(bucket)
+	if chunkDb == nil {
+		return nil
+	}
+	wb := new(Batch)
+	for n := int64(0); n < manifest.Chunks(); n++ {
+		wb.Delete(ChunkKey(manifest.Id, n))
+	}
+	return chunkDb.Write(wb, false)
+}
+
+// Reads a chunked value one chunk at a time. It reads from a snapshot, so
+// the value stays readable even if it is overwritten meanwhile, as long as
+// its manifest was read while holding the chunks; see HoldChunks.
+type ChunkReader struct {
+	snapshot Snapshot
+	it       Iterator
+	manifest *Manifest
+	offset   int64
+	chunk    []byte
+	loaded   int64 // Number of the chunk in chunk, -1 for none.
+}
+
+func (database *Database) OpenChunks(bucket string, manifest *Manifest) (*ChunkReader, error) {
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate(bucket)
+	if chunkDb == nil {
+		return nil, fmt.Errorf("chunks of %s are missing", bucket)
+	}
+	reader := &ChunkReader{manifest: manifest, loaded: -1}
+	reader.snapshot = chunkDb.NewSnapshot()
+	// A large value read once would only push everything else out.
+	reader.it = reader.snapshot.NewIterator(false)
+	return reader, nil
+}
+
+func (reader *ChunkReader) Size() int64 {
+	return reader.manifest.Size
+}
+
+func (reader *ChunkReader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.manifest.Size {
+		return 0, io.EOF
+	}
+
+	chunkSize := int64(reader.manifest.ChunkSize)
+	n := reader.offset / chunkSize
+	if n != reader.loaded {
+		chunkKey := ChunkKey(reader.manifest.Id, n)
+		reader.it.Seek(chunkKey)
+		if err := reader.it.GetError(); err != nil {
+			return 0, err
+		}
+		if !reader.it.Valid() || !bytes.Equal(reader.it.Key(), chunkKey) {
+			return 0, fmt.Errorf("chunk %d of %s is missing", n, reader.manifest.Id)
+		}
+		chunk := reader.it.Value()
+		if !reader.manifest.Verify(n, chunk) {
+			return 0, fmt.Errorf("chunk %d of %s does not match its checksum", n, reader.manifest.Id)
+		}
+		chunk, err := reader.manifest.decompressChunk(n, chunk)
+		if err != nil {
+			return 0, fmt.Errorf("chunk %d of %s does not decompress: %s", n, reader.manifest.Id, err)
+		}
+		reader.chunk, reader.loaded = chunk, n
+	}
+
+	start := reader.offset - n*chunkSize
+	if start >= int64(len(reader.chunk)) {
+		return 0, fmt.Errorf("chunk %d of %s is short", n, reader.manifest.Id)
+	}
+	read := copy(p, reader.chunk[start:])
+	reader.offset += int64(read)
+	return read, nil
+}
+
+func (reader *ChunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.manifest.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the value")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *ChunkReader) Close() {
+	reader.it.Close()
+	reader.snapshot.Release()
+}
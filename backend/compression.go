@@ -0,0 +1,181 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Codecs a bucket can compress its values with. leveldb compresses blocks
+// of small records well by itself; these are for values big enough to be
+// worth compressing on their own.
+const (
+	CodecNone    = "none"
+	CodecGzip    = "gzip"
+	CodecDeflate = "deflate"
+	CodecSnappy  = "snappy"
+)
+
+func ValidCodec(codec string) bool {
+	switch codec {
+	case "", CodecNone, CodecGzip, CodecDeflate, CodecSnappy:
+		return true
+	}
+	return false
+}
+
+func Compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, data), nil
+	}
+
+	buf := new(bytes.Buffer)
+	var err error
+	if codec == CodecGzip {
+		writer := gzip.NewWriter(buf)
+		if _, err = writer.Write(data); err == nil {
+			err = writer.Close()
+		}
+	} else if codec == CodecDeflate {
+		var writer *flate.Writer
+		if writer, err = flate.NewWriter(buf, flate.DefaultCompression); err == nil {
+			if _, err = writer.Write(data); err == nil {
+				err = writer.Close()
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	case CodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case CodecDeflate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// The codec a bucket's new values are written with.
+func (database *Database) bucketCodec(bucket string) (string, error) {
+	if database.Props == nil {
+		return "", nil
+	}
+	props, err := database.Props.Get(bucket)
+	if err != nil {
+		return "", err
+	}
+	return props.Compression, nil
+}
+
+// Compresses a value that is about to be stored in bucket, recording the
+// codec in meta. Values that do not get any smaller are kept as they are.
+// Chunked values have no data here; their chunks are compressed one by one
+// as they are stored, see compressChunk.
+func (database *Database) compressValue(bucket string, meta *Meta, data []byte) ([]byte, error) {
+	meta.Codec = ""
+	codec, err := database.bucketCodec(bucket)
+	if err != nil || codec == "" || codec == CodecNone || len(data) == 0 {
+		return data, err
+	}
+	compressed, err := Compress(codec, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(data) {
+		compressionStats.add(bucket, len(data), len(data))
+		return data, nil
+	}
+	compressionStats.add(bucket, len(data), len(compressed))
+	meta.Codec = codec
+	return compressed, nil
+}
+
+// Bytes handed to compression and what was stored, per bucket, since
+// startup.
+type CompressionCount struct {
+	Raw    uint64 `json:"raw_bytes"`
+	Stored uint64 `json:"stored_bytes"`
+}
+
+func (count CompressionCount) Ratio() float64 {
+	if count.Stored == 0 {
+		return 0
+	}
+	return float64(count.Raw) / float64(count.Stored)
+}
+
+type compressionCounter struct {
+	lock    sync.Mutex
+	buckets map[string]*CompressionCount
+}
+
+var compressionStats = &compressionCounter{buckets: make(map[string]*CompressionCount)}
+
+func (counter *compressionCounter) add(bucket string, raw, stored int) {
+	counter.lock.Lock()
+	count, ok := counter.buckets[bucket]
+	if !ok {
+		count = new(CompressionCount)
+		counter.buckets[bucket] = count
+	}
+	count.Raw += uint64(raw)
+	count.Stored += uint64(stored)
+	counter.lock.Unlock()
+}
+
+// Names of the buckets that compressed something, sorted, and their counts.
+func CompressionCounts() ([]string, map[string]CompressionCount) {
+	compressionStats.lock.Lock()
+	defer compressionStats.lock.Unlock()
+	names := make([]string, 0, len(compressionStats.buckets))
+	counts := make(map[string]CompressionCount, len(compressionStats.buckets))
+	for name, count := range compressionStats.buckets {
+		names = append(names, name)
+		counts[name] = *count
+	}
+	sort.Strings(names)
+	return names, counts
+}
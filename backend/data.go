@@ -17,34 +17,101 @@
 package backend
 
 import (
-	"encoding/json"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"strings"
 )
 
-func EncodeData(meta *Meta, data []byte) ([]byte, error) {
-	metaString, err := json.Marshal(meta)
+// Objects are stored in a versioned envelope:
+//
+//	0xfe | version | crc32c | uvarint meta length | meta | value
+//
+// The CRC32C, big endian, covers everything after it. Version 1 has no
+// checksum and the meta as JSON, version 2 no checksum and the meta in the
+// binary format of metacodec.go, version 3 is version 2 with the checksum.
+// Records written before the envelope existed start straight away with the
+// meta length as a big endian int32, so their first byte is always 0 and
+// they can never be mistaken for an envelope. DecodeData reads all of them;
+// migrate rewrites the old ones.
+const (
+	EnvelopeMagic   = 0xfe
+	EnvelopeVersion = 3
+)
 
-	if err != nil {
-		return nil, err
-	}
+// Returned by DecodeData for a record that was damaged after it was written.
+var ErrChecksum = errors.New("checksum mismatch")
 
-	length := int32(len(metaString))
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.BigEndian, length)
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
+func EncodeData(meta *Meta, data []byte) ([]byte, error) {
+	metaBytes, err := meta.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
 
-	buf.Write(metaString)
-	buf.Write(data)
-	return buf.Bytes(), nil
+	buf := make([]byte, 6+binary.MaxVarintLen64, 6+binary.MaxVarintLen64+len(metaBytes)+len(data))
+	buf[0] = EnvelopeMagic
+	buf[1] = EnvelopeVersion
+	buf = buf[:6+binary.PutUvarint(buf[6:], uint64(len(metaBytes)))]
+	buf = append(buf, metaBytes...)
+	buf = append(buf, data...)
+	binary.BigEndian.PutUint32(buf[2:6], crc32.Checksum(buf[6:], crcTable))
+	return buf, nil
+}
+
+// The envelope version a record was written with, 0 for the legacy layout.
+func EnvelopeVersionOf(data []byte) int {
+	if len(data) >= 2 && data[0] == EnvelopeMagic {
+		return int(data[1])
+	}
+	return 0
 }
 
 func DecodeData(data []byte) (*Meta, []byte, error) {
+	if len(data) < 2 || data[0] != EnvelopeMagic {
+		return decodeLegacyData(data)
+	}
+
+	version := data[1]
+	if version < 1 || version > 3 {
+		return nil, nil, fmt.Errorf("unknown envelope version %d", version)
+	}
+	header := 2
+	if version == 3 {
+		if len(data) < 6 {
+			return nil, nil, errors.New("corrupt envelope: no checksum")
+		}
+		if binary.BigEndian.Uint32(data[2:6]) != crc32.Checksum(data[6:], crcTable) {
+			return nil, nil, ErrChecksum
+		}
+		header = 6
+	}
+
+	length, n := binary.Uvarint(data[header:])
+	if n <= 0 || length > uint64(len(data)-header-n) {
+		return nil, nil, errors.New("corrupt envelope: bad meta length")
+	}
+	start := header + n
+	end := start + int(length)
+	meta := new(Meta)
+	var err error
+	if version == 1 {
+		err = json.Unmarshal(data[start:end], meta)
+	} else {
+		err = meta.UnmarshalBinary(data[start:end])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, data[end:], nil
+}
+
+func decodeLegacyData(data []byte) (*Meta, []byte, error) {
 	if len(data) < 5 {
 		return nil, nil, errors.New("Data length must be greater than 4!")
 	}
@@ -55,9 +122,12 @@ func DecodeData(data []byte) (*Meta, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if length < 0 || int(length) > len(data)-4 {
+		return nil, nil, errors.New("corrupt record: bad meta length")
+	}
 
 	meta := new(Meta)
-	length += 4 // Should never overflow, right?
+	length += 4
 	err = json.Unmarshal(data[4:length], meta)
 
 	if err != nil {
@@ -70,13 +140,41 @@ func DecodeData(data []byte) (*Meta, []byte, error) {
 
 // Object Manipulation Section
 
+// Writes to the same key are serialized through one of these, picked by a
+// hash of the bucket and key.
+const keyLockStripes = 256
+
+// Locks the key and returns the function that unlocks it.
+func (database *Database) lockKey(bucket, key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(bucket))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	lock := &database.keyLocks[hash.Sum32()%keyLockStripes]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Returns the value decompressed. meta.Codec still says how it is stored.
 func (database *Database) GetObject(bucket, key string) (*Meta, []byte, error) {
+	meta, data, err := database.GetEncodedObject(bucket, key)
+	if meta == nil || err != nil {
+		return meta, data, err
+	}
+	if data, err = Decompress(meta.Codec, data); err != nil {
+		return nil, nil, err
+	}
+	return meta, data, nil
+}
+
+// Returns the value as it is stored, compressed with meta.Codec.
+func (database *Database) GetEncodedObject(bucket, key string) (*Meta, []byte, error) {
 	db := database.GetBucketNoCreate(bucket)
 	if db == nil {
 		return nil, nil, nil
 	}
 
-	encodedData, err := db.Get(LReadOptions, []byte(key))
+	encodedData, err := db.Get([]byte(key))
 	if encodedData == nil {
 		return nil, nil, nil
 	}
@@ -92,7 +190,14 @@ func (database *Database) GetObject(bucket, key string) (*Meta, []byte, error) {
 	return meta, data, nil
 }
 
-func (database *Database) StoreObject(bucket, key string, meta *Meta, data []byte) error {
+// A durable store only returns once the object and its indexes are synced
+// to disk.
+func (database *Database) StoreObject(bucket, key string, meta *Meta, data []byte, durable bool) error {
+	// Reindexing the bucket waits for this write and holds off new ones.
+	lock := database.bucketLock(bucket)
+	lock.RLock()
+	defer lock.RUnlock()
+
 	db, err := database.GetBucket(bucket)
 	if err != nil {
 		return err
@@ -103,27 +208,37 @@ func (database *Database) StoreObject(bucket, key string, meta *Meta, data []byt
 		return err
 	}
 
+	if data, err = database.compressValue(bucket, meta, data); err != nil {
+		return err
+	}
 	encodedData, err := EncodeData(meta, data)
 	if err != nil {
 		return err
 	}
 
+	// The old record decides which indexes and chunks go away, so nobody
+	// else may change it until this write is done.
+	defer database.lockKey(bucket, key)()
+
 	bkey := []byte(key)
-	oldData, err := db.Get(LReadOptions, bkey)
+	oldData, err := db.Get(bkey)
 	if err != nil {
 		return err
 	}
 
 	var oldIndexes [][2]string
+	var oldManifest *Manifest
+	// A damaged record can still be overwritten, though whatever index
+	// entries and chunks it had are left behind.
 	if oldData != nil {
-		oldMeta, _, err := DecodeData(oldData)
-		if err != nil {
-			return err
+		if oldMeta, _, err := DecodeData(oldData); err == nil {
+			oldIndexes = oldMeta.Indexes
+			oldManifest = oldMeta.Manifest
 		}
-		oldIndexes = oldMeta.Indexes
 	}
 
-	if err = db.Put(LWriteOptions, bkey, encodedData); err != nil {
+	sync := database.syncWrite(durable)
+	if err = db.Put(bkey, encodedData, sync); err != nil {
 		return err
 	}
 
@@ -133,26 +248,39 @@ func (database *Database) StoreObject(bucket, key string, meta *Meta, data []byt
 		return err
 	}
 
-	if err := indexDb.Write(LWriteOptions, wb); err != nil {
+	if err := indexDb.Write(wb, sync); err != nil {
 		return err
 	}
 
+	if err := database.commit(durable, db, indexDb); err != nil {
+		return err
+	}
+	if oldManifest != nil {
+		return database.dropChunks(bucket, oldManifest)
+	}
 	return nil
 }
 
-func (database *Database) DeleteObject(bucket, key string) (int, error){
+func (database *Database) DeleteObject(bucket, key string, durable bool) (int, error) {
+	lock := database.bucketLock(bucket)
+	lock.RLock()
+	defer lock.RUnlock()
+
 	db := database.GetBucketNoCreate(bucket)
 	if db == nil {
 		return 404, nil
 	}
 
+	defer database.lockKey(bucket, key)()
+
 	bkey := []byte(key)
-	encodedData, _ := db.Get(LReadOptions, bkey)
+	encodedData, _ := db.Get(bkey)
 	if encodedData == nil {
 		return 404, nil
 	}
 
-	err := db.Delete(LWriteOptions, bkey)
+	sync := database.syncWrite(durable)
+	err := db.Delete(bkey, sync)
 	if err != nil {
 		return 500, err
 	}
@@ -174,10 +302,21 @@ func (database *Database) DeleteObject(bucket, key string) (int, error){
 				return 500, err
 			}
 
-			if err = indexDb.Write(LWriteOptions, wb); err != nil {
+			if err = indexDb.Write(wb, sync); err != nil {
 				return 500, err
 			}
+			if err = database.commit(durable, indexDb); err != nil {
+				return 500, err
+			}
+		}
+	}
+	if err = database.commit(durable, db); err != nil {
+		return 500, err
+	}
+	if meta != nil && meta.Manifest != nil {
+		if err = database.dropChunks(bucket, meta.Manifest); err != nil {
+			return 500, err
 		}
 	}
 	return 204, nil
-}
\ No newline at end of file
+}
@@ -17,44 +17,55 @@
 package backend
 
 import (
-	"os"
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
-	"github.com/jmhodges/levigo"
-	"bytes"
+	"sync"
 )
 
 type Database struct {
-	DBMap        map[string]*levigo.DB
-	BaseLocation string
+	DBMap         map[string]Engine
+	BaseLocation  string
+	Backends      *Backends // What the buckets are stored in.
 	IndexDatabase *Database
-}
+	ChunkDatabase *Database // Where the chunks of large values go.
+	Defaults      EngineOptions
+	Props         *PropsStore     // nil means every bucket uses its backend's options.
+	GroupCommit   *GroupCommitter // nil means durable writes sync on their own.
 
-var LReadOptions *levigo.ReadOptions
-var LWriteOptions *levigo.WriteOptions
+	lock            sync.RWMutex
+	keyLocks        [keyLockStripes]sync.Mutex
+	bucketLocksLock sync.Mutex
+	bucketLocks     map[string]*sync.RWMutex // See bucketLock.
+	chunkReaders    chunkReaders
+}
 
 func Initialize() {
-	InitializeLeveldbOptions()
 	InitializeLinkRegexp()
 }
 
-func InitializeLeveldbOptions() {
-	LReadOptions = levigo.NewReadOptions()
-	LWriteOptions = levigo.NewWriteOptions()
-}
-
 // Will panic if there is a problem with the database.
 // Should only be called on server initialization.
-func NewDatabase(databaseLocation string) *Database {
+func NewDatabase(databaseLocation string, backends *Backends, defaults EngineOptions, props *PropsStore) *Database {
 	buckets := new(Database)
-	buckets.DBMap = make(map[string]*levigo.DB)
+	buckets.DBMap = make(map[string]Engine)
+	buckets.bucketLocks = make(map[string]*sync.RWMutex)
 	buckets.BaseLocation = databaseLocation
+	buckets.Backends = backends
+	buckets.Defaults = defaults
+	buckets.Props = props
 
-	os.MkdirAll(databaseLocation, 0755)
-
+	// Nothing was stored yet, or it is all kept in memory.
 	files, err := ioutil.ReadDir(databaseLocation)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return buckets
+	} else if err != nil {
 		panic(err)
 	}
 
@@ -62,73 +73,216 @@ func NewDatabase(databaseLocation string) *Database {
 		if !file.IsDir() || strings.HasPrefix(file.Name(), "_") {
 			continue
 		}
-		opts := levigo.NewOptions()
-		opts.SetCreateIfMissing(true)
-		opts.SetCache(levigo.NewLRUCache(4194304))
-		buckets.DBMap[file.Name()], err = levigo.Open(path.Join(databaseLocation, file.Name()), opts)
-		if err != nil {
+		if _, err = buckets.openBucket(file.Name()); err != nil {
 			panic(err)
 		}
 	}
 	return buckets
 }
 
-func (buckets *Database) GetBucket(name string) (*levigo.DB, error) {
+// The options a bucket is opened with: the defaults, then those of its
+// backend, then the bucket's own leveldb and bitcask properties. Changed properties
+// apply the next time the bucket is opened, which for an existing bucket
+// means the next restart.
+func (buckets *Database) BucketOptions(name string) (EngineOptions, error) {
+	_, _, options, err := buckets.Backends.Bucket(name)
+	if err != nil {
+		return buckets.Defaults, err
+	}
+	options = buckets.Defaults.Merge(options)
+	if buckets.Props == nil {
+		return options, nil
+	}
+	props, err := buckets.Props.Get(name)
+	if err != nil {
+		return options, err
+	}
+	return options.Merge(props.Options()), nil
+}
+
+var ErrBucketNotEmpty = errors.New("the backend of a bucket can only change while it is empty")
+
+// Sets a bucket's properties. A bucket that changes engines has to start
+// over in the new one, along with its indexes and chunks, so only an empty
+// bucket can, and writes to it wait while it does.
+func (buckets *Database) SetBucketProps(name string, props *BucketProps) error {
+	if err := buckets.Backends.Check(props.Backend); err != nil {
+		return err
+	}
+	lock := buckets.bucketLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, driver, _, err := buckets.Backends.Bucket(name)
+	if err != nil {
+		return err
+	}
+	if next, _, _ := buckets.Backends.Lookup(props.Backend); next != driver {
+		if !buckets.IsBucketEmpty(name) {
+			return ErrBucketNotEmpty
+		}
+		for _, database := range []*Database{buckets, buckets.IndexDatabase, buckets.ChunkDatabase} {
+			if database == nil {
+				continue
+			}
+			if err := database.DestroyBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	return buckets.Props.Set(name, props)
+}
+
+// Must be called with the write lock held, or before the database is shared.
+func (buckets *Database) openBucket(name string) (Engine, error) {
+	options, err := buckets.BucketOptions(name)
+	if err != nil {
+		return nil, err
+	}
+	backend, driver, _, err := buckets.Backends.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another engine would not see what is there, and would write over it.
+	location := path.Join(buckets.BaseLocation, name)
+	if stored := StoredBy(location); stored != "" && !driver.Holds(location) {
+		return nil, fmt.Errorf("bucket %s is stored by %s, which its backend %q does not use", name, stored, backend)
+	}
+	db, err := driver.Open(location, options)
+	if err != nil {
+		return nil, err
+	}
+	buckets.DBMap[name] = db
+	return db, nil
+}
+
+func (buckets *Database) GetBucket(name string) (Engine, error) {
+	if db := buckets.GetBucketNoCreate(name); db != nil {
+		return db, nil
+	}
+
+	buckets.lock.Lock()
+	defer buckets.lock.Unlock()
 	if db, ok := buckets.DBMap[name]; ok {
 		return db, nil
 	}
-	opts := levigo.NewOptions()
-	opts.SetCreateIfMissing(true)
-	opts.SetCache(levigo.NewLRUCache(4194304))
-	var err error
-	buckets.DBMap[name], err = levigo.Open(path.Join(buckets.BaseLocation, name), opts)
-	return buckets.DBMap[name], err
+	return buckets.openBucket(name)
 }
 
-func (buckets *Database) GetBucketNoCreate(name string) *levigo.DB {
+func (buckets *Database) GetBucketNoCreate(name string) Engine {
+	buckets.lock.RLock()
+	defer buckets.lock.RUnlock()
 	if db, ok := buckets.DBMap[name]; ok {
 		return db
 	}
 	return nil
 }
 
+// Closes every bucket, which frees their caches. Nothing may use the
+// database afterwards.
+func (buckets *Database) Close() {
+	buckets.lock.Lock()
+	defer buckets.lock.Unlock()
+	for _, db := range buckets.DBMap {
+		db.Close()
+	}
+	buckets.DBMap = make(map[string]Engine)
+	buckets.bucketLocks = make(map[string]*sync.RWMutex)
+}
+
+func (buckets *Database) OpenBucketCount() int {
+	buckets.lock.RLock()
+	defer buckets.lock.RUnlock()
+	return len(buckets.DBMap)
+}
+
+// What leveldb says its memtables and caches use, summed over every open
+// bucket. Older leveldb versions do not report this and count as zero.
+func (buckets *Database) ApproximateMemoryUsage() uint64 {
+	buckets.lock.RLock()
+	defer buckets.lock.RUnlock()
+	var total uint64
+	for _, db := range buckets.DBMap {
+		introspector, ok := db.(Introspector)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(introspector.Property("leveldb.approximate-memory-usage"), 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// The configured block cache sizes, summed over every open bucket.
+func (buckets *Database) BlockCacheCapacity() uint64 {
+	buckets.lock.RLock()
+	defer buckets.lock.RUnlock()
+	var total uint64
+	for _, db := range buckets.DBMap {
+		if introspector, ok := db.(Introspector); ok {
+			total += introspector.CacheCapacity()
+		}
+	}
+	return total
+}
+
 func (buckets *Database) DestroyBucket(name string) error {
-	if _, ok := buckets.DBMap[name]; ok {
+	buckets.lock.Lock()
+	defer buckets.lock.Unlock()
+	if db, ok := buckets.DBMap[name]; ok {
+		db.Close()
 		delete(buckets.DBMap, name)
-		return levigo.DestroyDatabase(name, levigo.NewOptions())
+		_, driver, _, err := buckets.Backends.Bucket(name)
+		if err != nil {
+			return err
+		}
+		return driver.Destroy(path.Join(buckets.BaseLocation, name))
 	}
 	return nil
 }
 
+// The buckets stored on disk and the ones open, which for engines that
+// keep nothing on disk are all there are.
 func (buckets *Database) GetAllBucketNames() ([]string, error) {
 	fileinfos, err := ioutil.ReadDir(buckets.BaseLocation)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	bucketNames := make([]string, len(fileinfos) - 1)
+	found := make(map[string]bool)
+	bucketNames := make([]string, 0, len(fileinfos))
 	for _, info := range fileinfos {
 		name := info.Name()
-		if name != "_indexes" && name != "" {
+		if info.IsDir() && !strings.HasPrefix(name, "_") && name != "" {
 			bucketNames = append(bucketNames, name)
+			found[name] = true
 		}
 	}
+	for _, name := range buckets.OpenBucketNames() {
+		if !found[name] {
+			bucketNames = append(bucketNames, name)
+		}
+	}
+	sort.Strings(bucketNames)
 	return bucketNames, nil
 }
 
 func (buckets *Database) GetKeysRange(bucket, start, end string) ([]string, error) {
-	if db, ok := buckets.DBMap[bucket]; ok {
+	if db := buckets.GetBucketNoCreate(bucket); db != nil {
 		keys := make([]string, 0)
-		it := db.NewIterator(LReadOptions) // TODO: Refactor with GetAllKeys
+		it := db.NewIterator(true) // TODO: Refactor with GetAllKeys
+		defer it.Close()
 		it.Seek([]byte(start))
-		var check func(*levigo.Iterator) bool
+		var check func(Iterator) bool
 		if len(end) == 0 {
-			check = func(*levigo.Iterator) bool {
+			check = func(Iterator) bool {
 				return true
 			}
 		} else {
 			bend := []byte(end)
-			check = func(*levigo.Iterator) bool {
-				return bytes.Compare(bend, it.Key()) < 0
+			check = func(Iterator) bool {
+				return bytes.Compare(it.Key(), bend) <= 0
 			}
 		}
 		for it = it; it.Valid() && check(it); it.Next() {
@@ -146,8 +300,9 @@ func (buckets *Database) GetKeysRange(bucket, start, end string) ([]string, erro
 }
 
 func (buckets *Database) IsBucketEmpty(bucket string) bool {
-	if db, ok := buckets.DBMap[bucket]; ok {
-		it := db.NewIterator(LReadOptions)
+	if db := buckets.GetBucketNoCreate(bucket); db != nil {
+		it := db.NewIterator(true)
+		defer it.Close()
 		it.SeekToFirst()
 		return !it.Valid()
 	}
@@ -158,9 +313,10 @@ func (buckets *Database) IsBucketEmpty(bucket string) bool {
 // TODO: test destroy database and is bucket empty
 
 func (buckets *Database) GetAllKeys(bucket string) ([]string, error) {
-	if db, ok := buckets.DBMap[bucket]; ok {
+	if db := buckets.GetBucketNoCreate(bucket); db != nil {
 		keys := make([]string, 0)
-		it := db.NewIterator(LReadOptions)
+		it := db.NewIterator(true)
+		defer it.Close()
 		it.SeekToFirst()
 		for it = it; it.Valid(); it.Next() {
 			keys = append(keys, string(it.Key()))
@@ -176,8 +332,9 @@ func (buckets *Database) GetAllKeys(bucket string) ([]string, error) {
 }
 
 func (buckets *Database) StreamAllKeys(bucket string, keys chan<- string) {
-	if db, ok := buckets.DBMap[bucket]; ok {
-		it := db.NewIterator(LReadOptions)
+	if db := buckets.GetBucketNoCreate(bucket); db != nil {
+		it := db.NewIterator(true)
+		defer it.Close()
 		it.SeekToFirst()
 		for it = it; it.Valid(); it.Next() {
 			keys <- string(it.Key())
@@ -185,4 +342,4 @@ func (buckets *Database) StreamAllKeys(bucket string, keys chan<- string) {
 
 		keys <- ""
 	}
-}
\ No newline at end of file
+}
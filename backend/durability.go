@@ -0,0 +1,136 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// There is exactly one replica, so every quorum resolves to 0 or 1.
+const NVal = 1
+
+// QuorumDefault means the request did not ask for anything in particular.
+const QuorumDefault = -1
+
+// Parses a Riak quorum value (a number, "one", "quorum", "all" or
+// "default") against an n_val of 1.
+func ParseQuorum(value string) (int, error) {
+	switch value {
+	case "", "default":
+		return QuorumDefault, nil
+	case "one", "quorum", "all":
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid quorum", value)
+	}
+	if n > NVal {
+		return 0, fmt.Errorf("quorum %d is larger than the n_val of %d", n, NVal)
+	}
+	return n, nil
+}
+
+// Coalesces fsyncs. Writers that want durability write without syncing and
+// then wait here; one sync per database covers every writer that was
+// waiting when it started, so concurrent durable writes share fsyncs
+// instead of queueing up behind each other's.
+type GroupCommitter struct {
+	Window time.Duration // How long the first writer waits for company.
+
+	lock   sync.Mutex
+	groups map[Engine]*syncGroup
+}
+
+type syncGroup struct {
+	waiting []chan error
+	running bool
+}
+
+func NewGroupCommitter(window time.Duration) *GroupCommitter {
+	return &GroupCommitter{Window: window, groups: make(map[Engine]*syncGroup)}
+}
+
+// Returns once everything written to db before the call is on disk.
+func (committer *GroupCommitter) Sync(db Engine) error {
+	done := make(chan error, 1)
+
+	committer.lock.Lock()
+	group, ok := committer.groups[db]
+	if !ok {
+		group = new(syncGroup)
+		committer.groups[db] = group
+	}
+	group.waiting = append(group.waiting, done)
+	if !group.running {
+		group.running = true
+		go committer.flush(db, group)
+	}
+	committer.lock.Unlock()
+
+	return <-done
+}
+
+func (committer *GroupCommitter) flush(db Engine, group *syncGroup) {
+	if committer.Window > 0 {
+		time.Sleep(committer.Window)
+	}
+
+	// An empty batch written with sync set makes every write that went in
+	// before it durable.
+	wb := new(Batch)
+	for {
+		committer.lock.Lock()
+		waiting := group.waiting
+		group.waiting = nil
+		if len(waiting) == 0 {
+			group.running = false
+			delete(committer.groups, db)
+			committer.lock.Unlock()
+			return
+		}
+		committer.lock.Unlock()
+
+		err := db.Write(wb, true)
+		for _, done := range waiting {
+			done <- err
+		}
+	}
+}
+
+// Whether a write syncs. Without group commit a durable write simply syncs
+// by itself.
+func (database *Database) syncWrite(durable bool) bool {
+	return durable && database.GroupCommit == nil
+}
+
+// With group commit, waits until the writes already done to the given
+// databases are durable.
+func (database *Database) commit(durable bool, dbs ...Engine) error {
+	if !durable || database.GroupCommit == nil {
+		return nil
+	}
+	for _, db := range dbs {
+		if err := database.GroupCommit.Sync(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
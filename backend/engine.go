@@ -0,0 +1,141 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+// An Engine stores one bucket, or one of the internal stores, as a map
+// from keys to values ordered by key. Engines are safe for concurrent use;
+// an iterator or snapshot belongs to whoever made it. Engines copy what
+// they are given, so callers may reuse their buffers once a write returns.
+type Engine interface {
+	// Returns nil and no error if there is no such key.
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte, sync bool) error
+	Delete(key []byte, sync bool) error
+	// Applies all of the batch or none of it. An empty batch written with
+	// sync set makes everything written before it durable.
+	Write(batch *Batch, sync bool) error
+	// Scans that read a lot once pass fillCache false, so they do not push
+	// everything else out of the engine's caches.
+	NewIterator(fillCache bool) Iterator
+	NewSnapshot() Snapshot
+	Close() error
+}
+
+// Iterators start out invalid; they have to be positioned with one of the
+// Seek methods first. Key and Value may only be called while Valid, and
+// what they return must not be modified.
+type Iterator interface {
+	Seek(key []byte) // To the first key at or after key.
+	SeekToFirst()
+	SeekToLast()
+	Valid() bool
+	Next()
+	Prev()
+	Key() []byte
+	Value() []byte
+	GetError() error // Why the iterator stopped early, if it did.
+	Close()
+}
+
+// What the engine held when the snapshot was taken. Writes made since do
+// not show up.
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(fillCache bool) Iterator
+	Release()
+}
+
+// Engines that can say more about themselves than their contents.
+type Introspector interface {
+	// An engine specific property such as "leveldb.stats", or "".
+	Property(name string) string
+	// An estimate of the space the engine takes on disk.
+	ApproximateSize() uint64
+	// The bytes the engine may use for caching, as configured.
+	CacheCapacity() uint64
+}
+
+// Opens and destroys the engines of one kind. Each engine takes its own
+// part of the options and ignores the rest.
+type Driver interface {
+	Open(location string, options EngineOptions) (Engine, error)
+	Destroy(location string) error
+	// Whether location holds what an engine of this kind stored there.
+	Holds(location string) bool
+}
+
+// The drivers Config.Engine and the backend bucket property can name.
+var drivers = map[string]Driver{
+	"leveldb": LevelDB,
+	"memory":  Memory,
+	"bitcask": Bitcask,
+}
+
+// The driver called name, or nil if there is none.
+func DriverNamed(name string) Driver {
+	return drivers[name]
+}
+
+// The name of the driver whose engine stored what location holds, or "" if
+// none did.
+func StoredBy(location string) string {
+	for name, driver := range drivers {
+		if driver.Holds(location) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Writes that Engine.Write applies together.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// The batch keeps key and value, so they must not change until it has
+// been written.
+func (batch *Batch) Put(key, value []byte) {
+	batch.ops = append(batch.ops, batchOp{key: key, value: value})
+}
+
+func (batch *Batch) Delete(key []byte) {
+	batch.ops = append(batch.ops, batchOp{key: key, delete: true})
+}
+
+func (batch *Batch) Len() int {
+	return len(batch.ops)
+}
+
+func (batch *Batch) Clear() {
+	batch.ops = batch.ops[:0]
+}
+
+// Hands the writes to put and del in the order they were made.
+func (batch *Batch) Replay(put func(key, value []byte), del func(key []byte)) {
+	for _, op := range batch.ops {
+		if op.delete {
+			del(op.key)
+		} else {
+			put(op.key, op.value)
+		}
+	}
+}
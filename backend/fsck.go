@@ -0,0 +1,195 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"context"
+	"sort"
+)
+
+// The kinds of problem CheckBucket finds.
+const (
+	ProblemMissingObject = "index_missing_object" // An index entry lists a key that has no object.
+	ProblemStaleIndex    = "index_stale_key"      // An index entry lists an object stored without it.
+	ProblemDuplicateKey  = "index_duplicate_key"  // An index entry lists a key twice.
+	ProblemMissingIndex  = "object_missing_index" // An object is not listed under one of its indexes.
+	ProblemDanglingLink  = "dangling_link"        // An object links to one that does not exist.
+	ProblemOrphanChunks  = "orphan_chunks"        // Chunks no object's manifest refers to.
+)
+
+type Problem struct {
+	Type   string `json:"type"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	Field  string `json:"field,omitempty"`  // Of the index entry.
+	Value  string `json:"value,omitempty"`  // Of the index entry.
+	Link   string `json:"link,omitempty"`   // The bucket/key a dangling link points to.
+	Upload string `json:"upload,omitempty"` // The id of orphan chunks.
+	Fixed  bool   `json:"fixed"`
+}
+
+// Cross-checks bucket's index entries with its objects, the links of its
+// objects with what they point to and its chunks with the manifests that
+// should refer to them. Each problem is handed to found. With fix the index
+// entries are rewritten to match the objects and orphan chunks are deleted;
+// dangling links are only reported, as Riak lets a link point at an object
+// that is yet to be stored. Nothing else may be writing while this runs,
+// or chunks of an upload in progress look like orphans.
+func (database *Database) CheckBucket(ctx context.Context, bucket string, fix bool, found func(Problem)) (int, error) {
+	mode := ReindexReport
+	if fix {
+		mode = ReindexRepair
+	}
+	result, err := database.ReindexBucket(ctx, bucket, mode)
+	if err != nil {
+		return result.Scanned, err
+	}
+	db := database.GetBucketNoCreate(bucket)
+	for _, diff := range result.Diffs {
+		for _, key := range diff.Missing {
+			found(Problem{Type: ProblemMissingIndex, Bucket: bucket, Key: key, Field: diff.Field, Value: diff.Value, Fixed: fix})
+		}
+		for _, key := range diff.Extra {
+			problem := Problem{Type: ProblemMissingObject, Bucket: bucket, Key: key, Field: diff.Field, Value: diff.Value, Fixed: fix}
+			if indexed, exists := objectIndexed(db, key, diff.Field, diff.Value); indexed {
+				problem.Type = ProblemDuplicateKey
+			} else if exists {
+				problem.Type = ProblemStaleIndex
+			}
+			found(problem)
+		}
+	}
+
+	uploads, err := database.checkLinks(ctx, bucket, db, found)
+	if err != nil {
+		return result.Scanned, err
+	}
+	return result.Scanned, database.checkChunks(bucket, uploads, fix, found)
+}
+
+// Whether key has an object, and whether that object has the index.
+func objectIndexed(db Engine, key, field, value string) (indexed, exists bool) {
+	if db == nil {
+		return false, false
+	}
+	data, err := db.Get([]byte(key))
+	if err != nil || data == nil {
+		return false, false
+	}
+	meta, _, err := DecodeData(data)
+	if err != nil {
+		return false, true
+	}
+	indexes, _ := ComputeIndexesDiff(meta.Indexes, nil)
+	for _, index := range indexes {
+		if index[0] == field && index[1] == value {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// Reports the links of bucket's objects that point nowhere. Returns the
+// upload ids the objects' manifests refer to.
+func (database *Database) checkLinks(ctx context.Context, bucket string, db Engine, found func(Problem)) (map[string]bool, error) {
+	uploads := make(map[string]bool)
+	if db == nil {
+		return uploads, nil
+	}
+	exists := make(map[Link]bool)
+
+	it := db.NewIterator(false)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		meta, _, err := DecodeData(it.Value())
+		if err != nil {
+			continue
+		}
+		if meta.Manifest != nil {
+			uploads[meta.Manifest.Id] = true
+		}
+		for _, link := range QueryLinks(meta.Links, "_", "_") {
+			target := Link{Bucket: link.Bucket, Key: link.Key}
+			there, checked := exists[target]
+			if !checked {
+				if targetDb := database.GetBucketNoCreate(link.Bucket); targetDb != nil {
+					data, err := targetDb.Get([]byte(link.Key))
+					if err != nil {
+						return nil, err
+					}
+					there = data != nil
+				}
+				exists[target] = there
+			}
+			if !there {
+				found(Problem{Type: ProblemDanglingLink, Bucket: bucket, Key: string(it.Key()), Link: link.Bucket + "/" + link.Key})
+			}
+		}
+	}
+	return uploads, it.GetError()
+}
+
+// Reports, and with fix deletes, the chunks of bucket that belong to no
+// upload in uploads.
+func (database *Database) checkChunks(bucket string, uploads map[string]bool, fix bool, found func(Problem)) error {
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate(bucket)
+	if chunkDb == nil {
+		return nil
+	}
+
+	orphans := make(map[string][][]byte)
+	it := chunkDb.NewIterator(false)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) <= 8 {
+			continue
+		}
+		id := string(key[:len(key)-8])
+		if !uploads[id] {
+			orphans[id] = append(orphans[id], key)
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(orphans))
+	for id := range orphans {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if fix {
+			wb := new(Batch)
+			for _, key := range orphans[id] {
+				wb.Delete(key)
+			}
+			if err := chunkDb.Write(wb, false); err != nil {
+				return err
+			}
+		}
+		found(Problem{Type: ProblemOrphanChunks, Bucket: bucket, Upload: id, Fixed: fix})
+	}
+	if fix && len(ids) > 0 {
+		return database.sync(chunkDb)
+	}
+	return nil
+}
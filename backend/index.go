@@ -19,7 +19,6 @@ package backend
 import (
 	"bytes"
 	"strings"
-	"github.com/jmhodges/levigo"
 )
 
 func appendDataKey(keys []byte, key []byte) []byte {
@@ -49,9 +48,9 @@ func DecodeDataKeys(keys []byte) []string {
 	return strings.Split(string(keys), string(byte(9)))
 }
 
-func AddIndex(index [2]string, key []byte, indexDb *levigo.DB, wb *levigo.WriteBatch) error {
+func AddIndex(index [2]string, key []byte, indexDb Engine, wb *Batch) error {
 	searchKey := []byte(index[0] + "~" + index[1])
-	keys, err := indexDb.Get(LReadOptions, searchKey)
+	keys, err := indexDb.Get(searchKey)
 	if err != nil {
 		return err
 	}
@@ -61,9 +60,9 @@ func AddIndex(index [2]string, key []byte, indexDb *levigo.DB, wb *levigo.WriteB
 }
 
 // TODO: refactor with above.
-func RemoveIndex(index [2]string, key []byte, indexDb *levigo.DB, wb *levigo.WriteBatch) error {
+func RemoveIndex(index [2]string, key []byte, indexDb Engine, wb *Batch) error {
 	searchKey := []byte(index[0] + "~" + index[1])
-	keys, err := indexDb.Get(LReadOptions, searchKey)
+	keys, err := indexDb.Get(searchKey)
 	if err != nil {
 		return err
 	}
@@ -115,8 +114,8 @@ func ComputeIndexesDiff(newIndexes [][2]string, oldIndexes [][2]string) (added [
 	return
 }
 
-func GenerateWriteBatchForIndexes(added, deleted [][2]string, key string, indexDb *levigo.DB) (*levigo.WriteBatch, error) {
-	wb := levigo.NewWriteBatch()
+func GenerateWriteBatchForIndexes(added, deleted [][2]string, key string, indexDb Engine) (*Batch, error) {
+	wb := new(Batch)
 	bkey := []byte(key)
 	for _, index := range added {
 		if err := AddIndex(index, bkey, indexDb, wb); err != nil {
@@ -129,5 +128,35 @@ func GenerateWriteBatchForIndexes(added, deleted [][2]string, key string, indexD
 			return nil, err
 		}
 	}
+	countIndexChanges(len(added), len(deleted))
 	return wb, nil
-}
\ No newline at end of file
+}
+
+// The keys of bucket's objects with a value for field from start to end,
+// both included, or exactly start if end is empty. found is false if
+// nothing in the bucket was ever indexed.
+func (database *Database) QueryIndex(bucket, field, start, end string) (keys []string, found bool, err error) {
+	indexDb := database.IndexDatabase.GetBucketNoCreate(bucket)
+	if indexDb == nil {
+		return nil, false, nil
+	}
+	searchKey := []byte(field + "~" + start)
+	if end == "" {
+		data, err := indexDb.Get(searchKey)
+		if err != nil {
+			return nil, true, err
+		}
+		return DecodeDataKeys(data), true, nil
+	}
+
+	endSearchKey := []byte(field + "~" + end)
+	it := indexDb.NewIterator(true)
+	defer it.Close()
+	for it.Seek(searchKey); it.Valid(); it.Next() {
+		if bytes.Compare(it.Key(), endSearchKey) > 0 {
+			break
+		}
+		keys = append(keys, DecodeDataKeys(it.Value())...)
+	}
+	return keys, true, it.GetError()
+}
@@ -0,0 +1,192 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Index postings added and removed since startup.
+var IndexAdds, IndexRemoves uint64
+
+// Names of the buckets that are currently open, sorted.
+func (buckets *Database) OpenBucketNames() []string {
+	buckets.lock.RLock()
+	names := make([]string, 0, len(buckets.DBMap))
+	for name := range buckets.DBMap {
+		names = append(names, name)
+	}
+	buckets.lock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// An engine property such as "leveldb.stats" for an open bucket, or "" if
+// the bucket is not open or its engine has no such thing.
+func (buckets *Database) Property(bucket, property string) string {
+	if introspector, ok := buckets.GetBucketNoCreate(bucket).(Introspector); ok {
+		return introspector.Property(property)
+	}
+	return ""
+}
+
+// The engine's estimate of the space the bucket takes on disk.
+func (buckets *Database) ApproximateSize(bucket string) uint64 {
+	if introspector, ok := buckets.GetBucketNoCreate(bucket).(Introspector); ok {
+		return introspector.ApproximateSize()
+	}
+	return 0
+}
+
+// The open buckets kept in one backend, and the space they take with
+// their indexes and chunks.
+type BackendUsage struct {
+	Buckets int    `json:"buckets"`
+	Size    uint64 `json:"size"`
+}
+
+// By backend name, "" being the default. Buckets whose backend is no
+// longer configured are left out.
+func (buckets *Database) BackendUsage() map[string]*BackendUsage {
+	usage := make(map[string]*BackendUsage)
+	for _, bucket := range buckets.OpenBucketNames() {
+		name, _, _, err := buckets.Backends.Bucket(bucket)
+		if err != nil {
+			continue
+		}
+		if usage[name] == nil {
+			usage[name] = new(BackendUsage)
+		}
+		usage[name].Buckets++
+		usage[name].Size += buckets.ApproximateSize(bucket)
+		for _, database := range []*Database{buckets.IndexDatabase, buckets.ChunkDatabase} {
+			if database != nil {
+				usage[name].Size += database.ApproximateSize(bucket)
+			}
+		}
+	}
+	return usage
+}
+
+// leveldb cannot count keys without reading them all, so the count is
+// estimated from the bucket's size and the average size of the first few
+// records. Estimates are cached for a minute to keep this cheap.
+const keyEstimateSamples = 100
+
+type keyEstimate struct {
+	count uint64
+	stamp time.Time
+}
+
+var keyEstimates = struct {
+	lock      sync.Mutex
+	estimates map[*Database]map[string]keyEstimate
+}{estimates: make(map[*Database]map[string]keyEstimate)}
+
+func (buckets *Database) EstimateKeyCount(bucket string) uint64 {
+	keyEstimates.lock.Lock()
+	estimates, ok := keyEstimates.estimates[buckets]
+	if !ok {
+		estimates = make(map[string]keyEstimate)
+		keyEstimates.estimates[buckets] = estimates
+	}
+	estimate, ok := estimates[bucket]
+	keyEstimates.lock.Unlock()
+	if ok && time.Since(estimate.stamp) < time.Minute {
+		return estimate.count
+	}
+
+	db := buckets.GetBucketNoCreate(bucket)
+	if db == nil {
+		return 0
+	}
+
+	var sampled, bytes uint64
+	it := db.NewIterator(false)
+	for it.SeekToFirst(); it.Valid() && sampled < keyEstimateSamples; it.Next() {
+		sampled++
+		bytes += uint64(len(it.Key()) + len(it.Value()))
+	}
+	it.Close()
+
+	estimate = keyEstimate{stamp: time.Now()}
+	if sampled < keyEstimateSamples {
+		estimate.count = sampled // That was all of them.
+	} else if bytes > 0 {
+		estimate.count = buckets.ApproximateSize(bucket) * sampled / bytes
+	}
+
+	keyEstimates.lock.Lock()
+	estimates[bucket] = estimate
+	keyEstimates.lock.Unlock()
+	return estimate.count
+}
+
+func countIndexChanges(added, removed int) {
+	atomic.AddUint64(&IndexAdds, uint64(added))
+	atomic.AddUint64(&IndexRemoves, uint64(removed))
+}
+
+// One row of the compaction table in leveldb.stats.
+type LevelStats struct {
+	Level       int
+	Files       int
+	SizeMB      float64
+	TimeSeconds float64
+	ReadMB      float64
+	WriteMB     float64
+}
+
+// Parses the table leveldb.stats contains:
+//
+//	                             Compactions
+//	Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+//	--------------------------------------------------
+//	  0        1        0         0        0         0
+func ParseLevelDBStats(stats string) []LevelStats {
+	var levels []LevelStats
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			continue
+		}
+		level, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue // The header.
+		}
+		files, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		var numbers [4]float64
+		for i := range numbers {
+			if numbers[i], err = strconv.ParseFloat(fields[i+2], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		levels = append(levels, LevelStats{level, files, numbers[0], numbers[1], numbers[2], numbers[3]})
+	}
+	return levels
+}
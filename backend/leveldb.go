@@ -0,0 +1,215 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"os"
+	"path"
+
+	"github.com/jmhodges/levigo"
+)
+
+// The engine everything was stored in before there were others, and still
+// the default. This is the only file that knows about levigo.
+var LevelDB Driver = levelDBDriver{}
+
+type levelDBDriver struct{}
+
+func (levelDBDriver) Open(location string, options EngineOptions) (Engine, error) {
+	// leveldb only creates the last directory itself.
+	if err := os.MkdirAll(path.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+	opened := options.LevelDB.toLevigo()
+	db, err := levigo.Open(location, opened.options)
+	if err != nil {
+		opened.Close()
+		return nil, err
+	}
+	engine := &levelDB{db: db, opened: opened}
+	engine.ro = levigo.NewReadOptions()
+	engine.scanRo = levigo.NewReadOptions()
+	engine.scanRo.SetFillCache(false)
+	engine.wo = levigo.NewWriteOptions()
+	engine.syncWo = levigo.NewWriteOptions()
+	engine.syncWo.SetSync(true)
+	return engine, nil
+}
+
+// leveldb always writes a CURRENT file naming its manifest.
+func (levelDBDriver) Holds(location string) bool {
+	_, err := os.Stat(path.Join(location, "CURRENT"))
+	return err == nil
+}
+
+func (levelDBDriver) Destroy(location string) error {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	return levigo.DestroyDatabase(location, opts)
+}
+
+// The levigo objects behind an open database. They have to outlive the DB
+// and be freed by hand once it is closed.
+type openOptions struct {
+	options   *levigo.Options
+	cache     *levigo.Cache
+	cacheSize int
+	filter    *levigo.FilterPolicy
+}
+
+func (options LevelDBOptions) toLevigo() *openOptions {
+	opened := &openOptions{options: levigo.NewOptions()}
+	opts := opened.options
+	opts.SetCreateIfMissing(true)
+	if options.BlockCacheSize > 0 {
+		opened.cache = levigo.NewLRUCache(options.BlockCacheSize)
+		opened.cacheSize = options.BlockCacheSize
+		opts.SetCache(opened.cache)
+	}
+	if options.WriteBufferSize > 0 {
+		opts.SetWriteBufferSize(options.WriteBufferSize)
+	}
+	if options.BlockSize > 0 {
+		opts.SetBlockSize(options.BlockSize)
+	}
+	if options.MaxOpenFiles > 0 {
+		opts.SetMaxOpenFiles(options.MaxOpenFiles)
+	}
+	if options.BloomFilterBits > 0 {
+		opened.filter = levigo.NewBloomFilter(options.BloomFilterBits)
+		opts.SetFilterPolicy(opened.filter)
+	}
+	if options.Compression == "none" {
+		opts.SetCompression(levigo.NoCompression)
+	} else if options.Compression == "snappy" {
+		opts.SetCompression(levigo.SnappyCompression)
+	}
+	if options.ParanoidChecks != nil {
+		opts.SetParanoidChecks(*options.ParanoidChecks)
+	}
+	return opened
+}
+
+func (opened *openOptions) Close() {
+	opened.options.Close()
+	if opened.cache != nil {
+		opened.cache.Close()
+	}
+	if opened.filter != nil {
+		opened.filter.Close()
+	}
+}
+
+type levelDB struct {
+	db     *levigo.DB
+	opened *openOptions
+	ro     *levigo.ReadOptions
+	scanRo *levigo.ReadOptions // Does not fill the cache.
+	wo     *levigo.WriteOptions
+	syncWo *levigo.WriteOptions
+}
+
+func (engine *levelDB) writeOptions(sync bool) *levigo.WriteOptions {
+	if sync {
+		return engine.syncWo
+	}
+	return engine.wo
+}
+
+func (engine *levelDB) Get(key []byte) ([]byte, error) {
+	return engine.db.Get(engine.ro, key)
+}
+
+func (engine *levelDB) Put(key, value []byte, sync bool) error {
+	return engine.db.Put(engine.writeOptions(sync), key, value)
+}
+
+func (engine *levelDB) Delete(key []byte, sync bool) error {
+	return engine.db.Delete(engine.writeOptions(sync), key)
+}
+
+func (engine *levelDB) Write(batch *Batch, sync bool) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	batch.Replay(wb.Put, wb.Delete)
+	return engine.db.Write(engine.writeOptions(sync), wb)
+}
+
+func (engine *levelDB) NewIterator(fillCache bool) Iterator {
+	if fillCache {
+		return engine.db.NewIterator(engine.ro)
+	}
+	return engine.db.NewIterator(engine.scanRo)
+}
+
+func (engine *levelDB) NewSnapshot() Snapshot {
+	snapshot := &levelDBSnapshot{db: engine.db, snapshot: engine.db.NewSnapshot()}
+	snapshot.ro = levigo.NewReadOptions()
+	snapshot.ro.SetSnapshot(snapshot.snapshot)
+	snapshot.scanRo = levigo.NewReadOptions()
+	snapshot.scanRo.SetSnapshot(snapshot.snapshot)
+	snapshot.scanRo.SetFillCache(false)
+	return snapshot
+}
+
+func (engine *levelDB) Close() error {
+	engine.db.Close()
+	engine.opened.Close()
+	engine.ro.Close()
+	engine.scanRo.Close()
+	engine.wo.Close()
+	engine.syncWo.Close()
+	return nil
+}
+
+func (engine *levelDB) Property(name string) string {
+	return engine.db.PropertyValue(name)
+}
+
+func (engine *levelDB) ApproximateSize() uint64 {
+	// 0xff is larger than the first byte of any UTF-8 key.
+	sizes := engine.db.GetApproximateSizes([]levigo.Range{{Start: []byte{}, Limit: []byte{0xff, 0xff, 0xff, 0xff}}})
+	return sizes[0]
+}
+
+func (engine *levelDB) CacheCapacity() uint64 {
+	return uint64(engine.opened.cacheSize)
+}
+
+type levelDBSnapshot struct {
+	db       *levigo.DB
+	snapshot *levigo.Snapshot
+	ro       *levigo.ReadOptions
+	scanRo   *levigo.ReadOptions
+}
+
+func (snapshot *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return snapshot.db.Get(snapshot.ro, key)
+}
+
+func (snapshot *levelDBSnapshot) NewIterator(fillCache bool) Iterator {
+	if fillCache {
+		return snapshot.db.NewIterator(snapshot.ro)
+	}
+	return snapshot.db.NewIterator(snapshot.scanRo)
+}
+
+func (snapshot *levelDBSnapshot) Release() {
+	snapshot.ro.Close()
+	snapshot.scanRo.Close()
+	snapshot.db.ReleaseSnapshot(snapshot.snapshot)
+}
@@ -0,0 +1,519 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Keeps everything in memory and nothing on disk, so whatever is stored is
+// gone once the engine is closed. Meant for tests and for standing in for
+// Riak where nothing has to survive a restart.
+var Memory Driver = memoryDriver{}
+
+type memoryDriver struct{}
+
+func (memoryDriver) Open(location string, options EngineOptions) (Engine, error) {
+	return newMemoryEngine(), nil
+}
+
+func (memoryDriver) Destroy(location string) error {
+	return nil
+}
+
+func (memoryDriver) Holds(location string) bool {
+	return false
+}
+
+var errMemoryClosed = errors.New("memory engine is closed")
+
+// The records are kept in a copy on write B-tree. Nodes are never changed
+// once a write is done with them, so a snapshot is nothing but the root
+// it was taken at, and readers and iterators need no locks.
+const (
+	memoryMaxItems = 63
+	memoryMinItems = memoryMaxItems / 2
+)
+
+type memoryItem struct {
+	key, value []byte
+}
+
+type memoryNode struct {
+	items    []memoryItem
+	children []*memoryNode // None for a leaf, else one more than items.
+	owner    *memoryWrite  // The write that may still change the node.
+}
+
+// What a write sees, and what it publishes when it is done.
+type memoryState struct {
+	root  *memoryNode
+	bytes int
+}
+
+// A write in progress. Nodes it copied belong to it and are changed in
+// place; the others are copied first.
+type memoryWrite struct {
+	state memoryState
+}
+
+type memoryEngine struct {
+	writeLock sync.Mutex // Serializes writers.
+	lock      sync.RWMutex
+	state     *memoryState // nil once closed.
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{state: &memoryState{root: new(memoryNode)}}
+}
+
+func (engine *memoryEngine) current() *memoryState {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	return engine.state
+}
+
+func (engine *memoryEngine) Get(key []byte) ([]byte, error) {
+	state := engine.current()
+	if state == nil {
+		return nil, errMemoryClosed
+	}
+	return state.root.get(key), nil
+}
+
+func (engine *memoryEngine) Put(key, value []byte, sync bool) error {
+	batch := new(Batch)
+	batch.Put(key, value)
+	return engine.Write(batch, sync)
+}
+
+func (engine *memoryEngine) Delete(key []byte, sync bool) error {
+	batch := new(Batch)
+	batch.Delete(key)
+	return engine.Write(batch, sync)
+}
+
+// There is nothing to sync, and readers only ever see the batch whole.
+func (engine *memoryEngine) Write(batch *Batch, sync bool) error {
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	state := engine.current()
+	if state == nil {
+		return errMemoryClosed
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	write := &memoryWrite{state: *state}
+	batch.Replay(func(key, value []byte) {
+		// Like leveldb, an empty value reads back as empty rather than nil,
+		// which would look like no value at all.
+		write.put(append([]byte(nil), key...), append([]byte{}, value...))
+	}, write.delete)
+
+	// The nodes keep pointing at the write, which must not keep the trees
+	// of earlier writes alive through its state.
+	published := write.state
+	write.state = memoryState{}
+	engine.lock.Lock()
+	engine.state = &published
+	engine.lock.Unlock()
+	return nil
+}
+
+func (engine *memoryEngine) NewIterator(fillCache bool) Iterator {
+	state := engine.current()
+	if state == nil {
+		return &memoryIterator{err: errMemoryClosed}
+	}
+	return &memoryIterator{root: state.root}
+}
+
+func (engine *memoryEngine) NewSnapshot() Snapshot {
+	state := engine.current()
+	if state == nil {
+		return memorySnapshot{}
+	}
+	return memorySnapshot{root: state.root}
+}
+
+func (engine *memoryEngine) Close() error {
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+	engine.lock.Lock()
+	engine.state = nil
+	engine.lock.Unlock()
+	return nil
+}
+
+func (engine *memoryEngine) Property(name string) string {
+	return ""
+}
+
+// The bytes of the keys and values, not counting the tree around them.
+func (engine *memoryEngine) ApproximateSize() uint64 {
+	if state := engine.current(); state != nil {
+		return uint64(state.bytes)
+	}
+	return 0
+}
+
+func (engine *memoryEngine) CacheCapacity() uint64 {
+	return 0
+}
+
+type memorySnapshot struct {
+	root *memoryNode // nil if the engine was closed.
+}
+
+func (snapshot memorySnapshot) Get(key []byte) ([]byte, error) {
+	if snapshot.root == nil {
+		return nil, errMemoryClosed
+	}
+	return snapshot.root.get(key), nil
+}
+
+func (snapshot memorySnapshot) NewIterator(fillCache bool) Iterator {
+	if snapshot.root == nil {
+		return &memoryIterator{err: errMemoryClosed}
+	}
+	return &memoryIterator{root: snapshot.root}
+}
+
+func (snapshot memorySnapshot) Release() {
+}
+
+// The index of the first item at or after key, and whether it is key.
+func (node *memoryNode) find(key []byte) (int, bool) {
+	i := sort.Search(len(node.items), func(i int) bool {
+		return bytes.Compare(node.items[i].key, key) >= 0
+	})
+	return i, i < len(node.items) && bytes.Equal(node.items[i].key, key)
+}
+
+func (node *memoryNode) get(key []byte) []byte {
+	value, _ := node.lookup(key)
+	return value
+}
+
+// The value of key, and whether there is one at all.
+func (node *memoryNode) lookup(key []byte) ([]byte, bool) {
+	for {
+		i, found := node.find(key)
+		if found {
+			return node.items[i].value, true
+		}
+		if len(node.children) == 0 {
+			return nil, false
+		}
+		node = node.children[i]
+	}
+}
+
+// node itself if the write owns it, else a copy of it that it does.
+func (write *memoryWrite) own(node *memoryNode) *memoryNode {
+	if node.owner == write {
+		return node
+	}
+	copied := &memoryNode{owner: write}
+	copied.items = append(make([]memoryItem, 0, len(node.items)+1), node.items...)
+	if len(node.children) > 0 {
+		copied.children = append(make([]*memoryNode, 0, len(node.children)+1), node.children...)
+	}
+	return copied
+}
+
+// The i'th child of node, owned by the write. node must be owned already.
+func (write *memoryWrite) child(node *memoryNode, i int) *memoryNode {
+	node.children[i] = write.own(node.children[i])
+	return node.children[i]
+}
+
+func (write *memoryWrite) put(key, value []byte) {
+	root := write.own(write.state.root)
+	if len(root.items) >= memoryMaxItems {
+		left := root
+		root = &memoryNode{owner: write, children: []*memoryNode{left}}
+		write.split(root, 0)
+	}
+	write.state.root = root
+
+	node := root
+	for {
+		i, found := node.find(key)
+		if found {
+			write.state.bytes += len(value) - len(node.items[i].value)
+			node.items[i].value = value
+			return
+		}
+		if len(node.children) == 0 {
+			node.items = append(node.items, memoryItem{})
+			copy(node.items[i+1:], node.items[i:])
+			node.items[i] = memoryItem{key, value}
+			write.state.bytes += len(key) + len(value)
+			return
+		}
+		// Full children are split on the way down, so there is always
+		// room for what a split below pushes up.
+		if len(node.children[i].items) >= memoryMaxItems {
+			write.split(node, i)
+			switch c := bytes.Compare(key, node.items[i].key); {
+			case c == 0:
+				continue
+			case c > 0:
+				i++
+			}
+		}
+		node = write.child(node, i)
+	}
+}
+
+// Splits node's full i'th child in two around its middle item, which moves
+// up into node.
+func (write *memoryWrite) split(node *memoryNode, i int) {
+	child := write.child(node, i)
+	middle := len(child.items) / 2
+	right := &memoryNode{owner: write}
+	right.items = append([]memoryItem(nil), child.items[middle+1:]...)
+	if len(child.children) > 0 {
+		right.children = append([]*memoryNode(nil), child.children[middle+1:]...)
+		child.children = child.children[:middle+1]
+	}
+	item := child.items[middle]
+	child.items = child.items[:middle]
+
+	node.items = append(node.items, memoryItem{})
+	copy(node.items[i+1:], node.items[i:])
+	node.items[i] = item
+	node.children = append(node.children, nil)
+	copy(node.children[i+2:], node.children[i+1:])
+	node.children[i+1] = right
+}
+
+func (write *memoryWrite) delete(key []byte) {
+	if _, found := write.state.root.lookup(key); !found {
+		return // Nothing to copy for.
+	}
+	root := write.own(write.state.root)
+	item := write.remove(root, key, false)
+	write.state.bytes -= len(item.key) + len(item.value)
+	if len(root.items) == 0 && len(root.children) > 0 {
+		root = root.children[0]
+	}
+	write.state.root = root
+}
+
+// Removes key, or with last node's last item, from the subtree under the
+// owned node and returns it. On the way down every child is given more than
+// the minimum of items first, so none can end up with too few.
+func (write *memoryWrite) remove(node *memoryNode, key []byte, last bool) memoryItem {
+	for {
+		var i int
+		var found bool
+		if last {
+			if len(node.children) == 0 {
+				item := node.items[len(node.items)-1]
+				node.items = node.items[:len(node.items)-1]
+				return item
+			}
+			i = len(node.items)
+		} else {
+			i, found = node.find(key)
+			if len(node.children) == 0 {
+				item := node.items[i]
+				node.items = append(node.items[:i], node.items[i+1:]...)
+				return item
+			}
+		}
+
+		if len(node.children[i].items) <= memoryMinItems {
+			write.grow(node, i)
+			continue // The items moved; look again.
+		}
+		child := write.child(node, i)
+		if found {
+			// The item is replaced by the one just before it, which is the
+			// last one in the subtree to its left.
+			item := node.items[i]
+			node.items[i] = write.remove(child, nil, true)
+			return item
+		}
+		node = child
+	}
+}
+
+// Gives node's i'th child another item, from a sibling with some to spare
+// or by merging it with one.
+func (write *memoryWrite) grow(node *memoryNode, i int) {
+	switch {
+	case i > 0 && len(node.children[i-1].items) > memoryMinItems:
+		child, left := write.child(node, i), write.child(node, i-1)
+		child.items = append([]memoryItem{node.items[i-1]}, child.items...)
+		node.items[i-1] = left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		if len(left.children) > 0 {
+			child.children = append([]*memoryNode{left.children[len(left.children)-1]}, child.children...)
+			left.children = left.children[:len(left.children)-1]
+		}
+	case i < len(node.items) && len(node.children[i+1].items) > memoryMinItems:
+		child, right := write.child(node, i), write.child(node, i+1)
+		child.items = append(child.items, node.items[i])
+		node.items[i] = right.items[0]
+		right.items = append(right.items[:0], right.items[1:]...)
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.children[0])
+			right.children = append(right.children[:0], right.children[1:]...)
+		}
+	default:
+		if i >= len(node.items) {
+			i--
+		}
+		child, right := write.child(node, i), node.children[i+1]
+		child.items = append(child.items, node.items[i])
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		node.items = append(node.items[:i], node.items[i+1:]...)
+		node.children = append(node.children[:i+1], node.children[i+2:]...)
+	}
+}
+
+// Walks a tree that never changes under it. The top of the path is the
+// current item; every frame below it is a node the iterator is inside the
+// i'th child of, whose i'th item comes after that child.
+type memoryIterator struct {
+	root *memoryNode
+	path []memoryFrame
+	err  error
+}
+
+type memoryFrame struct {
+	node *memoryNode
+	i    int
+}
+
+func (it *memoryIterator) top() *memoryFrame {
+	return &it.path[len(it.path)-1]
+}
+
+func (it *memoryIterator) Valid() bool {
+	return len(it.path) > 0
+}
+
+func (it *memoryIterator) Seek(key []byte) {
+	it.path = it.path[:0]
+	if it.root == nil {
+		return
+	}
+	node := it.root
+	for {
+		i, _ := node.find(key)
+		it.path = append(it.path, memoryFrame{node, i})
+		if len(node.children) == 0 {
+			break
+		}
+		node = node.children[i]
+	}
+	it.forward()
+}
+
+func (it *memoryIterator) SeekToFirst() {
+	it.Seek(nil)
+}
+
+func (it *memoryIterator) SeekToLast() {
+	it.path = it.path[:0]
+	if it.root != nil {
+		it.descendLast(it.root)
+	}
+}
+
+func (it *memoryIterator) Next() {
+	frame := it.top()
+	if len(frame.node.children) == 0 {
+		frame.i++
+		it.forward()
+		return
+	}
+	frame.i++
+	node := frame.node.children[frame.i]
+	for len(node.children) > 0 {
+		it.path = append(it.path, memoryFrame{node, 0})
+		node = node.children[0]
+	}
+	it.path = append(it.path, memoryFrame{node, 0})
+	it.forward()
+}
+
+func (it *memoryIterator) Prev() {
+	frame := it.top()
+	if len(frame.node.children) == 0 {
+		frame.i--
+		it.backward()
+		return
+	}
+	it.descendLast(frame.node.children[frame.i])
+}
+
+// Goes to the last item under node.
+func (it *memoryIterator) descendLast(node *memoryNode) {
+	for len(node.children) > 0 {
+		it.path = append(it.path, memoryFrame{node, len(node.items)})
+		node = node.children[len(node.items)]
+	}
+	it.path = append(it.path, memoryFrame{node, len(node.items) - 1})
+	it.backward()
+}
+
+// Climbs out of nodes the iterator has gone past the end of.
+func (it *memoryIterator) forward() {
+	for len(it.path) > 0 && it.top().i >= len(it.top().node.items) {
+		it.path = it.path[:len(it.path)-1]
+	}
+}
+
+// Climbs out of nodes the iterator has gone past the start of. Coming out
+// of a child, the item before it is next.
+func (it *memoryIterator) backward() {
+	for len(it.path) > 0 && it.top().i < 0 {
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) > 0 {
+			it.top().i--
+		}
+	}
+}
+
+func (it *memoryIterator) Key() []byte {
+	frame := it.top()
+	return frame.node.items[frame.i].key
+}
+
+func (it *memoryIterator) Value() []byte {
+	frame := it.top()
+	return frame.node.items[frame.i].value
+}
+
+func (it *memoryIterator) GetError() error {
+	return it.err
+}
+
+func (it *memoryIterator) Close() {
+	it.path = nil
+}
@@ -20,6 +20,8 @@ import (
 	"net/http"
 	"strings"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 type Meta struct {
@@ -27,6 +29,17 @@ type Meta struct {
 	Links       string            `json:"L"`
 	Meta        map[string]string `json:"M"`
 	ContentType string            `json:"C"`
+	Modified    int64             `json:"T,omitempty"` // Microseconds since the epoch, 0 for old objects.
+	Manifest    *Manifest         `json:"X,omitempty"` // Set when the value is stored in chunks.
+	Codec       string            `json:"Z,omitempty"` // How the stored value is compressed, see Compress.
+}
+
+// The size of the value, wherever it is stored.
+func (meta *Meta) Size(data []byte) int64 {
+	if meta.Manifest != nil {
+		return meta.Manifest.Size
+	}
+	return int64(len(data))
 }
 
 func MetaFromRequest(req *http.Request) (*Meta, error) {
@@ -35,6 +48,7 @@ func MetaFromRequest(req *http.Request) (*Meta, error) {
 	meta.Links = req.Header.Get("Link")
 	meta.ContentType = req.Header.Get("Content-Type")
 	meta.Meta = make(map[string]string)
+	meta.Modified = time.Now().UnixNano() / 1000
 	for headerKey, headerValue := range req.Header {
 		headerValueLength := len(headerValue)
 		if strings.HasPrefix(headerKey, "X-Riak-Index-") && headerValueLength > 0 {
@@ -52,13 +66,24 @@ func MetaFromRequest(req *http.Request) (*Meta, error) {
 	return meta, nil
 }
 
+// The headers Riak sends with an object, apart from Content-Length which
+// depends on the response. levelupdb removes deleted objects right away, like
+// Riak does once a tombstone is reaped, so X-Riak-Deleted is never needed.
 func (meta *Meta) ToHeaders(headers http.Header, bucket string) {
 	links := fmt.Sprintf("</buckets/%s>; rel=\"up\"", bucket)
 	if meta.Links != "" {
 		links += ", " + meta.Links
 	}
 	headers.Add("Link", links)
-	headers.Add("Content-Type", meta.ContentType)
+	if meta.ContentType != "" {
+		headers.Set("Content-Type", meta.ContentType)
+	} else {
+		headers["Content-Type"] = nil // Stops net/http from guessing one.
+	}
+	if meta.Modified != 0 {
+		headers.Set("Last-Modified", meta.LastModified().Format(http.TimeFormat))
+		headers.Set("ETag", meta.ETag())
+	}
 	for _, index := range meta.Indexes {
 		headers.Add("X-Riak-Index-"+index[0], index[1])
 	}
@@ -67,4 +92,17 @@ func (meta *Meta) ToHeaders(headers http.Header, bucket string) {
 		headers.Add("X-Riak-Meta-"+k, v)
 	}
 	headers.Add("X-Riak-Vclock", "Yay02966e9d038d6332eea23012217f8c4b521eaf92==")
-}
\ No newline at end of file
+}
+
+func (meta *Meta) LastModified() time.Time {
+	return time.Unix(0, meta.Modified*1000).UTC()
+}
+
+// Every write gets a new modification time, so it makes a good ETag. Objects
+// stored before modification times were recorded have none.
+func (meta *Meta) ETag() string {
+	if meta.Modified == 0 {
+		return ""
+	}
+	return "\"" + strconv.FormatInt(meta.Modified, 36) + "\""
+}
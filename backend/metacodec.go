@@ -0,0 +1,209 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Meta is stored as a list of fields, each a tag byte, a uvarint length and
+// that many bytes. Decoders skip tags they do not know, so fields can be
+// added without a new envelope version as long as old readers can do
+// without them. Tags are never reused.
+const (
+	metaTagContentType = 1
+	metaTagLinks       = 2
+	metaTagIndex       = 3 // One per index: a pair.
+	metaTagUserMeta    = 4 // One per entry: a pair.
+	metaTagModified    = 5 // uvarint
+	metaTagManifest    = 6 // A string (the id), uvarints for size and chunk size, then four bytes of checksum per chunk.
+	metaTagCodec       = 7
+	metaTagChunkCodec  = 8 // The manifest's codec, only there if it has one.
+)
+
+var errCorruptMeta = errors.New("corrupt meta")
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], v)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendField(buf []byte, tag byte, value []byte) []byte {
+	return append(appendUvarint(append(buf, tag), uint64(len(value))), value...)
+}
+
+func appendStringField(buf []byte, tag byte, s string) []byte {
+	return appendString(append(buf, tag), s)
+}
+
+// A pair is its first string length prefixed, then the second one filling
+// the rest of the field.
+func appendPairField(buf []byte, tag byte, first, second string) []byte {
+	buf = append(buf, tag)
+	buf = appendUvarint(buf, uint64(uvarintSize(uint64(len(first)))+len(first)+len(second)))
+	return append(appendString(buf, first), second...)
+}
+
+func uvarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func (meta *Meta) MarshalBinary() ([]byte, error) {
+	return meta.appendBinary(make([]byte, 0, 64)), nil
+}
+
+func (meta *Meta) appendBinary(buf []byte) []byte {
+	if meta.ContentType != "" {
+		buf = appendStringField(buf, metaTagContentType, meta.ContentType)
+	}
+	if meta.Links != "" {
+		buf = appendStringField(buf, metaTagLinks, meta.Links)
+	}
+	for _, index := range meta.Indexes {
+		buf = appendPairField(buf, metaTagIndex, index[0], index[1])
+	}
+	// Sorted so the same Meta always encodes to the same bytes.
+	keys := make([]string, 0, len(meta.Meta))
+	for key := range meta.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf = appendPairField(buf, metaTagUserMeta, key, meta.Meta[key])
+	}
+	if meta.Modified != 0 {
+		buf = appendField(buf, metaTagModified, appendUvarint(nil, uint64(meta.Modified)))
+	}
+	if meta.Manifest != nil {
+		manifest := appendString(nil, meta.Manifest.Id)
+		manifest = appendUvarint(manifest, uint64(meta.Manifest.Size))
+		manifest = appendUvarint(manifest, uint64(meta.Manifest.ChunkSize))
+		var checksum [4]byte
+		for _, crc := range meta.Manifest.Checksums {
+			binary.BigEndian.PutUint32(checksum[:], crc)
+			manifest = append(manifest, checksum[:]...)
+		}
+		buf = appendField(buf, metaTagManifest, manifest)
+		if meta.Manifest.Codec != "" {
+			buf = appendStringField(buf, metaTagChunkCodec, meta.Manifest.Codec)
+		}
+	}
+	if meta.Codec != "" {
+		buf = appendStringField(buf, metaTagCodec, meta.Codec)
+	}
+	return buf
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errCorruptMeta
+	}
+	return v, data[n:], nil
+}
+
+// Splits off a uvarint length prefixed string.
+func readString(data []byte) (string, []byte, error) {
+	length, data, err := readUvarint(data)
+	if err != nil || length > uint64(len(data)) {
+		return "", nil, errCorruptMeta
+	}
+	return string(data[:length]), data[length:], nil
+}
+
+func readPair(field []byte) (string, string, error) {
+	first, rest, err := readString(field)
+	return first, string(rest), err
+}
+
+func (meta *Meta) UnmarshalBinary(data []byte) error {
+	*meta = Meta{Meta: make(map[string]string)}
+	chunkCodec := ""
+	for len(data) > 0 {
+		tag := data[0]
+		length, rest, err := readUvarint(data[1:])
+		if err != nil || length > uint64(len(rest)) {
+			return errCorruptMeta
+		}
+		field := rest[:length]
+		data = rest[length:]
+
+		switch tag {
+		case metaTagContentType:
+			meta.ContentType = string(field)
+		case metaTagLinks:
+			meta.Links = string(field)
+		case metaTagIndex:
+			name, value, err := readPair(field)
+			if err != nil {
+				return err
+			}
+			meta.Indexes = append(meta.Indexes, [2]string{name, value})
+		case metaTagUserMeta:
+			key, value, err := readPair(field)
+			if err != nil {
+				return err
+			}
+			meta.Meta[key] = value
+		case metaTagModified:
+			modified, _, err := readUvarint(field)
+			if err != nil {
+				return err
+			}
+			meta.Modified = int64(modified)
+		case metaTagManifest:
+			manifest := new(Manifest)
+			var size, chunkSize uint64
+			if manifest.Id, field, err = readString(field); err != nil {
+				return err
+			}
+			if size, field, err = readUvarint(field); err != nil {
+				return err
+			}
+			if chunkSize, field, err = readUvarint(field); err != nil {
+				return err
+			}
+			if chunkSize == 0 || len(field)%4 != 0 {
+				return errCorruptMeta
+			}
+			for ; len(field) > 0; field = field[4:] {
+				manifest.Checksums = append(manifest.Checksums, binary.BigEndian.Uint32(field))
+			}
+			manifest.Size, manifest.ChunkSize = int64(size), int(chunkSize)
+			meta.Manifest = manifest
+		case metaTagCodec:
+			meta.Codec = string(field)
+		case metaTagChunkCodec:
+			chunkCodec = string(field)
+		}
+	}
+	if meta.Manifest != nil {
+		meta.Manifest.Codec = chunkCodec
+	}
+	return nil
+}
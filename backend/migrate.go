@@ -0,0 +1,108 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bytes"
+	"context"
+)
+
+// How many records MigrateBucket rewrites per batch.
+const migrateBatchSize = 1000
+
+// Rewrites every record of bucket that is not in the current envelope
+// format. It is safe to run while the bucket is being written to: records
+// are read from a snapshot, and each one is only rewritten if it has not
+// changed since. It stops between batches once ctx is done. Records that
+// do not decode are left as they are and handed to damaged, which may be
+// nil. Returns how many records were looked at and rewritten.
+func (database *Database) MigrateBucket(ctx context.Context, bucket string, damaged func(key []byte, err error)) (scanned, migrated int, err error) {
+	db := database.GetBucketNoCreate(bucket)
+	if db == nil {
+		return 0, 0, nil
+	}
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	var keys, values [][]byte
+	flush := func() error {
+		n, err := database.rewriteRecords(bucket, db, keys, values, damaged)
+		migrated += n
+		keys, values = keys[:0], values[:0]
+		return err
+	}
+
+	it := snapshot.NewIterator(false)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		scanned++
+		if EnvelopeVersionOf(it.Value()) == EnvelopeVersion {
+			continue
+		}
+		// The iterator may reuse what it hands out.
+		keys = append(keys, append([]byte(nil), it.Key()...))
+		values = append(values, append([]byte(nil), it.Value()...))
+		if len(keys) == migrateBatchSize {
+			if err := flush(); err != nil {
+				return scanned, migrated, err
+			}
+			if err := ctx.Err(); err != nil {
+				return scanned, migrated, err
+			}
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return scanned, migrated, err
+	}
+	if err := flush(); err != nil {
+		return scanned, migrated, err
+	}
+	return scanned, migrated, database.sync(db)
+}
+
+// Re-encodes records that still hold the old value they were read with.
+func (database *Database) rewriteRecords(bucket string, db Engine, keys, values [][]byte, damaged func([]byte, error)) (int, error) {
+	rewritten := 0
+	for i, key := range keys {
+		meta, data, err := DecodeData(values[i])
+		if err != nil {
+			// Scrub reports it; there is nothing to rewrite it from.
+			if damaged != nil {
+				damaged(key, err)
+			}
+			continue
+		}
+		encoded, err := EncodeData(meta, data)
+		if err != nil {
+			return rewritten, err
+		}
+
+		unlock := database.lockKey(bucket, string(key))
+		current, err := db.Get(key)
+		if err == nil && bytes.Equal(current, values[i]) {
+			if err = db.Put(key, encoded, false); err == nil {
+				rewritten++
+			}
+		}
+		unlock()
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
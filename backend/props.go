@@ -0,0 +1,209 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Tuning knobs handed to leveldb when a bucket is opened. Zero values (and
+// a nil ParanoidChecks) mean "inherit", so a bucket only has to mention
+// what it wants to differ from the global defaults.
+type LevelDBOptions struct {
+	BlockCacheSize  int    `json:"block_cache_size,omitempty"` // Bytes.
+	WriteBufferSize int    `json:"write_buffer_size,omitempty"`
+	BlockSize       int    `json:"block_size,omitempty"`
+	MaxOpenFiles    int    `json:"max_open_files,omitempty"`
+	BloomFilterBits int    `json:"bloom_filter_bits,omitempty"`
+	Compression     string `json:"compression,omitempty"` // "snappy" or "none"
+	ParanoidChecks  *bool  `json:"paranoid_checks,omitempty"`
+}
+
+// Returns a copy of options with every field set in overrides replaced.
+func (options LevelDBOptions) Merge(overrides LevelDBOptions) LevelDBOptions {
+	if overrides.BlockCacheSize != 0 {
+		options.BlockCacheSize = overrides.BlockCacheSize
+	}
+	if overrides.WriteBufferSize != 0 {
+		options.WriteBufferSize = overrides.WriteBufferSize
+	}
+	if overrides.BlockSize != 0 {
+		options.BlockSize = overrides.BlockSize
+	}
+	if overrides.MaxOpenFiles != 0 {
+		options.MaxOpenFiles = overrides.MaxOpenFiles
+	}
+	if overrides.BloomFilterBits != 0 {
+		options.BloomFilterBits = overrides.BloomFilterBits
+	}
+	if overrides.Compression != "" {
+		options.Compression = overrides.Compression
+	}
+	if overrides.ParanoidChecks != nil {
+		options.ParanoidChecks = overrides.ParanoidChecks
+	}
+	return options
+}
+
+func (options LevelDBOptions) Validate() error {
+	if options.BlockCacheSize < 0 || options.WriteBufferSize < 0 || options.BlockSize < 0 || options.BloomFilterBits < 0 {
+		return fmt.Errorf("leveldb sizes must not be negative")
+	}
+	// leveldb keeps some descriptors for itself and clamps below this anyway.
+	if options.MaxOpenFiles != 0 && options.MaxOpenFiles < 20 {
+		return fmt.Errorf("leveldb max_open_files must be at least 20")
+	}
+	if options.Compression != "" && options.Compression != "snappy" && options.Compression != "none" {
+		return fmt.Errorf("leveldb compression must be snappy or none, not %q", options.Compression)
+	}
+	return nil
+}
+
+// Tuning knobs handed to bitcask when a bucket is opened. Zero values
+// inherit, as with LevelDBOptions.
+type BitcaskOptions struct {
+	// Bytes a data file may grow to before the next one is started, which
+	// is also how much dead data a write merges away.
+	MaxFileSize int `json:"max_file_size,omitempty"`
+}
+
+// Returns a copy of options with every field set in overrides replaced.
+func (options BitcaskOptions) Merge(overrides BitcaskOptions) BitcaskOptions {
+	if overrides.MaxFileSize != 0 {
+		options.MaxFileSize = overrides.MaxFileSize
+	}
+	return options
+}
+
+func (options BitcaskOptions) Validate() error {
+	if options.MaxFileSize < 0 {
+		return fmt.Errorf("bitcask max_file_size must not be negative")
+	}
+	return nil
+}
+
+// What a bucket is opened with. Each engine reads the options meant for it
+// and ignores the others.
+type EngineOptions struct {
+	LevelDB LevelDBOptions
+	Bitcask BitcaskOptions
+}
+
+// Returns a copy of options with every field set in overrides replaced.
+func (options EngineOptions) Merge(overrides EngineOptions) EngineOptions {
+	return EngineOptions{
+		LevelDB: options.LevelDB.Merge(overrides.LevelDB),
+		Bitcask: options.Bitcask.Merge(overrides.Bitcask),
+	}
+}
+
+func (options EngineOptions) Validate() error {
+	if err := options.LevelDB.Validate(); err != nil {
+		return err
+	}
+	return options.Bitcask.Validate()
+}
+
+// Per bucket settings, Riak's bucket properties.
+type BucketProps struct {
+	DW          string         `json:"dw,omitempty"`          // Default durability, see ParseQuorum.
+	Compression string         `json:"compression,omitempty"` // Codec for new values, see Compress.
+	Backend     string         `json:"backend,omitempty"`     // The engine, if not the server's. See Backends.
+	LevelDB     LevelDBOptions `json:"leveldb"`
+	Bitcask     BitcaskOptions `json:"bitcask"`
+}
+
+// The bucket's own engine options.
+func (props *BucketProps) Options() EngineOptions {
+	return EngineOptions{LevelDB: props.LevelDB, Bitcask: props.Bitcask}
+}
+
+func (props *BucketProps) Validate() error {
+	if _, err := ParseQuorum(props.DW); err != nil {
+		return fmt.Errorf("dw: %s", err)
+	}
+	if !ValidCodec(props.Compression) {
+		return fmt.Errorf("compression must be none, gzip, deflate or snappy, not %q", props.Compression)
+	}
+	return props.Options().Validate()
+}
+
+// Bucket properties live in their own database, one JSON record per bucket.
+// They are read every time a bucket is opened, so they are cached.
+type PropsStore struct {
+	db    Engine
+	lock  sync.RWMutex
+	cache map[string]*BucketProps
+}
+
+func OpenPropsStore(driver Driver, location string) (*PropsStore, error) {
+	db, err := driver.Open(location, EngineOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &PropsStore{db: db, cache: make(map[string]*BucketProps)}, nil
+}
+
+func (store *PropsStore) Close() {
+	store.db.Close()
+}
+
+// Buckets that never had their properties set get the zero value.
+func (store *PropsStore) Get(bucket string) (*BucketProps, error) {
+	store.lock.RLock()
+	props, ok := store.cache[bucket]
+	store.lock.RUnlock()
+	if ok {
+		return props, nil
+	}
+
+	props = new(BucketProps)
+	data, err := store.db.Get([]byte(bucket))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, props); err != nil {
+			return nil, err
+		}
+	}
+
+	store.lock.Lock()
+	store.cache[bucket] = props
+	store.lock.Unlock()
+	return props, nil
+}
+
+func (store *PropsStore) Set(bucket string, props *BucketProps) error {
+	if err := props.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.db.Put([]byte(bucket), data, false); err != nil {
+		return err
+	}
+	store.cache[bucket] = props
+	return nil
+}
@@ -0,0 +1,230 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Pending and dead entries live in the same database so moving an entry
+// between the two is a single atomic write batch.
+const (
+	queuePendingPrefix = 'p'
+	queueDeadPrefix    = 'd'
+)
+
+type QueueEntry struct {
+	Id          uint64 `json:"id"`
+	Lane        string `json:"lane"` // Entries sharing a lane are delivered in order.
+	Target      string `json:"target"`
+	Payload     []byte `json:"payload"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"` // Unix nanoseconds.
+	LastError   string `json:"last_error"`
+	Created     int64  `json:"created"`
+}
+
+// A FIFO queue stored in its own database, as durable as the engine that
+// keeps it. Ids are monotonically increasing so iterating the pending
+// entries yields them in push order.
+type Queue struct {
+	db   Engine
+	lock sync.Mutex // Guards seq, and moves between pending and dead.
+	seq  uint64
+}
+
+func queueKey(prefix byte, id uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = prefix
+	binary.BigEndian.PutUint64(key[1:], id)
+	return key
+}
+
+func OpenQueue(driver Driver, location string) (*Queue, error) {
+	db, err := driver.Open(location, EngineOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &Queue{db: db}
+
+	// Ids are shared between pending and dead entries, so the next id is one
+	// past the largest id found under either prefix.
+	it := db.NewIterator(true)
+	defer it.Close()
+	for _, prefix := range []byte{queuePendingPrefix, queueDeadPrefix} {
+		it.Seek([]byte{prefix + 1})
+		if it.Valid() {
+			it.Prev()
+		} else {
+			it.SeekToLast()
+		}
+		if it.Valid() && len(it.Key()) == 9 && it.Key()[0] == prefix {
+			if id := binary.BigEndian.Uint64(it.Key()[1:]); id > queue.seq {
+				queue.seq = id
+			}
+		}
+	}
+	return queue, it.GetError()
+}
+
+func (queue *Queue) Close() {
+	queue.db.Close()
+}
+
+func (queue *Queue) nextId() uint64 {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.seq++
+	return queue.seq
+}
+
+func (queue *Queue) Push(entry *QueueEntry) error {
+	entry.Id = queue.nextId()
+	return queue.put(queuePendingPrefix, entry)
+}
+
+func (queue *Queue) put(prefix byte, entry *QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return queue.db.Put(queueKey(prefix, entry.Id), data, false)
+}
+
+// Pending reads a pending entry as it is stored now, or returns nil if it
+// is not pending any more.
+func (queue *Queue) Pending(id uint64) (*QueueEntry, error) {
+	data, err := queue.db.Get(queueKey(queuePendingPrefix, id))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	entry := new(QueueEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, errors.New("queue: corrupted entry: " + err.Error())
+	}
+	return entry, nil
+}
+
+func (queue *Queue) isPending(id uint64) (bool, error) {
+	data, err := queue.db.Get(queueKey(queuePendingPrefix, id))
+	return data != nil, err
+}
+
+// Update rewrites a pending entry after a failed attempt. It returns false
+// and writes nothing if the entry is no longer pending, so that a late
+// update cannot bring back an entry that was delivered or buried since.
+func (queue *Queue) Update(entry *QueueEntry) (bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if pending, err := queue.isPending(entry.Id); !pending || err != nil {
+		return false, err
+	}
+	return true, queue.put(queuePendingPrefix, entry)
+}
+
+// Remove drops a pending entry once it has been delivered.
+func (queue *Queue) Remove(id uint64) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.db.Delete(queueKey(queuePendingPrefix, id), false)
+}
+
+// Bury moves a pending entry into the dead letter section. Like Update, it
+// returns false and writes nothing if the entry is no longer pending.
+func (queue *Queue) Bury(entry *QueueEntry) (bool, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if pending, err := queue.isPending(entry.Id); !pending || err != nil {
+		return false, err
+	}
+	wb := new(Batch)
+	wb.Delete(queueKey(queuePendingPrefix, entry.Id))
+	wb.Put(queueKey(queueDeadPrefix, entry.Id), data)
+	return true, queue.db.Write(wb, false)
+}
+
+// Replay moves a dead entry back to the pending section with its attempts
+// reset. It keeps its id, so it goes ahead of whatever of its lane is still
+// pending, as it did before it died. Entries of the lane delivered while it
+// was dead were delivered first all the same.
+func (queue *Queue) Replay(id uint64) (bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	deadKey := queueKey(queueDeadPrefix, id)
+	data, err := queue.db.Get(deadKey)
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	entry := new(QueueEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return false, err
+	}
+	entry.Attempts = 0
+	entry.NextAttempt = 0
+	entry.LastError = ""
+	if data, err = json.Marshal(entry); err != nil {
+		return false, err
+	}
+
+	wb := new(Batch)
+	wb.Delete(deadKey)
+	wb.Put(queueKey(queuePendingPrefix, entry.Id), data)
+	return true, queue.db.Write(wb, false)
+}
+
+// DeleteDead permanently discards a dead entry.
+func (queue *Queue) DeleteDead(id uint64) error {
+	return queue.db.Delete(queueKey(queueDeadPrefix, id), false)
+}
+
+func (queue *Queue) forEach(prefix byte, fn func(*QueueEntry) bool) error {
+	it := queue.db.NewIterator(true)
+	defer it.Close()
+	for it.Seek([]byte{prefix}); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != 9 || key[0] != prefix {
+			break
+		}
+		entry := new(QueueEntry)
+		if err := json.Unmarshal(it.Value(), entry); err != nil {
+			return errors.New("queue: corrupted entry: " + err.Error())
+		}
+		if !fn(entry) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+// ForEachPending calls fn for every pending entry in push order until fn
+// returns false.
+func (queue *Queue) ForEachPending(fn func(*QueueEntry) bool) error {
+	return queue.forEach(queuePendingPrefix, fn)
+}
+
+func (queue *Queue) ForEachDead(fn func(*QueueEntry) bool) error {
+	return queue.forEach(queueDeadPrefix, fn)
+}
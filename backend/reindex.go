@@ -0,0 +1,250 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Writes to a bucket hold its lock for reading while they change its
+// indexes, and reindexing holds it for writing. Every bucket has its own,
+// so a long reindex only holds up writes to the bucket it reads.
+func (database *Database) bucketLock(bucket string) *sync.RWMutex {
+	database.bucketLocksLock.Lock()
+	defer database.bucketLocksLock.Unlock()
+	lock, ok := database.bucketLocks[bucket]
+	if !ok {
+		lock = new(sync.RWMutex)
+		database.bucketLocks[bucket] = lock
+	}
+	return lock
+}
+
+// What ReindexBucket does about the differences it finds.
+const (
+	ReindexReport  = iota // Nothing, they are only reported.
+	ReindexRepair         // Rewrites the index entries that differ.
+	ReindexRebuild        // Drops the index database and writes it anew.
+)
+
+// An index entry that does not list the keys the objects say it should.
+type IndexDiff struct {
+	Bucket  string   `json:"bucket"`
+	Field   string   `json:"field"`
+	Value   string   `json:"value"`
+	Missing []string `json:"missing,omitempty"` // Objects that have the index but are not listed.
+	Extra   []string `json:"extra,omitempty"`   // Keys listed that are not there or lack the index.
+}
+
+type ReindexResult struct {
+	Scanned int         `json:"scanned"` // Objects read.
+	Entries int         `json:"entries"` // Index entries they make up.
+	Diffs   []IndexDiff `json:"diffs"`
+}
+
+// How many index entries ReindexBucket writes per batch.
+const reindexBatchSize = 1000
+
+// Works out bucket's index entries from the Meta.Indexes of its objects and
+// compares them with the index database. Writes to the bucket wait while
+// this runs, reads and queries do not. ReindexRepair leaves the index
+// database as a rebuild would without taking it away from queries.
+// ReindexRebuild does take it away, so it is only for when nothing else is
+// using the database. Gives up if ctx is done before the objects are read.
+func (database *Database) ReindexBucket(ctx context.Context, bucket string, mode int) (*ReindexResult, error) {
+	lock := database.bucketLock(bucket)
+	lock.Lock()
+	defer lock.Unlock()
+
+	result := &ReindexResult{Diffs: []IndexDiff{}}
+	expected, err := database.expectedIndexes(ctx, bucket, result)
+	if err != nil {
+		return result, err
+	}
+	result.Entries = len(expected)
+
+	indexDb := database.IndexDatabase.GetBucketNoCreate(bucket)
+	if indexDb == nil && mode == ReindexRepair && len(expected) > 0 {
+		if indexDb, err = database.IndexDatabase.GetBucket(bucket); err != nil {
+			return result, err
+		}
+	}
+	if mode != ReindexRebuild {
+		result.Diffs, err = database.diffIndexes(bucket, indexDb, expected, mode == ReindexRepair)
+		if err == nil && mode == ReindexRepair && indexDb != nil {
+			err = database.sync(indexDb)
+		}
+		return result, err
+	}
+
+	// What differed is still worth knowing.
+	if result.Diffs, err = database.diffIndexes(bucket, indexDb, expected, false); err != nil {
+		return result, err
+	}
+	if err := database.IndexDatabase.DestroyBucket(bucket); err != nil {
+		return result, err
+	}
+	if len(expected) == 0 {
+		return result, nil
+	}
+	if indexDb, err = database.IndexDatabase.GetBucket(bucket); err != nil {
+		return result, err
+	}
+	if _, err = database.diffIndexes(bucket, indexDb, expected, true); err != nil {
+		return result, err
+	}
+	return result, database.sync(indexDb)
+}
+
+// Compares indexDb, which may be nil, with the entries it should have and
+// returns where they differ. With fix it rewrites those entries as well.
+func (database *Database) diffIndexes(bucket string, indexDb Engine, expected map[string][]string, fix bool) ([]IndexDiff, error) {
+	diffs := []IndexDiff{}
+	wb := new(Batch)
+	pending := 0
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		err := indexDb.Write(wb, false)
+		wb.Clear()
+		pending = 0
+		return err
+	}
+	add := func(diff IndexDiff, entry string, keys []string) error {
+		diffs = append(diffs, diff)
+		if !fix {
+			return nil
+		}
+		if len(keys) == 0 {
+			wb.Delete([]byte(entry))
+		} else {
+			wb.Put([]byte(entry), []byte(strings.Join(keys, "\t")))
+		}
+		if pending++; pending == reindexBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	// Entries the index database has, against what they should list.
+	seen := make(map[string]bool)
+	if indexDb != nil {
+		it := indexDb.NewIterator(false)
+		defer it.Close()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			entry := string(it.Key())
+			seen[entry] = true
+			diff, same := diffIndexEntry(bucket, entry, expected[entry], DecodeDataKeys(it.Value()))
+			if same {
+				continue
+			}
+			if err := add(diff, entry, expected[entry]); err != nil {
+				return diffs, err
+			}
+		}
+		if err := it.GetError(); err != nil {
+			return diffs, err
+		}
+	}
+
+	// And the ones it does not have at all.
+	var entries []string
+	for entry := range expected {
+		if !seen[entry] {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		diff, _ := diffIndexEntry(bucket, entry, expected[entry], nil)
+		if err := add(diff, entry, expected[entry]); err != nil {
+			return diffs, err
+		}
+	}
+	return diffs, flush()
+}
+
+// Maps each index entry, "field~value" like in the index database, to the
+// sorted keys of the objects that have it.
+func (database *Database) expectedIndexes(ctx context.Context, bucket string, result *ReindexResult) (map[string][]string, error) {
+	expected := make(map[string][]string)
+	db := database.GetBucketNoCreate(bucket)
+	if db == nil {
+		return expected, nil
+	}
+
+	it := db.NewIterator(false)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if result.Scanned%reindexBatchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		result.Scanned++
+		meta, _, err := DecodeData(it.Value())
+		if err != nil {
+			// Damaged objects are scrub's business. Whatever they were
+			// indexed under is lost with them.
+			continue
+		}
+		key := string(it.Key())
+		added, _ := ComputeIndexesDiff(meta.Indexes, nil)
+		for _, index := range added {
+			entry := index[0] + "~" + index[1]
+			expected[entry] = append(expected[entry], key)
+		}
+	}
+	// Keys come out of the iterator sorted, so the lists already are.
+	return expected, it.GetError()
+}
+
+// Compares the keys an entry should list with those it does. Order does
+// not matter, but the same key listed twice is one too many.
+func diffIndexEntry(bucket, entry string, expected, actual []string) (IndexDiff, bool) {
+	diff := IndexDiff{Bucket: bucket}
+	diff.Field, diff.Value = splitIndexEntry(entry)
+
+	want := make(map[string]bool, len(expected))
+	for _, key := range expected {
+		want[key] = true
+	}
+	seen := make(map[string]bool, len(actual))
+	for _, key := range actual {
+		if !want[key] || seen[key] {
+			diff.Extra = append(diff.Extra, key)
+		}
+		seen[key] = true
+	}
+	for _, key := range expected {
+		if !seen[key] {
+			diff.Missing = append(diff.Missing, key)
+		}
+	}
+	return diff, len(diff.Missing) == 0 && len(diff.Extra) == 0
+}
+
+func splitIndexEntry(entry string) (string, string) {
+	if i := strings.Index(entry, "~"); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return entry, ""
+}
@@ -0,0 +1,139 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// An object ScrubBucket found something wrong with.
+type Damage struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// Reads every record of bucket and checks that it can be read and decoded,
+// that its checksum matches, that its value decompresses and that a large
+// object still has all of its chunks, intact. Each damaged object is handed
+// to damaged, and the scrub goes on with the next.
+// After every record read is called with how many bytes that took, so the
+// caller can throttle. Stops once ctx is done. Returns how many records
+// were looked at.
+func (database *Database) ScrubBucket(ctx context.Context, bucket string, read func(n int), damaged func(Damage)) (int, error) {
+	db := database.GetBucketNoCreate(bucket)
+	if db == nil {
+		return 0, nil
+	}
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	scanned := 0
+	unreadable := false
+	it := snapshot.NewIterator(false)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return scanned, err
+		}
+		scanned++
+		key, record := it.Key(), it.Value()
+		if record == nil {
+			// Records are never empty, so the engine could not read this
+			// one, which bitcask finds out record by record. Reading it
+			// alone says why.
+			unreadable = true
+			if _, err := snapshot.Get(key); err != nil && stillUnreadable(db, key) {
+				damaged(Damage{Bucket: bucket, Key: string(key), Problem: "reading the record failed: " + err.Error()})
+			}
+			continue
+		}
+		problem, n := database.scrubRecord(bucket, record)
+		if problem != "" && stillStored(db, key, record) {
+			damaged(Damage{Bucket: bucket, Key: string(key), Problem: problem})
+		}
+		if read != nil {
+			read(len(record) + n)
+		}
+	}
+	// The iterator holds on to the error of the first record it could not
+	// read, and those were reported one by one already.
+	if unreadable {
+		return scanned, nil
+	}
+	return scanned, it.GetError()
+}
+
+// What is wrong with a record, if anything, and how many chunk bytes were
+// read to find out.
+func (database *Database) scrubRecord(bucket string, record []byte) (string, int) {
+	meta, data, err := DecodeData(record)
+	if err != nil {
+		return err.Error(), 0
+	}
+	if meta.Manifest == nil {
+		if _, err := Decompress(meta.Codec, data); err != nil {
+			return fmt.Sprintf("value does not decompress with %s: %s", meta.Codec, err), 0
+		}
+		return "", 0
+	}
+
+	chunkDb := database.ChunkDatabase.GetBucketNoCreate(bucket)
+	if chunkDb == nil {
+		return "chunks are missing", 0
+	}
+	read := 0
+	size := int64(0)
+	for n := int64(0); n < meta.Manifest.Chunks(); n++ {
+		chunk, err := chunkDb.Get(ChunkKey(meta.Manifest.Id, n))
+		if err != nil {
+			return fmt.Sprintf("reading chunk %d failed: %s", n, err), read
+		}
+		if chunk == nil {
+			return fmt.Sprintf("chunk %d is missing", n), read
+		}
+		read += len(chunk)
+		if !meta.Manifest.Verify(n, chunk) {
+			return fmt.Sprintf("chunk %d does not match its checksum", n), read
+		}
+		if chunk, err = meta.Manifest.decompressChunk(n, chunk); err != nil {
+			return fmt.Sprintf("chunk %d does not decompress with %s: %s", n, meta.Manifest.Codec, err), read
+		}
+		size += int64(len(chunk))
+	}
+	if size != meta.Manifest.Size {
+		return fmt.Sprintf("chunks hold %d bytes instead of %d", size, meta.Manifest.Size), read
+	}
+	return "", read
+}
+
+// Whether key still holds record. Chunks are read outside the snapshot, so
+// an object overwritten since then can look like it lost them.
+func stillStored(db Engine, key, record []byte) bool {
+	current, err := db.Get(key)
+	return err == nil && bytes.Equal(current, record)
+}
+
+// Whether key still cannot be read, rather than having been written again
+// since the snapshot.
+func stillUnreadable(db Engine, key []byte) bool {
+	_, err := db.Get(key)
+	return err != nil
+}
@@ -18,6 +18,8 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"levelupdb/backend"
 	"net/http"
 	"strings"
 )
@@ -44,16 +46,27 @@ func bucketsOps(w http.ResponseWriter, req *http.Request) {
 					streamKeys(w, req, splitted[0])
 				}
 			}
+		} else if length == 2 && splitted[1] == "props" {
+			switch {
+			case req.Method == "GET":
+				getBucketProps(w, req, splitted[0])
+			case req.Method == "PUT":
+				setBucketProps(w, req, splitted[0])
+			default:
+				w.WriteHeader(405)
+			}
 		} else if length == 3 && splitted[1] == "keys" {
 			bucket := splitted[0]
 			key := splitted[2]
 			switch {
-			case req.Method == "GET":
+			case req.Method == "GET" || req.Method == "HEAD":
 				fetchObject(w, req, bucket, key)
 			case req.Method == "PUT" || req.Method == "POST":
 				storeObject(w, req, bucket, key)
 			case req.Method == "DELETE":
 				deleteObject(w, req, bucket, key)
+			default:
+				w.WriteHeader(405)
 			}
 		} else if length >= 4 && splitted[1] == "index" {
 			bucket := splitted[0]
@@ -78,16 +91,26 @@ type allBuckets struct {
 
 func listBuckets(w http.ResponseWriter, req *http.Request) {
 	var all allBuckets
+	done := timePhase(req, phaseLevelDBRead)
 	buckets, err := database.GetAllBucketNames()
-	all.Buckets = buckets
+	done()
 	if err != nil {
 		mainLogger.Println("ERROR: Getting all databases name failed with", err)
 		w.WriteHeader(500)
 		return
 	}
 
+	all.Buckets = make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		if canAccess(req, bucket, permList) {
+			all.Buckets = append(all.Buckets, bucket)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	done = timePhase(req, phaseJSONEncode)
 	data, err := json.Marshal(all)
+	done()
 	if err != nil {
 		w.WriteHeader(500)
 		return
@@ -102,14 +125,19 @@ type allKeys struct {
 
 func listKeys(w http.ResponseWriter, req *http.Request, bucket string) {
 	var all allKeys
+	done := timePhase(req, phaseLevelDBRead)
 	keys, err := database.GetAllKeys(bucket)
+	done()
 	all.Keys = keys
 	if err != nil {
 		w.WriteHeader(500)
 		return
 	}
 
-	if data, err := json.Marshal(all); err == nil {
+	done = timePhase(req, phaseJSONEncode)
+	data, err := json.Marshal(all)
+	done()
+	if err == nil {
 		w.Write(data)
 	} else {
 		w.WriteHeader(500)
@@ -135,3 +163,82 @@ func streamKeys(w http.ResponseWriter, req *http.Request, bucket string) {
 		key = <-keysChannel
 	}
 }
+
+// The Riak properties are fixed since there is only ever one copy of
+// anything and the last write always wins.
+type bucketProps struct {
+	Name          string `json:"name"`
+	NVal          int    `json:"n_val"`
+	AllowMult     bool   `json:"allow_mult"`
+	LastWriteWins bool   `json:"last_write_wins"`
+	*backend.BucketProps
+}
+
+type bucketPropsBody struct {
+	Props bucketProps `json:"props"`
+}
+
+func getBucketProps(w http.ResponseWriter, req *http.Request, bucket string) {
+	props, err := database.Props.Get(bucket)
+	if err != nil {
+		mainLogger.Println("ERROR: Getting bucket properties failed with", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	var body bucketPropsBody
+	body.Props = bucketProps{Name: bucket, NVal: 1, AllowMult: false, LastWriteWins: true, BucketProps: props}
+	w.Header().Set("Content-Type", "application/json")
+	if data, err := json.Marshal(body); err == nil {
+		w.Write(data)
+	} else {
+		w.WriteHeader(500)
+	}
+}
+
+// Only the properties present in the body change. Riak properties that do
+// not apply here are accepted and ignored so Riak clients keep working.
+func setBucketProps(w http.ResponseWriter, req *http.Request, bucket string) {
+	current, err := database.Props.Get(bucket)
+	if err != nil {
+		mainLogger.Println("ERROR: Getting bucket properties failed with", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// The cached properties are shared, so decode into a deep enough copy.
+	props := *current
+	if current.LevelDB.ParanoidChecks != nil {
+		paranoid := *current.LevelDB.ParanoidChecks
+		props.LevelDB.ParanoidChecks = &paranoid
+	}
+	var body bucketPropsBody
+	body.Props.BucketProps = &props
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err == nil {
+		err = props.Validate()
+	}
+	if err == nil {
+		err = database.Backends.Check(props.Backend)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if err := database.SetBucketProps(bucket, &props); err == backend.ErrBucketNotEmpty {
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if err != nil {
+		mainLogger.Println("ERROR: Setting bucket properties failed with", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,112 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+)
+
+type keyList struct {
+	Keys []string `json:"keys"`
+}
+
+func (client *Client) ListBuckets(ctx context.Context) ([]string, error) {
+	var buckets struct {
+		Buckets []string `json:"buckets"`
+	}
+	err := client.getJSON(ctx, "/buckets", url.Values{"buckets": {"true"}}, &buckets)
+	return buckets.Buckets, err
+}
+
+// Every key in bucket, in one response. StreamKeys suits big buckets.
+func (client *Client) ListKeys(ctx context.Context, bucket string) ([]string, error) {
+	var keys keyList
+	err := client.getJSON(ctx, objectPath("buckets", bucket, "keys"), url.Values{"keys": {"true"}}, &keys)
+	if keys.Keys == nil {
+		keys.Keys = []string{}
+	}
+	return keys.Keys, err
+}
+
+// Calls fn with each key in bucket as the server sends them. Stops at the
+// first error fn returns and returns it.
+func (client *Client) StreamKeys(ctx context.Context, bucket string, fn func(key string) error) error {
+	resp, err := client.do(ctx, "GET", objectPath("buckets", bucket, "keys"), url.Values{"keys": {"stream"}}, nil, nil, 200)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var keys keyList
+		if err := decoder.Decode(&keys); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, key := range keys.Keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Riak's bucket properties plus levelupdb's own. Fields left empty are not
+// changed by SetBucketProps.
+type BucketProps struct {
+	Name          string `json:"name,omitempty"`
+	NVal          int    `json:"n_val,omitempty"`
+	AllowMult     bool   `json:"allow_mult,omitempty"`
+	LastWriteWins bool   `json:"last_write_wins,omitempty"`
+
+	DW          string                 `json:"dw,omitempty"`
+	Compression string                 `json:"compression,omitempty"`
+	Backend     string                 `json:"backend,omitempty"`
+	LevelDB     map[string]interface{} `json:"leveldb,omitempty"`
+}
+
+type bucketPropsBody struct {
+	Props *BucketProps `json:"props"`
+}
+
+func (client *Client) GetBucketProps(ctx context.Context, bucket string) (*BucketProps, error) {
+	body := bucketPropsBody{Props: new(BucketProps)}
+	if err := client.getJSON(ctx, objectPath("buckets", bucket, "props"), nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Props, nil
+}
+
+func (client *Client) SetBucketProps(ctx context.Context, bucket string, props *BucketProps) error {
+	data, err := json.Marshal(bucketPropsBody{Props: props})
+	if err != nil {
+		return err
+	}
+	header := map[string][]string{"Content-Type": {"application/json"}}
+	resp, err := client.do(ctx, "PUT", objectPath("buckets", bucket, "props"), nil, header, bytes.NewReader(data), 200, 204)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package client talks to levelupdb, or to Riak, over the Riak HTTP API
+// (the /buckets URLs).
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Matched by errors.Is against the *Error of a response with that status.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// What a request that got an unexpected status fails with.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string // The start of the response body, which usually says why.
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Body != "" {
+		message += ": " + e.Body
+	}
+	return message
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == 404
+	case ErrUnauthorized:
+		return e.StatusCode == 401
+	case ErrForbidden:
+		return e.StatusCode == 403
+	}
+	return false
+}
+
+// A Client is safe to use from many goroutines, and should be shared so its
+// connections are reused.
+type Client struct {
+	base          string
+	http          *http.Client
+	authorization string
+}
+
+type Option func(*Client)
+
+// Sends requests through httpClient instead of the client's own pool.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) { client.http = httpClient }
+}
+
+// Keeps up to n idle connections to the server around, 16 by default.
+func WithMaxIdleConns(n int) Option {
+	return func(client *Client) {
+		if transport, ok := client.http.Transport.(*http.Transport); ok {
+			transport.MaxIdleConns = n
+			transport.MaxIdleConnsPerHost = n
+		}
+	}
+}
+
+// Authenticates with an API token.
+func WithToken(token string) Option {
+	return func(client *Client) { client.authorization = "Bearer " + token }
+}
+
+// Authenticates with a user name and password.
+func WithBasicAuth(user, password string) Option {
+	return func(client *Client) {
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(user, password)
+		client.authorization = req.Header.Get("Authorization")
+	}
+}
+
+// A client for the server at baseURL, e.g. http://localhost:8198.
+func New(baseURL string, options ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 16
+	transport.MaxIdleConnsPerHost = 16
+	client := &Client{
+		base: strings.TrimSuffix(baseURL, "/"),
+		http: &http.Client{Transport: transport},
+	}
+	for _, option := range options {
+		option(client)
+	}
+	return client
+}
+
+// Builds a path out of escaped segments.
+func objectPath(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// Sends a request and returns the response if its status is one of ok.
+// Any other status is turned into an *Error and the body closed.
+func (client *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	target := client.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if client.authorization != "" {
+		req.Header.Set("Authorization", client.authorization)
+	}
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(message))}
+}
+
+// Sends a GET and decodes the JSON it answers with into v.
+func (client *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := client.do(ctx, "GET", path, query, nil, nil, 200)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Fails unless the server answers pings.
+func (client *Client) Ping(ctx context.Context) error {
+	resp, err := client.do(ctx, "GET", "/ping", nil, nil, nil, 200)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// The server's /stats, as it sends them.
+func (client *Client) Stats(ctx context.Context) (map[string]interface{}, error) {
+	stats := make(map[string]interface{})
+	return stats, client.getJSON(ctx, "/stats", nil, &stats)
+}
@@ -0,0 +1,253 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Link struct {
+	Bucket string
+	Key    string
+	Tag    string
+}
+
+type Object struct {
+	Bucket      string
+	Key         string // Left empty, Put has the server make one up.
+	ContentType string
+	Value       []byte
+
+	// Indexes are named with their _bin or _int suffix. Meta keys are
+	// without the X-Riak-Meta- prefix; servers give them back lower case.
+	Indexes map[string][]string
+	Meta    map[string]string
+	Links   []Link
+
+	// Set by the server, ignored by Put.
+	LastModified time.Time
+	ETag         string
+	VClock       string
+}
+
+// The headers that carry an object's metadata.
+func (object *Object) header() http.Header {
+	header := make(http.Header)
+	if object.ContentType != "" {
+		header.Set("Content-Type", object.ContentType)
+	}
+	names := make([]string, 0, len(object.Indexes))
+	for name := range object.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header.Add("X-Riak-Index-"+name, strings.Join(object.Indexes[name], ","))
+	}
+	for key, value := range object.Meta {
+		header.Set("X-Riak-Meta-"+key, value)
+	}
+	if len(object.Links) > 0 {
+		links := make([]string, len(object.Links))
+		for i, link := range object.Links {
+			links[i] = fmt.Sprintf(`<%s>; riaktag="%s"`, objectPath("buckets", link.Bucket, "keys", link.Key), link.Tag)
+		}
+		header.Set("Link", strings.Join(links, ", "))
+	}
+	return header
+}
+
+var linkRegexp = regexp.MustCompile(`<([^>]*)>; ?(riaktag|rel)="([^"]*)"`)
+
+// Fills in the metadata from the headers an object was sent with.
+func (object *Object) fromHeader(header http.Header) {
+	object.ContentType = header.Get("Content-Type")
+	object.ETag = header.Get("ETag")
+	object.VClock = header.Get("X-Riak-Vclock")
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		object.LastModified = modified
+	}
+
+	object.Indexes = make(map[string][]string)
+	object.Meta = make(map[string]string)
+	object.Links = nil
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		switch {
+		case strings.HasPrefix(lower, "x-riak-index-"):
+			for _, value := range values {
+				object.Indexes[lower[13:]] = append(object.Indexes[lower[13:]], strings.Split(value, ",")...)
+			}
+		case strings.HasPrefix(lower, "x-riak-meta-") && len(values) > 0:
+			object.Meta[lower[12:]] = values[0]
+		}
+	}
+
+	for _, links := range header["Link"] {
+		for _, match := range linkRegexp.FindAllStringSubmatch(links, -1) {
+			if match[2] != "riaktag" {
+				continue // The link up to the bucket.
+			}
+			if bucket, key, ok := splitObjectPath(match[1]); ok {
+				object.Links = append(object.Links, Link{Bucket: bucket, Key: key, Tag: match[3]})
+			}
+		}
+	}
+}
+
+// Takes /buckets/<bucket>/keys/<key>, or Riak's old /riak/<bucket>/<key>,
+// apart.
+func splitObjectPath(path string) (bucket, key string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var err error
+	switch {
+	case len(parts) == 4 && parts[0] == "buckets" && parts[2] == "keys":
+		bucket, key = parts[1], parts[3]
+	case len(parts) == 3:
+		bucket, key = parts[1], parts[2]
+	default:
+		return "", "", false
+	}
+	if bucket, err = url.PathUnescape(bucket); err != nil {
+		return "", "", false
+	}
+	if key, err = url.PathUnescape(key); err != nil {
+		return "", "", false
+	}
+	return bucket, key, true
+}
+
+// Reads an object. Fails with ErrNotFound if there is none.
+func (client *Client) Get(ctx context.Context, bucket, key string) (*Object, error) {
+	object, value, err := client.GetStream(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer value.Close()
+	if object.Value, err = ioutil.ReadAll(value); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Reads an object's metadata, leaving its value for the caller to read
+// from value and close. Suits large values.
+func (client *Client) GetStream(ctx context.Context, bucket, key string) (object *Object, value io.ReadCloser, err error) {
+	resp, err := client.do(ctx, "GET", objectPath("buckets", bucket, "keys", key), nil, nil, nil, 200)
+	if err != nil {
+		return nil, nil, err
+	}
+	object = &Object{Bucket: bucket, Key: key}
+	object.fromHeader(resp.Header)
+	return object, resp.Body, nil
+}
+
+// Reads an object's metadata without its value. Fails with ErrNotFound if
+// there is none.
+func (client *Client) Head(ctx context.Context, bucket, key string) (*Object, error) {
+	resp, err := client.do(ctx, "HEAD", objectPath("buckets", bucket, "keys", key), nil, nil, nil, 200)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	object := &Object{Bucket: bucket, Key: key}
+	object.fromHeader(resp.Header)
+	return object, nil
+}
+
+type PutOptions struct {
+	// Syncs the write to disk before returning: "one", "quorum", "all" or a
+	// number. Empty leaves it to the bucket.
+	DW string
+	// Reads the stored object back into the one put.
+	ReturnBody bool
+}
+
+func (options *PutOptions) query() url.Values {
+	query := make(url.Values)
+	if options == nil {
+		return query
+	}
+	if options.DW != "" {
+		query.Set("dw", options.DW)
+	}
+	if options.ReturnBody {
+		query.Set("returnbody", "true")
+	}
+	return query
+}
+
+// Stores object with object.Value as its value. If object.Key is
+// empty the server picks one and object.Key is set to it.
+func (client *Client) Put(ctx context.Context, object *Object, options *PutOptions) error {
+	return client.PutStream(ctx, object, bytes.NewReader(object.Value), options)
+}
+
+// Stores object with a value read from value instead of object.Value.
+// Suits large values.
+func (client *Client) PutStream(ctx context.Context, object *Object, value io.Reader, options *PutOptions) error {
+	method, path := "PUT", objectPath("buckets", object.Bucket, "keys", object.Key)
+	if object.Key == "" {
+		method, path = "POST", objectPath("buckets", object.Bucket, "keys")
+	}
+	resp, err := client.do(ctx, method, path, options.query(), object.header(), value, 200, 201, 204)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if location := resp.Header.Get("Location"); object.Key == "" && location != "" {
+		if _, key, ok := splitObjectPath(location); ok {
+			object.Key = key
+		}
+	}
+	if options != nil && options.ReturnBody {
+		object.fromHeader(resp.Header)
+		if object.Value, err = ioutil.ReadAll(resp.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type DeleteOptions struct {
+	DW string // As in PutOptions.
+}
+
+// Deletes an object. Fails with ErrNotFound if there was none.
+func (client *Client) Delete(ctx context.Context, bucket, key string, options *DeleteOptions) error {
+	query := make(url.Values)
+	if options != nil && options.DW != "" {
+		query.Set("dw", options.DW)
+	}
+	resp, err := client.do(ctx, "DELETE", objectPath("buckets", bucket, "keys", key), query, nil, nil, 204)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// The keys of bucket's objects that have value for the index field, e.g.
+// "colour_bin". The special fields "$key" and "$bucket" work too.
+func (client *Client) Index(ctx context.Context, bucket, field, value string) ([]string, error) {
+	return client.index(ctx, objectPath("buckets", bucket, "index", field, value))
+}
+
+// The keys of bucket's objects whose value for the index field is between
+// start and end, both included.
+func (client *Client) IndexRange(ctx context.Context, bucket, field, start, end string) ([]string, error) {
+	return client.index(ctx, objectPath("buckets", bucket, "index", field, start, end))
+}
+
+// A bucket nothing was ever indexed in finds nothing, like in Riak.
+func (client *Client) index(ctx context.Context, path string) ([]string, error) {
+	var keys keyList
+	err := client.getJSON(ctx, path, nil, &keys)
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	if keys.Keys == nil {
+		keys.Keys = []string{}
+	}
+	return keys.Keys, err
+}
+
+// One step of a link walk: follows links to Bucket tagged Tag, either of
+// which can be "_" for any. Objects are only returned for steps that Keep
+// them and for the last step.
+type LinkStep struct {
+	Bucket string
+	Tag    string
+	Keep   bool
+}
+
+// Walks links from bucket/key. Returns the objects found by each step, in
+// order; steps that are not kept have none.
+func (client *Client) WalkLinks(ctx context.Context, bucket, key string, steps ...LinkStep) ([][]*Object, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("a link walk needs at least one step")
+	}
+	path := objectPath("buckets", bucket, "keys", key)
+	for _, step := range steps {
+		keep := "0"
+		if step.Keep {
+			keep = "1"
+		}
+		path += "/" + strings.Join([]string{step.Bucket, step.Tag, keep}, ",")
+	}
+
+	resp, err := client.do(ctx, "GET", path, nil, nil, nil, 200)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	phases, err := multipartReader(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var results [][]*Object
+	for {
+		phase, err := phases.NextPart()
+		if err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return nil, err
+		}
+		objects, err := readObjects(phase)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, objects)
+	}
+}
+
+func multipartReader(contentType string, body io.Reader) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("expected a multipart response, got %q", contentType)
+	}
+	return multipart.NewReader(body, params["boundary"]), nil
+}
+
+// The objects in one step's part of a link walk response.
+func readObjects(phase *multipart.Part) ([]*Object, error) {
+	objects := []*Object{}
+	parts, err := multipartReader(phase.Header.Get("Content-Type"), phase)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		object := new(Object)
+		object.fromHeader(http.Header(part.Header))
+		object.Bucket, object.Key, _ = splitObjectPath(part.Header.Get("Location"))
+		if object.Value, err = ioutil.ReadAll(part); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+}
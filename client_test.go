@@ -0,0 +1,212 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+// The client package is tested here, against the real handlers, since they
+// live in package main.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"levelupdb/client"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestClient(t *testing.T) (*client.Client, context.Context) {
+	server := newTestServer(t)
+	return client.New(server.URL), context.Background()
+}
+
+func TestClientObjects(t *testing.T) {
+	c, ctx := newTestClient(t)
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	object := &client.Object{
+		Bucket:      "b",
+		Key:         "k",
+		ContentType: "text/plain",
+		Value:       []byte("hello"),
+		Indexes:     map[string][]string{"colour_bin": {"purple", "green"}, "age_int": {"42"}},
+		Meta:        map[string]string{"mood": "fine"},
+		Links:       []client.Link{{Bucket: "b", Key: "other", Tag: "friend"}},
+	}
+	if err := c.Put(ctx, object, &client.PutOptions{DW: "one"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.Get(ctx, "b", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Value) != "hello" || got.ContentType != "text/plain" || got.Meta["mood"] != "fine" {
+		t.Fatalf("unexpected object %+v", got)
+	}
+	sort.Strings(got.Indexes["colour_bin"])
+	if !reflect.DeepEqual(got.Indexes, map[string][]string{"colour_bin": {"green", "purple"}, "age_int": {"42"}}) {
+		t.Fatalf("unexpected indexes %v", got.Indexes)
+	}
+	if !reflect.DeepEqual(got.Links, object.Links) {
+		t.Fatalf("unexpected links %v", got.Links)
+	}
+	if got.LastModified.IsZero() || got.ETag == "" || got.VClock == "" {
+		t.Fatalf("expected Last-Modified, ETag and a vclock, got %+v", got)
+	}
+
+	head, err := c.Head(ctx, "b", "k")
+	if err != nil || head.Value != nil || head.ETag != got.ETag {
+		t.Fatalf("unexpected HEAD %+v %v", head, err)
+	}
+
+	created := &client.Object{Bucket: "b", ContentType: "text/plain", Value: []byte("new")}
+	if err := c.Put(ctx, created, &client.PutOptions{ReturnBody: true}); err != nil {
+		t.Fatal(err)
+	}
+	if created.Key == "" || string(created.Value) != "new" || created.ETag == "" {
+		t.Fatalf("expected a key and the stored object back, got %+v", created)
+	}
+
+	value, err := c.Get(ctx, "b", created.Key)
+	if err != nil || string(value.Value) != "new" {
+		t.Fatalf("unexpected created object %+v %v", value, err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 200000)
+	if err := c.PutStream(ctx, &client.Object{Bucket: "b", Key: "big"}, bytes.NewReader(big), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "b", "big"); err != nil || !bytes.Equal(got.Value, big) {
+		t.Fatal("large object did not round trip", err)
+	}
+
+	if err := c.Delete(ctx, "b", "k", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(ctx, "b", "k")
+	var clientErr *client.Error
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &clientErr) || clientErr.StatusCode != 404 {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := c.Delete(ctx, "b", "k", nil); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound deleting twice, got %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Get(canceled, "b", "big"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled request, got %v", err)
+	}
+}
+
+func TestClientBuckets(t *testing.T) {
+	c, ctx := newTestClient(t)
+
+	for _, key := range []string{"a", "b", "c"} {
+		object := &client.Object{Bucket: "letters", Key: key, Value: []byte(key), Indexes: map[string][]string{"letter_bin": {key}}}
+		if err := c.Put(ctx, object, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := c.ListBuckets(ctx)
+	if err != nil || !reflect.DeepEqual(buckets, []string{"letters"}) {
+		t.Fatalf("unexpected buckets %v %v", buckets, err)
+	}
+	keys, err := c.ListKeys(ctx, "letters")
+	if sort.Strings(keys); err != nil || strings.Join(keys, "") != "abc" {
+		t.Fatalf("unexpected keys %v %v", keys, err)
+	}
+	var streamed []string
+	err = c.StreamKeys(ctx, "letters", func(key string) error {
+		streamed = append(streamed, key)
+		return nil
+	})
+	if sort.Strings(streamed); err != nil || strings.Join(streamed, "") != "abc" {
+		t.Fatalf("unexpected streamed keys %v %v", streamed, err)
+	}
+
+	if keys, err = c.Index(ctx, "letters", "letter_bin", "b"); err != nil || strings.Join(keys, "") != "b" {
+		t.Fatalf("unexpected index keys %v %v", keys, err)
+	}
+	if keys, err = c.IndexRange(ctx, "letters", "letter_bin", "b", "c"); err != nil || strings.Join(keys, "") != "bc" {
+		t.Fatalf("unexpected index range %v %v", keys, err)
+	}
+	if keys, err = c.IndexRange(ctx, "letters", "$key", "a", "b"); err != nil || strings.Join(keys, "") != "ab" {
+		t.Fatalf("unexpected $key range %v %v", keys, err)
+	}
+	if keys, err = c.Index(ctx, "nothing", "letter_bin", "b"); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys from a bucket without indexes, got %v %v", keys, err)
+	}
+
+	if err := c.SetBucketProps(ctx, "letters", &client.BucketProps{Compression: "snappy"}); err != nil {
+		t.Fatal(err)
+	}
+	props, err := c.GetBucketProps(ctx, "letters")
+	if err != nil || props.Name != "letters" || props.NVal != 1 || props.Compression != "snappy" {
+		t.Fatalf("unexpected props %+v %v", props, err)
+	}
+	err = c.SetBucketProps(ctx, "letters", &client.BucketProps{Compression: "zip"})
+	var clientErr *client.Error
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != 400 || !strings.Contains(clientErr.Body, "compression") {
+		t.Fatalf("expected a 400 saying why, got %v", err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil || len(stats) == 0 {
+		t.Fatalf("unexpected stats %v %v", stats, err)
+	}
+}
+
+func TestClientLinkWalk(t *testing.T) {
+	c, ctx := newTestClient(t)
+
+	put := func(key string, links ...client.Link) {
+		object := &client.Object{Bucket: "people", Key: key, ContentType: "text/plain", Value: []byte(key), Links: links}
+		if err := c.Put(ctx, object, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("carol")
+	put("bob", client.Link{Bucket: "people", Key: "carol", Tag: "friend"})
+	put("alice", client.Link{Bucket: "people", Key: "bob", Tag: "friend"}, client.Link{Bucket: "people", Key: "nobody", Tag: "friend"})
+
+	steps, err := c.WalkLinks(ctx, "people", "alice",
+		client.LinkStep{Bucket: "people", Tag: "friend", Keep: true},
+		client.LinkStep{Bucket: "_", Tag: "_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || len(steps[0]) != 1 || len(steps[1]) != 1 {
+		t.Fatalf("unexpected walk %v", steps)
+	}
+	bob, carol := steps[0][0], steps[1][0]
+	if bob.Bucket != "people" || bob.Key != "bob" || string(bob.Value) != "bob" || len(bob.Links) != 1 {
+		t.Fatalf("unexpected first step %+v", bob)
+	}
+	if carol.Key != "carol" || string(carol.Value) != "carol" || carol.ContentType != "text/plain" {
+		t.Fatalf("unexpected second step %+v", carol)
+	}
+
+	if _, err := c.WalkLinks(ctx, "people", "nobody", client.LinkStep{Bucket: "_", Tag: "_"}); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound walking from a missing object, got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"levelupdb/backend"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "LEVELUPDB_"
+
+type Config struct {
+	DatabaseLocation string
+	Logging          string
+	HttpPort         string
+	Webhooks         WebhookConfig
+	Auth             AuthConfig
+	TLS              TLSConfig
+	Engine           string                 // leveldb, bitcask, or memory, which keeps nothing once the server stops.
+	LevelDB          backend.LevelDBOptions // Bucket properties can override these.
+	Bitcask          backend.BitcaskOptions // And these.
+
+	// Engine configurations buckets can be kept in instead of Engine, by
+	// setting their backend property to the name. Their LevelDB and Bitcask
+	// options go over the ones above.
+	Backends map[string]backend.Backend
+
+	// Durable writes (dw >= 1) share fsyncs instead of each doing their own.
+	// The window is how many microseconds the first writer of a group waits
+	// for others to join it.
+	GroupCommit       bool
+	GroupCommitWindow int
+
+	ShutdownTimeout int // Seconds to wait for in-flight requests on SIGTERM.
+
+	// Log files rotate when they reach LogMaxSize megabytes or are LogMaxAge
+	// hours old, whichever comes first; zero turns either off. Only the
+	// newest LogMaxBackups rotated files are kept, zero keeps them all.
+	LogLevel      string // debug, info, warn or error
+	LogMaxSize    int
+	LogMaxAge     int
+	LogMaxBackups int
+	AccessLog     string // Empty for none, stdout or a file; one JSON object per request.
+
+	// Requests taking at least SlowRequestThreshold milliseconds are logged
+	// with where their time went, and the last SlowRequestLogSize of them
+	// are kept for /admin/slow-requests. A threshold of zero turns this off.
+	SlowRequestThreshold int
+	SlowRequestLogSize   int
+
+	// Values larger than LargeObjectThreshold bytes are streamed into chunks
+	// of ChunkSize bytes instead of being held in memory whole.
+	LargeObjectThreshold int
+	ChunkSize            int
+
+	// Every ScrubInterval hours every object is read back and checked, at
+	// no more than ScrubRate megabytes per second; zero turns either off.
+	// What was found goes to ScrubReport, scrub-report.json in the
+	// DatabaseLocation by default.
+	ScrubInterval int
+	ScrubRate     int
+	ScrubReport   string
+}
+
+// What you get without a config file.
+func defaultConfig() *Config {
+	return &Config{
+		DatabaseLocation: "./databases",
+		Logging:          "stdout",
+		HttpPort:         "8198",
+		Webhooks: WebhookConfig{
+			MaxAttempts:    10,
+			InitialBackoff: 1,
+			MaxBackoff:     3600,
+			Timeout:        10,
+			Workers:        4,
+		},
+		Auth: AuthConfig{CredentialsFile: "credentials.json"},
+		TLS:  TLSConfig{Port: "8443"},
+		LevelDB: backend.LevelDBOptions{
+			BlockCacheSize: 4194304,
+		},
+		Engine:          "leveldb",
+		ShutdownTimeout: 30,
+		LogLevel:        "info",
+		LogMaxSize:      100,
+		LogMaxBackups:   7,
+
+		SlowRequestThreshold: 1000,
+		SlowRequestLogSize:   100,
+
+		LargeObjectThreshold: 1048576,
+		ChunkSize:            262144,
+
+		ScrubInterval: 168,
+		ScrubRate:     8,
+	}
+}
+
+// The flags every command that needs a configuration accepts.
+type configFlags struct {
+	set  *flag.FlagSet
+	path string
+	data string
+	http string
+	log  string
+}
+
+func newConfigFlags(name string) *configFlags {
+	flags := &configFlags{set: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags.set.StringVar(&flags.path, "config", "config.json", "path to the config file ($"+envPrefix+"CONFIG)")
+	flags.set.StringVar(&flags.data, "data", "", "database location, overrides DatabaseLocation ($"+envPrefix+"DATA)")
+	flags.set.StringVar(&flags.http, "http", "", "HTTP port, overrides HttpPort ($"+envPrefix+"HTTP)")
+	flags.set.StringVar(&flags.log, "log", "", "stdout, none or a file, overrides Logging ($"+envPrefix+"LOG)")
+	return flags
+}
+
+func (flags *configFlags) isSet(name string) bool {
+	set := false
+	flags.set.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Builds the effective configuration. Later sources win: defaults, the
+// config file, LEVELUPDB_* environment variables and finally flags.
+func initializeConfig(flags *configFlags) (*Config, error) {
+	config := defaultConfig()
+
+	configPath, explicit := flags.path, flags.isSet("config")
+	if env := os.Getenv(envPrefix + "CONFIG"); env != "" && !explicit {
+		configPath, explicit = env, true
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("config file %s: %s", configPath, err)
+		}
+	case os.IsNotExist(err) && !explicit:
+		// Running without a config file is fine, the defaults are sane.
+	default:
+		return nil, fmt.Errorf("config file %s: %s", configPath, err)
+	}
+
+	if err := applyEnvironment(envPrefix, reflect.ValueOf(config).Elem()); err != nil {
+		return nil, err
+	}
+
+	shorthands := []struct {
+		env, flag, value string
+		field            *string
+	}{
+		{"DATA", "data", flags.data, &config.DatabaseLocation},
+		{"HTTP", "http", flags.http, &config.HttpPort},
+		{"LOG", "log", flags.log, &config.Logging},
+	}
+	for _, s := range shorthands {
+		if env, ok := os.LookupEnv(envPrefix + s.env); ok {
+			*s.field = env
+		}
+		if flags.isSet(s.flag) {
+			*s.field = s.value
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Sets string, bool and integer fields from variables named after the field
+// path, e.g. LEVELUPDB_HTTPPORT or LEVELUPDB_TLS_CERTFILE.
+func applyEnvironment(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + strings.ToUpper(t.Field(i).Name)
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Bool {
+			if _, ok := os.LookupEnv(name); ok {
+				field.Set(reflect.New(field.Type().Elem()))
+				field = field.Elem()
+			}
+		}
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvironment(name+"_", field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(env)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, env)
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", name, env)
+			}
+			field.SetInt(n)
+		default:
+			return fmt.Errorf("%s: this setting can only be set in the config file", name)
+		}
+	}
+	return nil
+}
+
+func validatePort(name, port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s: %q is not a valid port number", name, port)
+	}
+	return nil
+}
+
+func (config *Config) validate() error {
+	if config.DatabaseLocation == "" {
+		return errors.New("DatabaseLocation must not be empty")
+	}
+	if config.Logging == "" {
+		return errors.New("Logging must be stdout, none or a file path")
+	}
+	if _, ok := levelNames[config.LogLevel]; !ok {
+		return fmt.Errorf("LogLevel must be debug, info, warn or error, not %q", config.LogLevel)
+	}
+	if config.LogMaxSize < 0 || config.LogMaxAge < 0 || config.LogMaxBackups < 0 {
+		return errors.New("LogMaxSize, LogMaxAge and LogMaxBackups must not be negative")
+	}
+	if config.AccessLog != "" && config.AccessLog == config.Logging && config.AccessLog != "stdout" && config.AccessLog != "none" {
+		return errors.New("AccessLog must not be the same file as Logging")
+	}
+
+	if config.HttpPort == "" {
+		if !config.TLS.enabled() {
+			return errors.New("HttpPort can only be empty when TLS is configured")
+		}
+	} else if err := validatePort("HttpPort", config.HttpPort); err != nil {
+		return err
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return errors.New("TLS: CertFile and KeyFile must be set together")
+	}
+	if config.TLS.enabled() {
+		if err := validatePort("TLS.Port", config.TLS.Port); err != nil {
+			return err
+		}
+	}
+	if config.TLS.RequireClientCert && !config.TLS.enabled() {
+		return errors.New("TLS: RequireClientCert needs CertFile and KeyFile")
+	}
+	if config.TLS.RequireClientCert && config.TLS.ClientCAFile == "" {
+		return errors.New("TLS: RequireClientCert needs ClientCAFile to verify client certificates against")
+	}
+
+	if backend.DriverNamed(config.Engine) == nil {
+		return fmt.Errorf("Engine must be leveldb, memory or bitcask, not %q", config.Engine)
+	}
+	if err := config.LevelDB.Validate(); err != nil {
+		return fmt.Errorf("LevelDB: %s", err)
+	}
+	if err := config.Bitcask.Validate(); err != nil {
+		return fmt.Errorf("Bitcask: %s", err)
+	}
+	for name, named := range config.Backends {
+		if err := named.Validate(); err != nil {
+			return fmt.Errorf("Backends: %s: %s", name, err)
+		}
+		if name == "" || backend.DriverNamed(name) != nil {
+			return fmt.Errorf("Backends: %q cannot be used as a name", name)
+		}
+	}
+
+	if config.ShutdownTimeout < 1 {
+		return errors.New("ShutdownTimeout must be at least one second")
+	}
+	if config.SlowRequestThreshold < 0 {
+		return errors.New("SlowRequestThreshold must not be negative")
+	}
+	if config.SlowRequestThreshold > 0 && config.SlowRequestLogSize < 1 {
+		return errors.New("SlowRequestLogSize must be at least 1")
+	}
+	if config.LargeObjectThreshold < 1 || config.ChunkSize < 1 {
+		return errors.New("LargeObjectThreshold and ChunkSize must be at least 1")
+	}
+	if config.ScrubInterval < 0 || config.ScrubRate < 0 {
+		return errors.New("ScrubInterval and ScrubRate must not be negative")
+	}
+	if config.GroupCommitWindow < 0 {
+		return errors.New("GroupCommitWindow must not be negative")
+	}
+
+	if config.Auth.Enabled && config.Auth.CredentialsFile == "" {
+		return errors.New("Auth: CredentialsFile must be set when auth is enabled")
+	}
+
+	webhooks := config.Webhooks
+	if webhooks.MaxAttempts < 1 || webhooks.InitialBackoff < 1 || webhooks.MaxBackoff < 1 || webhooks.Timeout < 1 || webhooks.Workers < 1 {
+		return errors.New("Webhooks: MaxAttempts, InitialBackoff, MaxBackoff, Timeout and Workers must be positive")
+	}
+	for i, target := range webhooks.Targets {
+		u, err := url.Parse(target.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Webhooks.Targets[%d]: %q is not an http(s) url", i, target.Url)
+		}
+		if target.Bucket == "" {
+			return fmt.Errorf("Webhooks.Targets[%d]: Bucket must be a bucket name or \"*\"", i)
+		}
+	}
+	return nil
+}
+
+// levelupdb config print [flags]
+func configCommand(args []string) int {
+	if len(args) < 1 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: levelupdb config print [flags]")
+		return 2
+	}
+
+	flags := newConfigFlags("config print")
+	if err := flags.set.Parse(args[1:]); err != nil {
+		return 2
+	}
+	config, err := initializeConfig(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(append(data, '\n'))
+	return 0
+}
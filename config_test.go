@@ -0,0 +1,237 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"levelupdb/backend"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the test in an empty directory, where there is no config.json.
+func inEmptyDir(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func writeConfigFile(t *testing.T, dir, contents string) string {
+	file := filepath.Join(dir, "levelupdb.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func parseConfig(t *testing.T, args ...string) (*Config, error) {
+	flags := newConfigFlags("test")
+	flags.set.SetOutput(ioutil.Discard)
+	if err := flags.set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return initializeConfig(flags)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := inEmptyDir(t)
+	file := writeConfigFile(t, dir, `{"HttpPort": "1001", "DatabaseLocation": "/file", "LogLevel": "warn", "TLS": {"Port": "1443"}}`)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+
+		port, data, level, tlsPort string
+	}{
+		{"defaults", nil, nil, "8198", "./databases", "info", "8443"},
+		{"file", nil, []string{"-config", file}, "1001", "/file", "warn", "1443"},
+		{"env over file",
+			map[string]string{"LEVELUPDB_HTTPPORT": "2001", "LEVELUPDB_DATABASELOCATION": "/env", "LEVELUPDB_TLS_PORT": "2443"},
+			[]string{"-config", file}, "2001", "/env", "warn", "2443"},
+		{"env config path",
+			map[string]string{"LEVELUPDB_CONFIG": file, "LEVELUPDB_LOGLEVEL": "error"},
+			nil, "1001", "/file", "error", "1443"},
+		{"shorthand env over long env",
+			map[string]string{"LEVELUPDB_HTTPPORT": "2001", "LEVELUPDB_HTTP": "3001", "LEVELUPDB_DATA": "/short"},
+			[]string{"-config", file}, "3001", "/short", "warn", "1443"},
+		{"flags over env",
+			map[string]string{"LEVELUPDB_HTTPPORT": "2001", "LEVELUPDB_HTTP": "3001", "LEVELUPDB_DATA": "/short"},
+			[]string{"-config", file, "-http", "4001", "-data", "/flag"}, "4001", "/flag", "warn", "1443"},
+		{"flag config over env config",
+			map[string]string{"LEVELUPDB_CONFIG": filepath.Join(dir, "missing.json")},
+			[]string{"-config", file}, "1001", "/file", "warn", "1443"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config, err := parseConfig(t, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.HttpPort != test.port || config.DatabaseLocation != test.data ||
+				config.LogLevel != test.level || config.TLS.Port != test.tlsPort {
+				t.Errorf("got HttpPort %q, DatabaseLocation %q, LogLevel %q, TLS.Port %q",
+					config.HttpPort, config.DatabaseLocation, config.LogLevel, config.TLS.Port)
+			}
+			// What nothing overrode keeps its default.
+			if config.ChunkSize != defaultConfig().ChunkSize || config.Webhooks.Workers != defaultConfig().Webhooks.Workers {
+				t.Errorf("defaults were lost: %+v", config)
+			}
+		})
+	}
+}
+
+func TestConfigEnvironmentTypes(t *testing.T) {
+	inEmptyDir(t)
+	t.Setenv("LEVELUPDB_AUTH_ENABLED", "true")
+	t.Setenv("LEVELUPDB_SHUTDOWNTIMEOUT", "5")
+	t.Setenv("LEVELUPDB_LEVELDB_PARANOIDCHECKS", "false")
+	config, err := parseConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Auth.Enabled || config.ShutdownTimeout != 5 {
+		t.Errorf("got Auth.Enabled %v, ShutdownTimeout %d", config.Auth.Enabled, config.ShutdownTimeout)
+	}
+	if config.LevelDB.ParanoidChecks == nil || *config.LevelDB.ParanoidChecks {
+		t.Errorf("got LevelDB.ParanoidChecks %v", config.LevelDB.ParanoidChecks)
+	}
+
+	tests := []struct {
+		name, value, err string
+	}{
+		{"LEVELUPDB_AUTH_ENABLED", "maybe", `LEVELUPDB_AUTH_ENABLED: "maybe" is not a boolean`},
+		{"LEVELUPDB_SHUTDOWNTIMEOUT", "soon", `LEVELUPDB_SHUTDOWNTIMEOUT: "soon" is not an integer`},
+		{"LEVELUPDB_BACKENDS", "fast", `LEVELUPDB_BACKENDS: this setting can only be set in the config file`},
+		{"LEVELUPDB_WEBHOOKS_TARGETS", "http://x", `LEVELUPDB_WEBHOOKS_TARGETS: this setting can only be set in the config file`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.name, test.value)
+			if _, err := parseConfig(t); err == nil || err.Error() != test.err {
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := inEmptyDir(t)
+	missing := filepath.Join(dir, "missing.json")
+
+	// Without one the defaults are used, unless one was asked for.
+	if config, err := parseConfig(t); err != nil || config.HttpPort != "8198" {
+		t.Errorf("without a config file: %v, %v", config, err)
+	}
+	if _, err := parseConfig(t, "-config", missing); err == nil || !strings.HasPrefix(err.Error(), "config file "+missing+": ") {
+		t.Errorf("missing -config file: %v", err)
+	}
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("LEVELUPDB_CONFIG", missing)
+		if _, err := parseConfig(t); err == nil || !strings.HasPrefix(err.Error(), "config file "+missing+": ") {
+			t.Errorf("missing LEVELUPDB_CONFIG file: %v", err)
+		}
+	})
+
+	broken := writeConfigFile(t, dir, `{"HttpPort": `)
+	if _, err := parseConfig(t, "-config", broken); err == nil || !strings.HasPrefix(err.Error(), "config file "+broken+": ") {
+		t.Errorf("broken config file: %v", err)
+	}
+	invalid := writeConfigFile(t, dir, `{"HttpPort": "http"}`)
+	if _, err := parseConfig(t, "-config", invalid); err == nil || err.Error() != `HttpPort: "http" is not a valid port number` {
+		t.Errorf("invalid config file: %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatal("the defaults do not validate:", err)
+	}
+
+	withTLS := func(config *Config) {
+		config.TLS.CertFile, config.TLS.KeyFile = "server.crt", "server.key"
+	}
+	tests := []struct {
+		change func(*Config)
+		err    string
+	}{
+		{func(c *Config) { c.DatabaseLocation = "" }, "DatabaseLocation must not be empty"},
+		{func(c *Config) { c.Logging = "" }, "Logging must be stdout, none or a file path"},
+		{func(c *Config) { c.LogLevel = "loud" }, `LogLevel must be debug, info, warn or error, not "loud"`},
+		{func(c *Config) { c.LogMaxAge = -1 }, "LogMaxSize, LogMaxAge and LogMaxBackups must not be negative"},
+		{func(c *Config) { c.Logging, c.AccessLog = "levelupdb.log", "levelupdb.log" }, "AccessLog must not be the same file as Logging"},
+		{func(c *Config) { c.HttpPort = "" }, "HttpPort can only be empty when TLS is configured"},
+		{func(c *Config) { c.HttpPort = "65536" }, `HttpPort: "65536" is not a valid port number`},
+		{func(c *Config) { c.TLS.CertFile = "server.crt" }, "TLS: CertFile and KeyFile must be set together"},
+		{func(c *Config) { withTLS(c); c.TLS.Port = "0" }, `TLS.Port: "0" is not a valid port number`},
+		{func(c *Config) { c.TLS.RequireClientCert, c.TLS.ClientCAFile = true, "ca.crt" }, "TLS: RequireClientCert needs CertFile and KeyFile"},
+		{func(c *Config) { withTLS(c); c.TLS.RequireClientCert = true }, "TLS: RequireClientCert needs ClientCAFile to verify client certificates against"},
+		{func(c *Config) { c.Engine = "rocksdb" }, `Engine must be leveldb, memory or bitcask, not "rocksdb"`},
+		{func(c *Config) { c.LevelDB.MaxOpenFiles = 10 }, "LevelDB: leveldb max_open_files must be at least 20"},
+		{func(c *Config) { c.Bitcask.MaxFileSize = -1 }, "Bitcask: bitcask max_file_size must not be negative"},
+		{func(c *Config) { c.Backends = map[string]backend.Backend{"fast": {Engine: "rocksdb"}} },
+			`Backends: fast: Engine must be leveldb, memory or bitcask, not "rocksdb"`},
+		{func(c *Config) { c.Backends = map[string]backend.Backend{"memory": {Engine: "bitcask"}} },
+			`Backends: "memory" cannot be used as a name`},
+		{func(c *Config) { c.Backends = map[string]backend.Backend{"": {Engine: "bitcask"}} },
+			`Backends: "" cannot be used as a name`},
+		{func(c *Config) { c.ShutdownTimeout = 0 }, "ShutdownTimeout must be at least one second"},
+		{func(c *Config) { c.SlowRequestThreshold = -1 }, "SlowRequestThreshold must not be negative"},
+		{func(c *Config) { c.SlowRequestLogSize = 0 }, "SlowRequestLogSize must be at least 1"},
+		{func(c *Config) { c.ChunkSize = 0 }, "LargeObjectThreshold and ChunkSize must be at least 1"},
+		{func(c *Config) { c.ScrubRate = -1 }, "ScrubInterval and ScrubRate must not be negative"},
+		{func(c *Config) { c.GroupCommitWindow = -1 }, "GroupCommitWindow must not be negative"},
+		{func(c *Config) { c.Auth = AuthConfig{Enabled: true} }, "Auth: CredentialsFile must be set when auth is enabled"},
+		{func(c *Config) { c.Webhooks.Workers = 0 },
+			"Webhooks: MaxAttempts, InitialBackoff, MaxBackoff, Timeout and Workers must be positive"},
+		{func(c *Config) { c.Webhooks.Targets = []WebhookTarget{{Bucket: "*", Url: "ftp://example.com"}} },
+			`Webhooks.Targets[0]: "ftp://example.com" is not an http(s) url`},
+		{func(c *Config) { c.Webhooks.Targets = []WebhookTarget{{Url: "http://example.com/hook"}} },
+			`Webhooks.Targets[0]: Bucket must be a bucket name or "*"`},
+	}
+	for _, test := range tests {
+		config := defaultConfig()
+		test.change(config)
+		if err := config.validate(); err == nil || err.Error() != test.err {
+			t.Errorf("expected %q, got %v", test.err, err)
+		}
+	}
+
+	// Some things are only fine together.
+	config := defaultConfig()
+	withTLS(config)
+	config.HttpPort = ""
+	config.TLS.RequireClientCert, config.TLS.ClientCAFile = true, "ca.crt"
+	config.SlowRequestThreshold, config.SlowRequestLogSize = 0, 0
+	config.Logging, config.AccessLog = "stdout", "stdout"
+	config.Backends = map[string]backend.Backend{"fast": {Engine: "memory"}}
+	if err := config.validate(); err != nil {
+		t.Error("a valid config was rejected:", err)
+	}
+}
@@ -0,0 +1,730 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+// These lock in the parts of Riak's HTTP behaviour that clients depend on:
+// which headers come back with an object and which status codes mean what.
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"levelupdb/backend"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -engine memory runs the server tests against the memory engine.
+var engineFlag = flag.String("engine", "leveldb", "the storage engine to test the server with")
+
+// Runs a server on a fresh data directory for the length of the test.
+func newTestServer(t *testing.T) *httptest.Server {
+	globalConfig = defaultConfig()
+	globalConfig.DatabaseLocation = t.TempDir()
+	globalConfig.Engine = *engineFlag
+	// Set once: a job from an earlier test may still be logging its end.
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	openDatabases()
+	webhooks.start()
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		webhooks.stop(context.Background())
+		// Jobs a test started must not outlive it and log into the next.
+		stopMigration(context.Background())
+		stopScrub(context.Background())
+		stopReindex(context.Background())
+		closeDatabases()
+	})
+	return server
+}
+
+// Closes and opens the databases under a running test server, as a
+// restart of the server would.
+func restartDatabases() {
+	webhooks.stop(context.Background())
+	closeDatabases()
+	openDatabases()
+	webhooks.start()
+}
+
+func do(t *testing.T, method, url string, body string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func expectStatus(t *testing.T, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d", resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode)
+	}
+}
+
+func expectHeader(t *testing.T, headers http.Header, name, value string) {
+	t.Helper()
+	if got := headers.Get(name); got != value {
+		t.Fatalf("expected %s: %q, got %q", name, value, got)
+	}
+}
+
+// The headers every object representation carries, whatever the request.
+func expectObjectHeaders(t *testing.T, headers http.Header, bucket string) {
+	t.Helper()
+	if headers.Get("X-Riak-Vclock") == "" {
+		t.Fatal("expected an X-Riak-Vclock header")
+	}
+	if !strings.Contains(headers.Get("Link"), "</buckets/"+bucket+">; rel=\"up\"") {
+		t.Fatalf("expected an up link to %s, got %q", bucket, headers.Get("Link"))
+	}
+	modified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("bad Last-Modified %q: %s", headers.Get("Last-Modified"), err)
+	}
+	if since := time.Since(modified); since < -time.Second || since > time.Minute {
+		t.Fatalf("Last-Modified %s is not recent", modified)
+	}
+	if etag := headers.Get("ETag"); len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("expected a quoted ETag, got %q", etag)
+	}
+	if headers.Get("X-Riak-Deleted") != "" {
+		t.Fatal("did not expect X-Riak-Deleted")
+	}
+}
+
+func TestFetchObjectHeaders(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	resp, _ := do(t, "PUT", url, "hello", map[string]string{
+		"Content-Type":         "text/plain",
+		"X-Riak-Meta-Color":    "purple",
+		"X-Riak-Index-Age_int": "42",
+		"Link":                 "</buckets/b/keys/other>; riaktag=\"friend\"",
+	})
+	expectStatus(t, resp, 204)
+
+	resp, body := do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 200)
+	if body != "hello" {
+		t.Fatalf("expected body hello, got %q", body)
+	}
+	expectObjectHeaders(t, resp.Header, "b")
+	expectHeader(t, resp.Header, "Content-Type", "text/plain")
+	expectHeader(t, resp.Header, "Content-Length", "5")
+	expectHeader(t, resp.Header, "Vary", "Accept-Encoding")
+	expectHeader(t, resp.Header, "X-Riak-Meta-Color", "purple")
+	expectHeader(t, resp.Header, "X-Riak-Index-Age_int", "42")
+	if !strings.Contains(resp.Header.Get("Link"), "</buckets/b/keys/other>; riaktag=\"friend\"") {
+		t.Fatalf("expected the stored link, got %q", resp.Header.Get("Link"))
+	}
+	if !strings.HasPrefix(resp.Header.Get("Server"), "levelupdb/") {
+		t.Fatalf("expected a Server header, got %q", resp.Header.Get("Server"))
+	}
+}
+
+func TestFetchObjectWithoutContentType(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	resp, _ := do(t, "PUT", url, "<html>", nil)
+	expectStatus(t, resp, 204)
+
+	resp, _ = do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 200)
+	if _, ok := resp.Header["Content-Type"]; ok {
+		t.Fatalf("expected no Content-Type, got %q", resp.Header.Get("Content-Type"))
+	}
+	expectHeader(t, resp.Header, "Content-Length", "6")
+}
+
+func TestFetchMissingObject(t *testing.T) {
+	server := newTestServer(t)
+
+	resp, body := do(t, "GET", server.URL+"/buckets/b/keys/missing", "", nil)
+	expectStatus(t, resp, 404)
+	if body != "not found\n" {
+		t.Fatalf("expected body \"not found\\n\", got %q", body)
+	}
+	expectHeader(t, resp.Header, "Content-Type", "text/plain")
+	if resp.Header.Get("X-Riak-Vclock") != "" {
+		t.Fatal("did not expect an X-Riak-Vclock on a missing object")
+	}
+}
+
+func TestStoreObjectStatusCodes(t *testing.T) {
+	server := newTestServer(t)
+	text := map[string]string{"Content-Type": "text/plain"}
+
+	resp, body := do(t, "PUT", server.URL+"/buckets/b/keys/k", "one", text)
+	expectStatus(t, resp, 204)
+	if body != "" {
+		t.Fatalf("expected no body, got %q", body)
+	}
+
+	// A key is made up and returned in Location.
+	resp, _ = do(t, "POST", server.URL+"/buckets/b/keys", "two", text)
+	expectStatus(t, resp, 201)
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/buckets/b/keys/") || len(location) == len("/buckets/b/keys/") {
+		t.Fatalf("expected a Location for the new key, got %q", location)
+	}
+	resp, body = do(t, "GET", server.URL+location, "", nil)
+	expectStatus(t, resp, 200)
+	if body != "two" {
+		t.Fatalf("expected body two at %s, got %q", location, body)
+	}
+
+	resp, body = do(t, "PUT", server.URL+"/buckets/b/keys/k?returnbody=true", "three", text)
+	expectStatus(t, resp, 200)
+	if body != "three" {
+		t.Fatalf("expected body three, got %q", body)
+	}
+	expectObjectHeaders(t, resp.Header, "b")
+	expectHeader(t, resp.Header, "Content-Type", "text/plain")
+	expectHeader(t, resp.Header, "Content-Length", "5")
+
+	resp, body = do(t, "POST", server.URL+"/buckets/b/keys?returnbody=true", "four", text)
+	expectStatus(t, resp, 201)
+	if body != "four" {
+		t.Fatalf("expected body four, got %q", body)
+	}
+	if resp.Header.Get("Location") == "" {
+		t.Fatal("expected a Location")
+	}
+	expectObjectHeaders(t, resp.Header, "b")
+	expectHeader(t, resp.Header, "Content-Length", "4")
+
+	resp, body = do(t, "PUT", server.URL+"/buckets/b/keys/k?dw=3", "five", text)
+	expectStatus(t, resp, 400)
+	if body == "" {
+		t.Fatal("expected the 400 to say what was wrong")
+	}
+
+	resp, _ = do(t, "PATCH", server.URL+"/buckets/b/keys/k", "", nil)
+	expectStatus(t, resp, 405)
+}
+
+func TestDeleteObjectStatusCodes(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	resp, _ := do(t, "PUT", url, "one", nil)
+	expectStatus(t, resp, 204)
+
+	resp, _ = do(t, "DELETE", url, "", nil)
+	expectStatus(t, resp, 204)
+
+	resp, body := do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 404)
+	if body != "not found\n" {
+		t.Fatalf("expected body \"not found\\n\", got %q", body)
+	}
+	if resp.Header.Get("X-Riak-Deleted") != "" {
+		t.Fatal("did not expect X-Riak-Deleted once the object is gone")
+	}
+
+	resp, _ = do(t, "DELETE", url, "", nil)
+	expectStatus(t, resp, 404)
+}
+
+// Reads a multipart/mixed body into its parts, keeping each part's body.
+func readParts(t *testing.T, contentType string, body io.Reader) (headers []http.Header, bodies []string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %q", contentType)
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, http.Header(part.Header))
+		bodies = append(bodies, string(data))
+	}
+}
+
+func TestLinkWalkPartHeaders(t *testing.T) {
+	server := newTestServer(t)
+
+	resp, _ := do(t, "PUT", server.URL+"/buckets/people/keys/alice", "alice", map[string]string{
+		"Link": "</buckets/pets/keys/rex>; riaktag=\"owns\"",
+	})
+	expectStatus(t, resp, 204)
+	resp, _ = do(t, "PUT", server.URL+"/buckets/pets/keys/rex", "woof", map[string]string{
+		"Content-Type":      "text/plain",
+		"X-Riak-Meta-Breed": "mutt",
+	})
+	expectStatus(t, resp, 204)
+
+	resp, body := do(t, "GET", server.URL+"/buckets/people/keys/alice/pets,owns,1", "", nil)
+	expectStatus(t, resp, 200)
+
+	phases, phaseBodies := readParts(t, resp.Header.Get("Content-Type"), strings.NewReader(body))
+	if len(phases) != 1 {
+		t.Fatalf("expected one phase, got %d", len(phases))
+	}
+	parts, bodies := readParts(t, phases[0].Get("Content-Type"), strings.NewReader(phaseBodies[0]))
+	if len(parts) != 1 {
+		t.Fatalf("expected one object, got %d", len(parts))
+	}
+	if bodies[0] != "woof" {
+		t.Fatalf("expected body woof, got %q", bodies[0])
+	}
+	expectObjectHeaders(t, parts[0], "pets")
+	expectHeader(t, parts[0], "Location", "/buckets/pets/keys/rex")
+	expectHeader(t, parts[0], "Content-Type", "text/plain")
+	expectHeader(t, parts[0], "X-Riak-Meta-Breed", "mutt")
+
+	resp, _ = do(t, "GET", server.URL+"/buckets/people/keys/nobody/pets,owns,1", "", nil)
+	expectStatus(t, resp, 404)
+
+	resp, _ = do(t, "GET", server.URL+"/buckets/people/keys/alice/pets,owns", "", nil)
+	expectStatus(t, resp, 400)
+}
+
+func TestLinkWalkLargeObject(t *testing.T) {
+	server := newTestServer(t)
+	globalConfig.LargeObjectThreshold = 100
+	globalConfig.ChunkSize = 30
+
+	value := strings.Repeat("abcdefghij", 25)
+	resp, _ := do(t, "PUT", server.URL+"/buckets/pets/keys/rex", value, nil)
+	expectStatus(t, resp, 204)
+	resp, _ = do(t, "PUT", server.URL+"/buckets/people/keys/alice", "alice", map[string]string{
+		"Link": "</buckets/pets/keys/rex>; riaktag=\"owns\"",
+	})
+	expectStatus(t, resp, 204)
+
+	url := server.URL + "/buckets/people/keys/alice/pets,owns,1"
+	resp, body := do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 200)
+	phases, phaseBodies := readParts(t, resp.Header.Get("Content-Type"), strings.NewReader(body))
+	_, bodies := readParts(t, phases[0].Get("Content-Type"), strings.NewReader(phaseBodies[0]))
+	if len(bodies) != 1 || bodies[0] != value {
+		t.Fatalf("expected the whole large object, got %q", bodies)
+	}
+
+	// A part that cannot be read whole is not sent as if it were.
+	meta, _, err := database.GetObject("pets", "rex")
+	if err != nil || meta.Manifest == nil {
+		t.Fatal("expected a large object:", meta, err)
+	}
+	chunkDatabase.GetBucketNoCreate("pets").Put(backend.ChunkKey(meta.Manifest.Id, 1), []byte(strings.Repeat("x", 30)), false)
+	resp, _ = do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 500)
+}
+
+func TestLastModifiedChangesOnWrite(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	do(t, "PUT", url, "one", nil)
+	resp, _ := do(t, "GET", url, "", nil)
+	first := resp.Header.Get("ETag")
+
+	do(t, "PUT", url, "two", nil)
+	resp, _ = do(t, "GET", url, "", nil)
+	if resp.Header.Get("ETag") == first {
+		t.Fatalf("expected a new ETag after a write, still %s", first)
+	}
+	if _, err := strconv.Unquote(resp.Header.Get("ETag")); err != nil {
+		t.Fatalf("ETag %s is not quoted: %s", resp.Header.Get("ETag"), err)
+	}
+}
+
+func TestHeadObject(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	do(t, "PUT", url, "hello world", map[string]string{"Content-Type": "text/plain"})
+
+	resp, body := do(t, "HEAD", url, "", nil)
+	expectStatus(t, resp, 200)
+	if body != "" {
+		t.Fatalf("expected no body, got %q", body)
+	}
+	expectObjectHeaders(t, resp.Header, "b")
+	expectHeader(t, resp.Header, "Content-Type", "text/plain")
+	expectHeader(t, resp.Header, "Content-Length", "11")
+
+	resp, _ = do(t, "HEAD", server.URL+"/buckets/b/keys/missing", "", nil)
+	expectStatus(t, resp, 404)
+}
+
+func TestRangeRequests(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/buckets/b/keys/k"
+
+	do(t, "PUT", url, "0123456789", map[string]string{"Content-Type": "application/pdf"})
+	resp, _ := do(t, "GET", url, "", nil)
+	expectHeader(t, resp.Header, "Accept-Ranges", "bytes")
+	etag := resp.Header.Get("ETag")
+
+	resp, body := do(t, "GET", url, "", map[string]string{"Range": "bytes=2-5"})
+	expectStatus(t, resp, 206)
+	if body != "2345" {
+		t.Fatalf("expected body 2345, got %q", body)
+	}
+	expectHeader(t, resp.Header, "Content-Range", "bytes 2-5/10")
+	expectHeader(t, resp.Header, "Content-Length", "4")
+	expectHeader(t, resp.Header, "Content-Type", "application/pdf")
+
+	resp, body = do(t, "GET", url, "", map[string]string{"Range": "bytes=-3"})
+	expectStatus(t, resp, 206)
+	if body != "789" {
+		t.Fatalf("expected body 789, got %q", body)
+	}
+
+	resp, body = do(t, "GET", url, "", map[string]string{"Range": "bytes=4-", "If-Range": etag})
+	expectStatus(t, resp, 206)
+	if body != "456789" {
+		t.Fatalf("expected body 456789, got %q", body)
+	}
+
+	// Once the object changed the whole new value comes back.
+	do(t, "PUT", url, "abcdefghij", map[string]string{"Content-Type": "application/pdf"})
+	resp, body = do(t, "GET", url, "", map[string]string{"Range": "bytes=4-", "If-Range": etag})
+	expectStatus(t, resp, 200)
+	if body != "abcdefghij" {
+		t.Fatalf("expected the whole object, got %q", body)
+	}
+
+	resp, _ = do(t, "GET", url, "", map[string]string{"Range": "bytes=20-30"})
+	expectStatus(t, resp, 416)
+	expectHeader(t, resp.Header, "Content-Range", "bytes */10")
+}
+
+func TestLargeObject(t *testing.T) {
+	server := newTestServer(t)
+	globalConfig.LargeObjectThreshold = 100
+	globalConfig.ChunkSize = 30
+	url := server.URL + "/buckets/b/keys/big"
+
+	value := strings.Repeat("abcdefghij", 25)
+	resp, body := do(t, "PUT", url+"?returnbody=true", value, map[string]string{
+		"Content-Type":          "video/mp4",
+		"X-Riak-Index-Kind_bin": "video",
+	})
+	expectStatus(t, resp, 200)
+	if body != value {
+		t.Fatalf("expected the value back, got %d bytes", len(body))
+	}
+	expectHeader(t, resp.Header, "Content-Length", "250")
+
+	resp, body = do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 200)
+	if body != value {
+		t.Fatalf("expected the value, got %d bytes", len(body))
+	}
+	expectObjectHeaders(t, resp.Header, "b")
+	expectHeader(t, resp.Header, "Content-Type", "video/mp4")
+	expectHeader(t, resp.Header, "Content-Length", "250")
+
+	resp, body = do(t, "GET", url, "", map[string]string{"Range": "bytes=25-34"})
+	expectStatus(t, resp, 206)
+	if body != "fghijabcde" {
+		t.Fatalf("expected fghijabcde, got %q", body)
+	}
+
+	resp, body = do(t, "GET", server.URL+"/buckets/b/index/kind_bin/video", "", nil)
+	expectStatus(t, resp, 200)
+	if body != `{"keys":["big"]}` {
+		t.Fatalf("expected the large object in the index, got %s", body)
+	}
+
+	resp, _ = do(t, "DELETE", url, "", nil)
+	expectStatus(t, resp, 204)
+	resp, _ = do(t, "GET", url, "", nil)
+	expectStatus(t, resp, 404)
+}
+
+func TestCompressedBucket(t *testing.T) {
+	server := newTestServer(t)
+	value := strings.Repeat(`{"name":"levelupdb","purple":true},`, 100)
+
+	for _, codec := range []string{"gzip", "deflate", "snappy"} {
+		resp, _ := do(t, "PUT", server.URL+"/buckets/"+codec+"/props", `{"props":{"compression":"`+codec+`"}}`, nil)
+		expectStatus(t, resp, 204)
+		url := server.URL + "/buckets/" + codec + "/keys/k"
+		resp, _ = do(t, "PUT", url, value, map[string]string{"Content-Type": "application/json"})
+		expectStatus(t, resp, 204)
+
+		resp, body := do(t, "GET", url, "", map[string]string{"Accept-Encoding": "identity"})
+		expectStatus(t, resp, 200)
+		if body != value {
+			t.Fatalf("%s: expected the value back, got %d bytes", codec, len(body))
+		}
+		expectHeader(t, resp.Header, "Content-Encoding", "")
+		expectHeader(t, resp.Header, "Content-Length", strconv.Itoa(len(value)))
+	}
+
+	// gzip goes out as it is stored.
+	resp, body := do(t, "GET", server.URL+"/buckets/gzip/keys/k", "", map[string]string{"Accept-Encoding": "gzip"})
+	expectStatus(t, resp, 200)
+	expectHeader(t, resp.Header, "Content-Encoding", "gzip")
+	if len(body) >= len(value) {
+		t.Fatalf("expected a compressed body, got %d bytes", len(body))
+	}
+	reader, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := ioutil.ReadAll(reader); err != nil || string(plain) != value {
+		t.Fatalf("expected the gzip'd value, got %d bytes: %v", len(plain), err)
+	}
+	if etag := resp.Header.Get("ETag"); !strings.HasSuffix(etag, `-gzip"`) {
+		t.Fatalf("expected a gzip ETag, got %s", etag)
+	}
+
+	resp, _ = do(t, "GET", server.URL+"/buckets/gzip/keys/k", "", map[string]string{"Accept-Encoding": "gzip;q=0"})
+	expectHeader(t, resp.Header, "Content-Encoding", "")
+
+	resp, body = do(t, "GET", server.URL+"/stats", "", nil)
+	var stats struct {
+		Compression map[string]struct {
+			Ratio float64 `json:"ratio"`
+		} `json:"compression"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compression["gzip"].Ratio <= 1 {
+		t.Fatalf("expected a compression ratio for gzip, got %v", stats.Compression)
+	}
+
+	// Large values are compressed a chunk at a time, and still read back
+	// in any range.
+	globalConfig.LargeObjectThreshold = 1000
+	globalConfig.ChunkSize = 1024
+	large := strings.Repeat(value, 3)
+	resp, _ = do(t, "PUT", server.URL+"/buckets/chunked/props", `{"props":{"compression":"snappy"}}`, nil)
+	expectStatus(t, resp, 204)
+	url := server.URL + "/buckets/chunked/keys/k"
+	resp, _ = do(t, "PUT", url, large, nil)
+	expectStatus(t, resp, 204)
+	meta, _, err := database.GetObject("chunked", "k")
+	if err != nil || meta.Manifest == nil || meta.Manifest.Codec != "snappy" || meta.Codec != "" {
+		t.Fatalf("expected snappy chunks, got %+v: %v", meta, err)
+	}
+	chunk, _ := chunkDatabase.GetBucketNoCreate("chunked").Get(backend.ChunkKey(meta.Manifest.Id, 0))
+	if len(chunk) >= globalConfig.ChunkSize {
+		t.Fatalf("expected a compressed chunk, got %d bytes", len(chunk))
+	}
+	resp, body = do(t, "GET", url, "", map[string]string{"Accept-Encoding": "gzip"})
+	expectStatus(t, resp, 200)
+	expectHeader(t, resp.Header, "Content-Encoding", "")
+	if body != large {
+		t.Fatalf("expected the large value back, got %d bytes", len(body))
+	}
+	resp, body = do(t, "GET", url, "", map[string]string{"Range": "bytes=2000-2099"})
+	expectStatus(t, resp, 206)
+	if body != large[2000:2100] {
+		t.Fatalf("expected bytes 2000-2099, got %q", body)
+	}
+	resp, body = do(t, "GET", server.URL+"/stats", "", nil)
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compression["chunked"].Ratio <= 1 {
+		t.Fatalf("expected a compression ratio for the chunks, got %v", stats.Compression)
+	}
+
+	resp, _ = do(t, "PUT", server.URL+"/buckets/b/props", `{"props":{"compression":"zip"}}`, nil)
+	expectStatus(t, resp, 400)
+}
+
+func TestBitcaskBucket(t *testing.T) {
+	server := newTestServer(t)
+	resp, _ := do(t, "PUT", server.URL+"/buckets/hot/props", `{"props":{"backend":"bitcask"}}`, nil)
+	expectStatus(t, resp, 204)
+	for _, key := range []string{"c", "a", "b"} {
+		resp, _ = do(t, "PUT", server.URL+"/buckets/hot/keys/"+key, key, map[string]string{"X-Riak-Index-Letter_bin": key})
+		expectStatus(t, resp, 204)
+	}
+	resp, _ = do(t, "DELETE", server.URL+"/buckets/hot/keys/c", "", nil)
+	expectStatus(t, resp, 204)
+
+	// Comes back from its own files after a restart.
+	restartDatabases()
+	if _, err := os.Stat(path.Join(globalConfig.DatabaseLocation, "hot", "000000000.bitcask.data")); err != nil {
+		t.Fatal("expected the bucket in bitcask files:", err)
+	}
+	resp, body := do(t, "GET", server.URL+"/buckets/hot/keys/a", "", nil)
+	expectStatus(t, resp, 200)
+	if body != "a" {
+		t.Fatalf("expected a, got %s", body)
+	}
+	resp, _ = do(t, "GET", server.URL+"/buckets/hot/keys/c", "", nil)
+	expectStatus(t, resp, 404)
+	resp, body = do(t, "GET", server.URL+"/buckets/hot/index/$key/a/z", "", nil)
+	expectStatus(t, resp, 200)
+	if body != `{"keys":["a","b"]}` {
+		t.Fatalf("expected a $key range over the keydir, got %s", body)
+	}
+	resp, body = do(t, "GET", server.URL+"/buckets/hot/index/letter_bin/b", "", nil)
+	if body != `{"keys":["b"]}` {
+		t.Fatalf("expected the index to work, got %s", body)
+	}
+
+	resp, _ = do(t, "PUT", server.URL+"/buckets/hot/props", `{"props":{"backend":"leveldb"}}`, nil)
+	expectStatus(t, resp, 409)
+	resp, _ = do(t, "PUT", server.URL+"/buckets/hot/props", `{"props":{"backend":"hash"}}`, nil)
+	expectStatus(t, resp, 400)
+}
+
+func TestMultiBackend(t *testing.T) {
+	server := newTestServer(t)
+	globalConfig.Backends = map[string]backend.Backend{
+		"cache":   {Engine: "memory"},
+		"durable": {Engine: "leveldb", LevelDB: backend.LevelDBOptions{BlockCacheSize: 1 << 20}},
+	}
+	restartDatabases()
+
+	for bucket, name := range map[string]string{"sessions": "cache", "orders": "durable", "logs": "bitcask"} {
+		resp, _ := do(t, "PUT", server.URL+"/buckets/"+bucket+"/props", `{"props":{"backend":"`+name+`"}}`, nil)
+		expectStatus(t, resp, 204)
+	}
+	for _, bucket := range []string{"sessions", "orders", "logs", "plain"} {
+		resp, _ := do(t, "PUT", server.URL+"/buckets/"+bucket+"/keys/k", bucket, map[string]string{"X-Riak-Index-Kind_bin": "x"})
+		expectStatus(t, resp, 204)
+	}
+	resp, _ := do(t, "PUT", server.URL+"/buckets/plain/props", `{"props":{"backend":"nope"}}`, nil)
+	expectStatus(t, resp, 400)
+
+	resp, body := do(t, "GET", server.URL+"/buckets?buckets=true", "", nil)
+	expectStatus(t, resp, 200)
+	if body != `{"buckets":["logs","orders","plain","sessions"]}` {
+		t.Fatalf("expected the buckets of every backend, got %s", body)
+	}
+	for _, bucket := range []string{"sessions", "orders", "logs", "plain"} {
+		resp, body = do(t, "GET", server.URL+"/buckets/"+bucket+"/index/kind_bin/x", "", nil)
+		if body != `{"keys":["k"]}` {
+			t.Fatalf("%s: expected the index to find k, got %s", bucket, body)
+		}
+	}
+
+	resp, body = do(t, "GET", server.URL+"/stats", "", nil)
+	var stats struct {
+		StorageBackend string                          `json:"storage_backend"`
+		Backends       map[string]backend.BackendUsage `json:"backends"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.StorageBackend != "riak_kv_multi_backend" {
+		t.Fatalf("expected a multi backend, got %s", stats.StorageBackend)
+	}
+	// plain counts for the engine it is kept in.
+	expected := map[string]int{"cache": 1, "durable": 1, "bitcask": 1}
+	expected[*engineFlag]++
+	for name, buckets := range expected {
+		if stats.Backends[name].Buckets != buckets || stats.Backends[name].Size == 0 {
+			t.Fatalf("expected %d buckets with a size in %s, got %+v", buckets, name, stats.Backends)
+		}
+	}
+
+	// The cache goes with its indexes; the others stay.
+	restartDatabases()
+	resp, _ = do(t, "GET", server.URL+"/buckets/sessions/keys/k", "", nil)
+	expectStatus(t, resp, 404)
+	resp, body = do(t, "GET", server.URL+"/buckets/sessions/index/kind_bin/x", "", nil)
+	if strings.Contains(body, `"k"`) {
+		t.Fatalf("expected the cache's index to be gone with it, got %s", body)
+	}
+	kept := []string{"orders", "logs", "plain"}
+	if *engineFlag == "memory" {
+		kept = kept[:2] // But they stay even when the rest are in memory.
+	}
+	for _, bucket := range kept {
+		resp, body = do(t, "GET", server.URL+"/buckets/"+bucket+"/keys/k", "", nil)
+		expectStatus(t, resp, 200)
+		if body != bucket {
+			t.Fatalf("expected %s back, got %s", bucket, body)
+		}
+	}
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	newTestServer(t)
+
+	// Not due for a long time, so the dispatcher leaves it alone.
+	later := time.Now().Add(time.Hour).UnixNano()
+	pending := &backend.QueueEntry{Lane: "a", Target: "http://127.0.0.1:1/", NextAttempt: later}
+	dead := &backend.QueueEntry{Lane: "b", Target: "http://127.0.0.1:1/", NextAttempt: later}
+	for _, entry := range []*backend.QueueEntry{pending, dead} {
+		if err := queue.Push(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := queue.Bury(dead); !ok || err != nil {
+		t.Fatal("bury failed:", err)
+	}
+
+	// Even with the buckets in memory.
+	restartDatabases()
+	if entry, err := queue.Pending(pending.Id); err != nil || entry == nil {
+		t.Fatal("the pending event was lost:", err)
+	}
+	var found bool
+	queue.ForEachDead(func(entry *backend.QueueEntry) bool {
+		found = found || entry.Id == dead.Id
+		return true
+	})
+	if !found {
+		t.Fatal("the dead event was lost")
+	}
+}
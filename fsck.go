@@ -0,0 +1,103 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"levelupdb/backend"
+	"os"
+)
+
+// What fsck prints.
+type fsckReport struct {
+	Buckets  int               `json:"buckets"`
+	Scanned  int               `json:"scanned"`
+	Problems []backend.Problem `json:"problems"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Checks buckets, or all of them when there are none.
+func fsckAll(ctx context.Context, buckets []string, fix bool) (*fsckReport, error) {
+	report := &fsckReport{Problems: []backend.Problem{}}
+	if len(buckets) == 0 {
+		var err error
+		if buckets, err = database.GetAllBucketNames(); err != nil {
+			return report, err
+		}
+	}
+	for _, bucket := range buckets {
+		scanned, err := database.CheckBucket(ctx, bucket, fix, func(problem backend.Problem) {
+			report.Problems = append(report.Problems, problem)
+		})
+		report.Scanned += scanned
+		if err != nil {
+			return report, fmt.Errorf("bucket %s: %s", bucket, err)
+		}
+		report.Buckets++
+	}
+	return report, nil
+}
+
+const fsckUsage = `usage: levelupdb fsck [-fix] [flags] [bucket ...]
+
+Checks that the secondary indexes list exactly the objects stored with them,
+that links point to objects that exist and that no chunks are left over from
+large objects that are gone, in the given buckets or all of them. Prints a
+JSON report of the problems found. With -fix the indexes are rewritten to
+match the objects and left over chunks are deleted; dangling links are only
+reported. The server must be stopped. Exits with 1 if problems remain.
+`
+
+func fsckCommand(args []string) int {
+	flags := newConfigFlags("fsck")
+	fix := flags.set.Bool("fix", false, "repair the indexes and delete left over chunks")
+	flags.set.Usage = func() {
+		fmt.Fprint(os.Stderr, fsckUsage+"\nflags:\n")
+		flags.set.PrintDefaults()
+	}
+	if err := flags.set.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if globalConfig, err = initializeConfig(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+	mainLogger = initializeLogger()
+	openDatabases()
+	defer closeDatabases()
+
+	report, err := fsckAll(context.Background(), flags.set.Args(), *fix)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+
+	if err != nil {
+		return 1
+	}
+	for _, problem := range report.Problems {
+		if !problem.Fixed {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,346 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]int{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+
+// Log lines say how serious they are with their first word, e.g.
+// "ERROR: ...". Anything untagged, like the request lines, is info.
+func messageLevel(message []byte) int {
+	switch {
+	case bytes.HasPrefix(message, []byte("DEBUG:")):
+		return levelDebug
+	case bytes.HasPrefix(message, []byte("WARNING:")), bytes.HasPrefix(message, []byte("DENIED:")):
+		return levelWarn
+	case bytes.HasPrefix(message, []byte("ERROR:")), bytes.HasPrefix(message, []byte("Error:")):
+		return levelError
+	}
+	return levelInfo
+}
+
+// Drops messages below the configured level and stamps the rest. The
+// logger writing into it has no prefix or flags of its own, and log.Logger
+// always hands over one whole message per Write.
+type levelWriter struct {
+	out   io.Writer
+	level int
+}
+
+func (w *levelWriter) Write(message []byte) (int, error) {
+	if messageLevel(message) < w.level {
+		return len(message), nil
+	}
+	stamp := time.Now().Format("2006/01/02 15:04:05")
+	line := make([]byte, 0, len(message)+48)
+	line = append(line, "[levelupdb "+VERSION+"] "+stamp+" "...)
+	line = append(line, message...)
+	if _, err := w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(message), nil
+}
+
+// A log file that rotates itself once it gets too big or too old, and can
+// be reopened after something else (logrotate) moved it away.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64         // 0 means no size limit.
+	maxAge     time.Duration // 0 means no age limit.
+	maxBackups int           // 0 keeps every rotated file.
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func openRotatingFile(path string, maxSizeMB, maxAgeHours, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1048576,
+		maxAge:     time.Duration(maxAgeHours) * time.Hour,
+		maxBackups: maxBackups,
+	}
+	return f, f.open()
+}
+
+// Must be called with the lock held, or before the file is shared.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if (f.maxSize > 0 && f.size+int64(len(data)) > f.maxSize && f.size > 0) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			// Better to keep logging into the old file than to lose lines.
+			fmt.Fprintln(os.Stderr, "levelupdb: rotating", f.path, "failed:", err)
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotated files are named after the time they were rotated, with a sequence
+// number after it for any further rotations within the same second.
+const backupTimeFormat = "20060102-150405"
+
+var backupSuffix = regexp.MustCompile(`^\.(\d{8}-\d{6})(?:\.(\d+))?$`)
+
+// Must be called with the lock held.
+func (f *rotatingFile) rotate() error {
+	stamp := f.path + "." + time.Now().Format(backupTimeFormat)
+	rotated := stamp
+	for seq := 1; ; seq++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		rotated = stamp + "." + strconv.Itoa(seq)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.removeOldBackups()
+	return nil
+}
+
+type backup struct {
+	name  string
+	stamp string
+	seq   int
+}
+
+// The files rotate made out of this one, oldest first. Other files that
+// merely start with the same name, like levelupdb.log.json, are not.
+func (f *rotatingFile) backups() ([]backup, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(f.path)
+	var backups []backup
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), base) {
+			continue
+		}
+		match := backupSuffix.FindStringSubmatch(file.Name()[len(base):])
+		if match == nil {
+			continue
+		}
+		seq, _ := strconv.Atoi(match[2])
+		backups = append(backups, backup{filepath.Join(filepath.Dir(f.path), file.Name()), match[1], seq})
+	}
+	// The timestamps sort chronologically as they are.
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].stamp != backups[j].stamp {
+			return backups[i].stamp < backups[j].stamp
+		}
+		return backups[i].seq < backups[j].seq
+	})
+	return backups, nil
+}
+
+// Must be called with the lock held.
+func (f *rotatingFile) removeOldBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return
+	}
+	for len(backups) > f.maxBackups {
+		os.Remove(backups[0].name)
+		backups = backups[1:]
+	}
+}
+
+// Reopens the file by name, which picks up a new file after an external
+// tool rotated the old one away.
+func (f *rotatingFile) Reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Every file the logs go to, so SIGHUP can reopen them all.
+var logFiles []*rotatingFile
+
+// Opens "stdout", "none" or a file path.
+func openLogDestination(destination string) (io.Writer, error) {
+	switch destination {
+	case "stdout":
+		return os.Stdout, nil
+	case "none":
+		return ioutil.Discard, nil
+	}
+	f, err := openRotatingFile(destination, globalConfig.LogMaxSize, globalConfig.LogMaxAge, globalConfig.LogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	logFiles = append(logFiles, f)
+	return f, nil
+}
+
+func initializeLogger() *log.Logger {
+	writer, err := openLogDestination(globalConfig.Logging)
+	if err != nil {
+		panic(fmt.Sprintln("Log file error: ", err))
+	}
+	return log.New(&levelWriter{out: writer, level: levelNames[globalConfig.LogLevel]}, "", 0)
+}
+
+var accessLog io.Writer
+
+func initializeAccessLog() {
+	if globalConfig.AccessLog == "" {
+		return
+	}
+	var err error
+	if accessLog, err = openLogDestination(globalConfig.AccessLog); err != nil {
+		panic(fmt.Sprintln("Access log file error: ", err))
+	}
+}
+
+// Reopens every log file on SIGHUP.
+func watchLogFiles() {
+	if len(logFiles) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		for _, f := range logFiles {
+			if err := f.Reopen(); err != nil {
+				fmt.Fprintln(os.Stderr, "levelupdb: reopening", f.path, "failed:", err)
+			}
+		}
+		mainLogger.Println("NOTICE: Reopened log files")
+	}
+}
+
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestId  string  `json:"request_id"`
+	Remote     string  `json:"remote"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Bucket     string  `json:"bucket,omitempty"`
+	Key        string  `json:"key,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// One JSON object per line.
+func logAccess(req *http.Request, requestId string, status, size int, duration time.Duration) {
+	if accessLog == nil {
+		return
+	}
+	entry := accessLogEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		RequestId:  requestId,
+		Remote:     req.RemoteAddr,
+		User:       requestUser(req),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Status:     status,
+		Bytes:      size,
+		DurationMs: float64(duration) / float64(time.Millisecond),
+	}
+	if strings.HasPrefix(entry.Path, "/buckets/") {
+		splitted := strings.Split(entry.Path[lenPath:], "/")
+		entry.Bucket = splitted[0]
+		if len(splitted) >= 3 && splitted[1] == "keys" {
+			entry.Key = splitted[2]
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	accessLog.Write(append(data, '\n'))
+}
+
+// Uses the client's X-Request-Id if it sent one so requests can be traced
+// through proxies, otherwise makes one up.
+func requestId(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
@@ -0,0 +1,195 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	messages := []string{
+		"DEBUG: cache miss",
+		"NOTICE: Server started",
+		"GET /buckets/b/keys/k 200",
+		"WARNING: slow disk",
+		"DENIED: 403 alice",
+		"ERROR: write failed",
+		"Error: Error reading request body",
+	}
+	tests := []struct {
+		level string
+		kept  int // The last kept messages.
+	}{
+		{"debug", 7},
+		{"info", 6},
+		{"warn", 4},
+		{"error", 2},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		logger := log.New(&levelWriter{out: &out, level: levelNames[test.level]}, "", 0)
+		for _, message := range messages {
+			logger.Println(message)
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if len(lines) != test.kept {
+			t.Errorf("%s: expected %d lines, got %q", test.level, test.kept, out.String())
+			continue
+		}
+		for i, line := range lines {
+			expected := messages[len(messages)-test.kept+i]
+			if !strings.HasPrefix(line, "[levelupdb "+VERSION+"] ") || !strings.HasSuffix(line, " "+expected) {
+				t.Errorf("%s: expected a stamped %q, got %q", test.level, expected, line)
+			}
+		}
+	}
+}
+
+// Reads every file in dir into one map from name to contents.
+func readLogDir(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[file.Name()] = string(data)
+	}
+	return contents
+}
+
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "levelupdb.log")
+	if err := ioutil.WriteFile(path+".json", []byte("not a backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".20120101-000000", []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	f.maxSize = 10
+
+	// Every line fills a file, so each one after the first rotates, all
+	// within the same second or two.
+	lines := []string{"line 0000\n", "line 0001\n", "line 0002\n", "line 0003\n", "line 0004\n"}
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents := readLogDir(t, dir)
+	if contents["levelupdb.log"] != lines[4] {
+		t.Errorf("the log holds %q, expected the last line", contents["levelupdb.log"])
+	}
+	if contents["levelupdb.log.json"] != "not a backup" {
+		t.Error("an unrelated file was touched")
+	}
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 5 {
+		t.Fatalf("expected 5 backups, got %v", backups)
+	}
+	// Nothing was overwritten, and the backups sort the way they were
+	// written.
+	if data, _ := ioutil.ReadFile(backups[0].name); string(data) != "old\n" {
+		t.Errorf("the oldest backup holds %q", data)
+	}
+	for i, backup := range backups[1:] {
+		if data, _ := ioutil.ReadFile(backup.name); string(data) != lines[i] {
+			t.Errorf("backup %s holds %q, expected %q", backup.name, data, lines[i])
+		}
+	}
+
+	// Pruning keeps the newest and leaves other files alone.
+	f.maxBackups = 2
+	if _, err := f.Write([]byte(lines[0])); err != nil {
+		t.Fatal(err)
+	}
+	contents = readLogDir(t, dir)
+	if len(contents) != 4 || contents["levelupdb.log.json"] != "not a backup" {
+		t.Fatalf("after pruning: %v", contents)
+	}
+	if backups, _ = f.backups(); len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	for i, backup := range backups {
+		if data, _ := ioutil.ReadFile(backup.name); string(data) != lines[3+i] {
+			t.Errorf("kept backup %s holds %q, expected %q", backup.name, data, lines[3+i])
+		}
+	}
+}
+
+func TestLogRotationByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "levelupdb.log")
+	f, err := openRotatingFile(path, 0, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	f.opened = f.opened.Add(-2 * time.Hour)
+	f.Write([]byte("third\n"))
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v", backups)
+	}
+	if data, _ := ioutil.ReadFile(backups[0].name); string(data) != "first\nsecond\n" {
+		t.Errorf("the backup holds %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "third\n" {
+		t.Errorf("the log holds %q", data)
+	}
+
+	// Reopening picks up a file that was moved away.
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fourth\n"))
+	if data, _ := ioutil.ReadFile(path); string(data) != "fourth\n" {
+		t.Errorf("after reopening the log holds %q", data)
+	}
+}
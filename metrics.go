@@ -0,0 +1,263 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"levelupdb/backend"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds, the Prometheus client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+type latencyHistogram struct {
+	counts []uint64 // One per latencyBuckets entry, not cumulative.
+	sum    float64
+	count  uint64
+}
+
+type requestMetrics struct {
+	lock      sync.Mutex
+	latencies map[requestKey]*latencyHistogram
+}
+
+var httpMetrics = &requestMetrics{latencies: make(map[requestKey]*latencyHistogram)}
+
+func (m *requestMetrics) observe(handler string, code int, duration time.Duration) {
+	seconds := duration.Seconds()
+	key := requestKey{handler, code}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.latencies[key]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[key] = h
+	}
+	h.count++
+	h.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// Names the operation a request performs, for the handler label.
+func requestOperation(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case p == "/ping":
+		return "ping"
+	case p == "/":
+		return "list_resources"
+	case p == "/stats" || p == "/metrics":
+		return p[1:]
+	case p == "/buckets" || p == "/buckets/":
+		return "list_buckets"
+	case strings.HasPrefix(p, "/admin/"):
+		return "admin"
+	case !strings.HasPrefix(p, "/buckets/"):
+		return "other"
+	}
+
+	splitted := strings.Split(p[lenPath:], "/")
+	switch {
+	case len(splitted) == 2 && splitted[1] == "props":
+		return "bucket_props"
+	case len(splitted) == 2 && splitted[1] == "keys" && req.Method == "POST":
+		return "store_object"
+	case len(splitted) == 2 && splitted[1] == "keys":
+		if req.URL.Query().Get("keys") == "stream" {
+			return "stream_keys"
+		}
+		return "list_keys"
+	case len(splitted) == 3 && splitted[1] == "keys":
+		switch req.Method {
+		case "GET", "HEAD":
+			return "fetch_object"
+		case "DELETE":
+			return "delete_object"
+		}
+		return "store_object"
+	case len(splitted) >= 4 && splitted[1] == "index":
+		return "index_query"
+	case len(splitted) >= 4 && splitted[1] == "keys":
+		return "link_walk"
+	}
+	return "other"
+}
+
+// Writes the metrics in the Prometheus text exposition format.
+func prometheusMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	writeRequestMetrics(out)
+
+	header(out, "levelupdb_index_postings_added_total", "counter", "Secondary index postings added.")
+	fmt.Fprintf(out, "levelupdb_index_postings_added_total %d\n", atomic.LoadUint64(&backend.IndexAdds))
+	header(out, "levelupdb_index_postings_removed_total", "counter", "Secondary index postings removed.")
+	fmt.Fprintf(out, "levelupdb_index_postings_removed_total %d\n", atomic.LoadUint64(&backend.IndexRemoves))
+	_, queries := nodeMetrics.indexQueries.lastMinute()
+	header(out, "levelupdb_index_queries_total", "counter", "Secondary index queries served.")
+	fmt.Fprintf(out, "levelupdb_index_queries_total %d\n", queries)
+
+	buckets := database.OpenBucketNames()
+	header(out, "levelupdb_bucket_keys_estimate", "gauge", "Estimated number of keys per bucket.")
+	for _, bucket := range buckets {
+		fmt.Fprintf(out, "levelupdb_bucket_keys_estimate{bucket=\"%s\"} %d\n", escapeLabel(bucket), database.EstimateKeyCount(bucket))
+	}
+	header(out, "levelupdb_bucket_size_bytes", "gauge", "Approximate on-disk size per bucket.")
+	for _, bucket := range buckets {
+		fmt.Fprintf(out, "levelupdb_bucket_size_bytes{bucket=\"%s\"} %d\n", escapeLabel(bucket), database.ApproximateSize(bucket))
+	}
+
+	usage := backendUsage()
+	backends := make([]string, 0, len(usage))
+	for name := range usage {
+		backends = append(backends, name)
+	}
+	sort.Strings(backends)
+	header(out, "levelupdb_backend_buckets", "gauge", "Open buckets per backend.")
+	for _, name := range backends {
+		fmt.Fprintf(out, "levelupdb_backend_buckets{backend=\"%s\"} %d\n", escapeLabel(name), usage[name].Buckets)
+	}
+	header(out, "levelupdb_backend_size_bytes", "gauge", "Approximate size of the buckets of each backend, with their indexes and chunks.")
+	for _, name := range backends {
+		fmt.Fprintf(out, "levelupdb_backend_size_bytes{backend=\"%s\"} %d\n", escapeLabel(name), usage[name].Size)
+	}
+
+	compressed, counts := backend.CompressionCounts()
+	header(out, "levelupdb_compression_raw_bytes_total", "counter", "Bytes of values written to compressed buckets.")
+	for _, bucket := range compressed {
+		fmt.Fprintf(out, "levelupdb_compression_raw_bytes_total{bucket=\"%s\"} %d\n", escapeLabel(bucket), counts[bucket].Raw)
+	}
+	header(out, "levelupdb_compression_stored_bytes_total", "counter", "Bytes those values took once compressed.")
+	for _, bucket := range compressed {
+		fmt.Fprintf(out, "levelupdb_compression_stored_bytes_total{bucket=\"%s\"} %d\n", escapeLabel(bucket), counts[bucket].Stored)
+	}
+
+	writeLevelDBMetrics(out)
+}
+
+func writeRequestMetrics(out *bufio.Writer) {
+	httpMetrics.lock.Lock()
+	keys := make([]requestKey, 0, len(httpMetrics.latencies))
+	snapshot := make(map[requestKey]latencyHistogram, len(httpMetrics.latencies))
+	for key, h := range httpMetrics.latencies {
+		keys = append(keys, key)
+		snapshot[key] = latencyHistogram{append([]uint64{}, h.counts...), h.sum, h.count}
+	}
+	httpMetrics.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	header(out, "levelupdb_http_requests_total", "counter", "HTTP requests by handler and status code.")
+	for _, key := range keys {
+		fmt.Fprintf(out, "levelupdb_http_requests_total{handler=\"%s\",code=\"%d\"} %d\n", key.handler, key.code, snapshot[key].count)
+	}
+
+	header(out, "levelupdb_http_request_duration_seconds", "histogram", "HTTP request latency by handler and status code.")
+	for _, key := range keys {
+		h := snapshot[key]
+		labels := fmt.Sprintf("handler=\"%s\",code=\"%d\"", key.handler, key.code)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "levelupdb_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "levelupdb_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(out, "levelupdb_http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "levelupdb_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+// Per level figures from leveldb.stats for every open bucket and index
+// database.
+func writeLevelDBMetrics(out *bufio.Writer) {
+	type row struct {
+		labels string
+		level  backend.LevelStats
+	}
+	var rows []row
+	for _, db := range []struct {
+		kind     string
+		database *backend.Database
+	}{{"data", database}, {"index", indexDatabase}, {"chunks", chunkDatabase}} {
+		for _, bucket := range db.database.OpenBucketNames() {
+			for _, level := range backend.ParseLevelDBStats(db.database.Property(bucket, "leveldb.stats")) {
+				labels := fmt.Sprintf("bucket=\"%s\",db=\"%s\",level=\"%d\"", escapeLabel(bucket), db.kind, level.Level)
+				rows = append(rows, row{labels, level})
+			}
+		}
+	}
+
+	const mb = 1048576
+	metrics := []struct {
+		name, kind, help string
+		value            func(backend.LevelStats) float64
+	}{
+		{"levelupdb_leveldb_level_files", "gauge", "Table files per leveldb level.",
+			func(l backend.LevelStats) float64 { return float64(l.Files) }},
+		{"levelupdb_leveldb_level_size_bytes", "gauge", "Size of each leveldb level.",
+			func(l backend.LevelStats) float64 { return l.SizeMB * mb }},
+		{"levelupdb_leveldb_compaction_seconds_total", "counter", "Time spent compacting into each level.",
+			func(l backend.LevelStats) float64 { return l.TimeSeconds }},
+		{"levelupdb_leveldb_compaction_read_bytes_total", "counter", "Bytes read by compactions per level.",
+			func(l backend.LevelStats) float64 { return l.ReadMB * mb }},
+		{"levelupdb_leveldb_compaction_written_bytes_total", "counter", "Bytes written by compactions per level.",
+			func(l backend.LevelStats) float64 { return l.WriteMB * mb }},
+	}
+
+	for _, metric := range metrics {
+		header(out, metric.name, metric.kind, metric.help)
+		for _, r := range rows {
+			fmt.Fprintf(out, "%s{%s} %s\n", metric.name, r.labels, strconv.FormatFloat(metric.value(r.level), 'g', -1, 64))
+		}
+	}
+}
+
+func header(out *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
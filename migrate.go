@@ -0,0 +1,275 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where a migration is at. The same record is kept for the one running
+// inside the server and printed by the command line tool.
+type migrationStatus struct {
+	Running      bool   `json:"running"`
+	Bucket       string `json:"bucket,omitempty"` // The one being migrated.
+	BucketsDone  int    `json:"buckets_done"`
+	BucketsTotal int    `json:"buckets_total"`
+	Scanned      int    `json:"scanned"`
+	Migrated     int    `json:"migrated"`
+	Skipped      int    `json:"skipped"` // Records too damaged to decode.
+	Error        string `json:"error,omitempty"`
+	Started      string `json:"started,omitempty"`
+	Finished     string `json:"finished,omitempty"`
+}
+
+var migration struct {
+	lock   sync.Mutex
+	status migrationStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func updateMigration(update func(status *migrationStatus)) {
+	migration.lock.Lock()
+	update(&migration.status)
+	migration.lock.Unlock()
+}
+
+// Rewrites every bucket's old records into the current envelope format.
+func migrateAll(ctx context.Context, progress func(migrationStatus)) error {
+	buckets, err := database.GetAllBucketNames()
+	if err != nil {
+		return err
+	}
+	updateMigration(func(status *migrationStatus) { status.BucketsTotal = len(buckets) })
+
+	for _, bucket := range buckets {
+		updateMigration(func(status *migrationStatus) { status.Bucket = bucket })
+		scanned, migrated, err := database.MigrateBucket(ctx, bucket, func(key []byte, err error) {
+			mainLogger.Println("ERROR: Migrating", bucket+"/"+string(key), "skipped, it failed to decode with err", err)
+			updateMigration(func(status *migrationStatus) { status.Skipped++ })
+		})
+		updateMigration(func(status *migrationStatus) {
+			status.Scanned += scanned
+			status.Migrated += migrated
+			if err == nil {
+				status.BucketsDone++
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("bucket %s: %s", bucket, err)
+		}
+		if progress != nil {
+			migration.lock.Lock()
+			status := migration.status
+			migration.lock.Unlock()
+			progress(status)
+		}
+	}
+	return nil
+}
+
+func startMigration() bool {
+	migration.lock.Lock()
+	defer migration.lock.Unlock()
+	if migration.status.Running {
+		return false
+	}
+	migration.status = migrationStatus{Running: true, Started: time.Now().UTC().Format(time.RFC3339)}
+	ctx, cancel := context.WithCancel(context.Background())
+	migration.cancel = cancel
+	migration.done = make(chan struct{})
+
+	go func() {
+		defer close(migration.done)
+		err := migrateAll(ctx, nil)
+		var migrated int
+		updateMigration(func(status *migrationStatus) {
+			status.Running = false
+			status.Bucket = ""
+			status.Finished = time.Now().UTC().Format(time.RFC3339)
+			if err != nil {
+				status.Error = err.Error()
+			}
+			migrated = status.Migrated
+		})
+		if err != nil {
+			mainLogger.Println("ERROR: Migration failed with", err)
+		} else {
+			mainLogger.Println("NOTICE: Migration rewrote", migrated, "records")
+		}
+	}()
+	return true
+}
+
+// Stops a migration running in the server so the databases can be closed.
+// Returns false if it did not stop before ctx was done.
+func stopMigration(ctx context.Context) bool {
+	migration.lock.Lock()
+	cancel, done := migration.cancel, migration.done
+	migration.lock.Unlock()
+	if done == nil {
+		return true
+	}
+	cancel()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GET  /admin/migrate shows the progress of the last migration
+// POST /admin/migrate starts one
+func migrateOps(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		migration.lock.Lock()
+		status := migration.status
+		migration.lock.Unlock()
+		writeJSON(w, status)
+	case "POST":
+		if !startMigration() {
+			w.WriteHeader(409)
+			w.Write([]byte("A migration is already running\n"))
+			return
+		}
+		mainLogger.Println("NOTICE: Migration started by", requestUser(req))
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+const migrateUsage = `usage: levelupdb migrate [flags]
+       levelupdb migrate -online [-url http://localhost:8198] [-token token]
+
+Rewrites records stored in an old format into the current one. Without
+-online the server must be stopped; with it, the running server at -url
+does the work while it keeps serving.
+`
+
+func migrateCommand(args []string) int {
+	flags := newConfigFlags("migrate")
+	online := flags.set.Bool("online", false, "have a running server migrate itself")
+	url := flags.set.String("url", "http://localhost:8198", "the server to migrate with -online")
+	token := flags.set.String("token", "", "API token for -online when auth is enabled ($"+envPrefix+"TOKEN)")
+	flags.set.Usage = func() {
+		fmt.Fprint(os.Stderr, migrateUsage+"\nflags:\n")
+		flags.set.PrintDefaults()
+	}
+	if err := flags.set.Parse(args); err != nil {
+		return 2
+	}
+
+	if *online {
+		if *token == "" {
+			*token = os.Getenv(envPrefix + "TOKEN")
+		}
+		return migrateOnline(strings.TrimSuffix(*url, "/"), *token)
+	}
+
+	var err error
+	if globalConfig, err = initializeConfig(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+	mainLogger = initializeLogger()
+	openDatabases()
+	defer closeDatabases()
+
+	err = migrateAll(context.Background(), printMigration)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Migration failed:", err)
+		return 1
+	}
+	fmt.Println("Done.")
+	return 0
+}
+
+func printMigration(status migrationStatus) {
+	fmt.Printf("%d/%d buckets, %d records scanned, %d rewritten, %d skipped\n",
+		status.BucketsDone, status.BucketsTotal, status.Scanned, status.Migrated, status.Skipped)
+}
+
+func migrateOnline(url, token string) int {
+	var status migrationStatus
+	return runOnline(url+"/admin/migrate", token, "migration", &status, func() (bool, string) {
+		printMigration(status)
+		return status.Running, status.Error
+	})
+}
+
+// Starts a job on a running server by POSTing to url, then GETs its status
+// into status every second until progress, called after each, says it is
+// no longer running. What progress returns as well is why it failed, if it
+// did.
+func runOnline(url, token, job string, status interface{}, progress func() (bool, string)) int {
+	call := func(method string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := call("POST")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Starting the", job, "failed:", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 202 && resp.StatusCode != 409 {
+		fmt.Fprintln(os.Stderr, "Starting the", job, "failed:", resp.Status)
+		return 1
+	}
+
+	for {
+		time.Sleep(time.Second)
+		resp, err := call("GET")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Getting the", job, "status failed:", err)
+			return 1
+		}
+		err = json.NewDecoder(resp.Body).Decode(status)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Getting the", job, "status failed:", err)
+			return 1
+		}
+
+		running, failure := progress()
+		if !running {
+			if failure != "" {
+				fmt.Fprintf(os.Stderr, "The %s failed: %s\n", job, failure)
+				return 1
+			}
+			fmt.Println("Done.")
+			return 0
+		}
+	}
+}
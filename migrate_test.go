@@ -0,0 +1,79 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"levelupdb/backend"
+	"testing"
+	"time"
+)
+
+func TestOnlineMigration(t *testing.T) {
+	server := newTestServer(t)
+
+	// A record the way levelupdb wrote them before the envelope.
+	metaString, _ := json.Marshal(&backend.Meta{ContentType: "text/plain"})
+	legacy := new(bytes.Buffer)
+	binary.Write(legacy, binary.BigEndian, int32(len(metaString)))
+	legacy.Write(metaString)
+	legacy.WriteString("old")
+	db, err := database.GetBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k"), legacy.Bytes(), false)
+
+	resp, body := do(t, "GET", server.URL+"/buckets/b/keys/k", "", nil)
+	expectStatus(t, resp, 200)
+	if body != "old" {
+		t.Fatalf("expected the legacy record to be readable, got %q", body)
+	}
+
+	resp, _ = do(t, "POST", server.URL+"/admin/migrate", "", nil)
+	expectStatus(t, resp, 202)
+
+	var status migrationStatus
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, body = do(t, "GET", server.URL+"/admin/migrate", "", nil)
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the migration did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Error != "" || status.Migrated != 1 || status.BucketsDone != 1 {
+		t.Fatalf("unexpected migration status %+v", status)
+	}
+
+	record, _ := db.Get([]byte("k"))
+	if backend.EnvelopeVersionOf(record) != backend.EnvelopeVersion {
+		t.Fatal("the record was not rewritten")
+	}
+	resp, body = do(t, "GET", server.URL+"/buckets/b/keys/k", "", nil)
+	expectStatus(t, resp, 200)
+	if body != "old" {
+		t.Fatalf("expected the migrated record to read the same, got %q", body)
+	}
+}
@@ -17,11 +17,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"levelupdb/backend"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // UUID from http://www.ashishbanerjee.com/home/go/go-generate-uuid
@@ -39,29 +45,94 @@ func GenUUID() (string, error) {
 }
 
 func fetchObject(w http.ResponseWriter, req *http.Request, bucket string, key string) {
-	meta, data, err := database.GetObject(bucket, key)
+	start := time.Now()
+	// Until the value is sent, a concurrent write must not delete the
+	// chunks the manifest read here points at.
+	defer database.HoldChunks()()
+	done := timePhase(req, phaseLevelDBRead)
+	meta, data, err := database.GetEncodedObject(bucket, key)
+	done()
 	if err != nil {
-		w.WriteHeader(500)
-		mainLogger.Println("ERROR: Getting object failed with err", err)
+		getObjectFailed(w, bucket, key, err)
 		return
 	}
 
 	if meta == nil {
-		w.WriteHeader(404)
+		notFound(w)
 		return
 	}
 
 	meta.ToHeaders(w.Header(), bucket)
-	w.Write(data)
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// gzip'd values go out as they are to clients that take gzip. Being a
+	// different representation, they get their own ETag.
+	if meta.Codec == backend.CodecGzip && acceptsGzip(req) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if etag := meta.ETag(); etag != "" {
+			w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+		}
+	} else if meta.Codec != "" {
+		done = timePhase(req, phaseDecompress)
+		data, err = backend.Decompress(meta.Codec, data)
+		done()
+		if err != nil {
+			w.WriteHeader(500)
+			mainLogger.Println("ERROR: Decompressing object failed with err", err)
+			return
+		}
+	}
+
+	value, err := openValue(bucket, meta, data)
+	if err != nil {
+		w.WriteHeader(500)
+		mainLogger.Println("ERROR: Opening chunks failed with err", err)
+		return
+	}
+	defer value.Close()
+
+	// ServeContent takes care of HEAD, Range, If-Range and the other
+	// conditional headers. Small values are read straight off the slice
+	// GetObject returned, so they are not copied again, and large ones
+	// a chunk at a time.
+	var modified time.Time
+	if meta.Modified != 0 {
+		modified = meta.LastModified()
+	}
+	http.ServeContent(w, req, "", modified, value)
+	nodeMetrics.observeGet(start, int(meta.Size(data)))
+}
+
+// An object's value, wherever it is stored.
+type valueReader interface {
+	io.ReadSeeker
+	Close()
+}
+
+type inlineValue struct {
+	*bytes.Reader
+}
+
+func (inlineValue) Close() {}
+
+func openValue(bucket string, meta *backend.Meta, data []byte) (valueReader, error) {
+	if meta.Manifest == nil {
+		return inlineValue{bytes.NewReader(data)}, nil
+	}
+	return database.OpenChunks(bucket, meta.Manifest)
 }
 
 func storeObject(w http.ResponseWriter, req *http.Request, bucket string, key string) {
-	data, err := ioutil.ReadAll(req.Body)
+	start := time.Now()
+	// Anything past the threshold is streamed into chunks instead.
+	threshold := int64(globalConfig.LargeObjectThreshold)
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, threshold+1))
 	if err != nil {
 		mainLogger.Printf("Error: Error reading request body '%s'.", err)
 		w.WriteHeader(400)
 		return
 	}
+	large := int64(len(data)) > threshold
 
 	meta, err := backend.MetaFromRequest(req)
 	if err != nil {
@@ -70,6 +141,13 @@ func storeObject(w http.ResponseWriter, req *http.Request, bucket string, key st
 		return
 	}
 
+	durable, err := writeDurability(req, bucket)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
 	created := false
 	if key == "" {
 		if key, err = GenUUID(); err != nil {
@@ -80,13 +158,32 @@ func storeObject(w http.ResponseWriter, req *http.Request, bucket string, key st
 		created = true
 	}
 
-	if err := database.StoreObject(bucket, key, meta, data); err != nil {
+	returnbody := req.URL.Query().Get("returnbody") == "true"
+	if returnbody {
+		// The value is read back after it is stored, by when another write
+		// may have replaced it.
+		defer database.HoldChunks()()
+	}
+
+	done := timePhase(req, phaseLevelDBWrite)
+	size := int64(len(data))
+	if large {
+		body := io.MultiReader(bytes.NewReader(data), req.Body)
+		data = nil
+		size, err = database.StoreLargeObject(bucket, key, meta, body, globalConfig.ChunkSize, durable)
+	} else {
+		err = database.StoreObject(bucket, key, meta, data, durable)
+	}
+	done()
+	if err != nil {
 		w.WriteHeader(500)
 		mainLogger.Println("ERROR: Backend store object failed with", err)
 		return
 	}
 
-	returnbody := req.URL.Query().Get("returnbody") == "true"
+	nodeMetrics.observePut(start, int(size))
+	// Large values are left out of the event; hooks can fetch them.
+	webhooks.postcommit("put", bucket, key, meta, data)
 
 	if created {
 		w.Header().Add("Location", "/buckets/"+bucket+"/keys/"+key)
@@ -94,11 +191,20 @@ func storeObject(w http.ResponseWriter, req *http.Request, bucket string, key st
 
 	// This is ugly.
 	if returnbody {
+		value, err := openValue(bucket, meta, data)
+		if err != nil {
+			w.WriteHeader(500)
+			mainLogger.Println("ERROR: Opening chunks failed with err", err)
+			return
+		}
+		defer value.Close()
+
 		meta.ToHeaders(w.Header(), bucket)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 		if created {
 			w.WriteHeader(201)
 		}
-		w.Write(data)
+		io.Copy(w, value)
 	} else {
 		if created {
 			w.WriteHeader(201)
@@ -109,11 +215,88 @@ func storeObject(w http.ResponseWriter, req *http.Request, bucket string, key st
 }
 
 func deleteObject(w http.ResponseWriter, req *http.Request, bucket string, key string) {
-	code, err := database.DeleteObject(bucket, key)
+	durable, err := writeDurability(req, bucket)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	done := timePhase(req, phaseLevelDBWrite)
+	code, err := database.DeleteObject(bucket, key, durable)
+	done()
 
 	if err != nil {
 		mainLogger.Println("ERROR: During delete...:w", err)
+	} else if code == 204 {
+		webhooks.postcommit("delete", bucket, key, nil, nil)
+	} else if code == 404 {
+		notFound(w)
+		return
 	}
 
 	w.WriteHeader(code)
 }
+
+func acceptsGzip(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(accepted, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Answers a read of bucket/key that failed with err.
+func getObjectFailed(w http.ResponseWriter, bucket, key string, err error) {
+	w.WriteHeader(500)
+	if err == backend.ErrChecksum {
+		mainLogger.Println("ERROR: Object", bucket+"/"+key, "is damaged, its checksum does not match")
+	} else {
+		mainLogger.Println("ERROR: Getting object", bucket+"/"+key, "failed with err", err)
+	}
+}
+
+// Riak answers for missing objects with a short plain text body.
+func notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(404)
+	w.Write([]byte("not found\n"))
+}
+
+// Riak's w, dw and pw. With a single node w and pw are met as soon as the
+// write is done, so only dw changes anything: a dw of one or more (or
+// "one", "quorum", "all") syncs the write to disk before responding.
+// Without dw in the query the bucket's dw property decides.
+func writeDurability(req *http.Request, bucket string) (bool, error) {
+	query := req.URL.Query()
+	invalid := fmt.Errorf("Specified w/dw/pw values invalid for bucket n value of %d", backend.NVal)
+	for _, param := range []string{"w", "pw"} {
+		if _, err := backend.ParseQuorum(query.Get(param)); err != nil {
+			return false, invalid
+		}
+	}
+	dw, err := backend.ParseQuorum(query.Get("dw"))
+	if err != nil {
+		return false, invalid
+	}
+
+	if dw == backend.QuorumDefault {
+		props, err := database.Props.Get(bucket)
+		if err != nil {
+			// Erring on the safe side costs an fsync, the other way could
+			// cost data.
+			mainLogger.Println("ERROR: Getting bucket properties failed with", err)
+			return true, nil
+		}
+		dw, _ = backend.ParseQuorum(props.DW)
+	}
+	return dw > 0, nil
+}
@@ -21,11 +21,13 @@ import (
 	"container/list"
 	"encoding/json"
 	"fmt"
+	"io"
 	"levelupdb/backend"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"strings"
+	"time"
 )
 
 type JSONIndexes struct {
@@ -33,17 +35,21 @@ type JSONIndexes struct {
 }
 
 func secondaryIndex(w http.ResponseWriter, req *http.Request, bucket string, indexField string, startValue string, endValue string) {
+	defer nodeMetrics.observeIndexQuery(time.Now())
 	var r JSONIndexes
-	// TODO: refactor this.
-	// The index operation should be moved to backend
 	if indexField == "$key" {
+		done := timePhase(req, phaseIndexScan)
 		keys, err := database.GetKeysRange(bucket, startValue, endValue)
+		done()
 		if err != nil {
 			w.WriteHeader(500)
 			return
 		}
 		r.Keys = keys
-		if d, err := json.Marshal(r); err == nil {
+		done = timePhase(req, phaseJSONEncode)
+		d, err := json.Marshal(r)
+		done()
+		if err == nil {
 			w.Write(d)
 		} else {
 			w.WriteHeader(500)
@@ -52,13 +58,18 @@ func secondaryIndex(w http.ResponseWriter, req *http.Request, bucket string, ind
 	} else if indexField == "$bucket" {
 		// TODO: do we care about start and end value? Riak seems to care if an
 		// end value is thrown into this
+		done := timePhase(req, phaseIndexScan)
 		keys, err := database.GetAllKeys(bucket)
+		done()
 		if err != nil {
 			w.WriteHeader(500)
 			return
 		}
 		r.Keys = keys
-		if d, err := json.Marshal(r); err == nil {
+		done = timePhase(req, phaseJSONEncode)
+		d, err := json.Marshal(r)
+		done()
+		if err == nil {
 			w.Write(d)
 		} else {
 			w.WriteHeader(500)
@@ -66,33 +77,21 @@ func secondaryIndex(w http.ResponseWriter, req *http.Request, bucket string, ind
 		return
 	}
 
-	indexDb := indexDatabase.GetBucketNoCreate(bucket)
-	if indexDb == nil {
+	done := timePhase(req, phaseIndexScan)
+	keys, found, err := database.QueryIndex(bucket, indexField, startValue, endValue)
+	done()
+	if !found {
 		w.WriteHeader(404)
 		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		mainLogger.Println("ERROR: Getting index values failed with", err)
+		return
 	}
-	searchKey := []byte(indexField + "~" + startValue)
-	if endValue == "" {
-		keys, err := indexDb.Get(backend.LReadOptions, searchKey)
-		if err != nil {
-			w.WriteHeader(500)
-			mainLogger.Println("ERROR: Getting index values failed with", searchKey)
-			return
-		}
-
-		r.Keys = backend.DecodeDataKeys(keys)
-	} else {
-		endSearchKey := []byte(indexField + "~" + endValue)
-		it := indexDb.NewIterator(backend.LReadOptions)
-		it.Seek(searchKey)
-		for it = it; it.Valid(); it.Next() {
-			if bytes.Compare(it.Key(), endSearchKey) > 0 {
-				break
-			}
-			r.Keys = append(r.Keys, backend.DecodeDataKeys(it.Value())...)
-		}
-	}
+	r.Keys = keys
+	done = timePhase(req, phaseJSONEncode)
 	d, err := json.Marshal(r)
+	done()
 	if err != nil {
 		w.WriteHeader(500)
 		mainLogger.Println("ERROR: JSON decode failed with ", r.Keys)
@@ -108,12 +107,17 @@ func walkLink(w http.ResponseWriter, req *http.Request, bucket string, key strin
 		return
 	}
 
+	// Until the parts are copied, a concurrent write must not delete the
+	// chunks the manifests read here point at.
+	defer database.HoldChunks()()
+	done := timePhase(req, phaseLevelDBRead)
 	meta, _, err := database.GetObject(bucket, key)
+	done()
 	if err != nil {
-		w.WriteHeader(400)
+		getObjectFailed(w, bucket, key, err)
 		return
 	} else if meta == nil {
-		w.WriteHeader(404)
+		notFound(w)
 		return
 	}
 
@@ -133,14 +137,21 @@ func walkLink(w http.ResponseWriter, req *http.Request, bucket string, key strin
 		phasepartBuffer := new(bytes.Buffer)
 		phasepartWriter := multipart.NewWriter(phasepartBuffer)
 
+		walked := timePhase(req, fmt.Sprintf("link_walk_%d", i+1))
 		nextMeta := list.New()
 		for node := metaToExplore.Front(); node != nil; node = node.Next() {
 			meta := node.Value.(*backend.Meta)
 			links := backend.QueryLinks(meta.Links, phase[0], phase[1])
 			for _, link := range links {
+				if !canAccess(req, link.Bucket, permRead) {
+					continue
+				}
+
+				done := timePhase(req, phaseLevelDBRead)
 				meta, body, err := database.GetObjectFromLink(link)
+				done()
 				if err != nil {
-					w.WriteHeader(500)
+					getObjectFailed(w, link.Bucket, link.Key, err)
 					return
 				} else if meta == nil {
 					continue
@@ -148,14 +159,28 @@ func walkLink(w http.ResponseWriter, req *http.Request, bucket string, key strin
 
 				if i+1 == len(walks) || phase[2] == "1" {
 					partHeader := make(http.Header)
-					meta.ToHeaders(partHeader, bucket)
+					meta.ToHeaders(partHeader, link.Bucket)
 					partHeader.Set("Location", fmt.Sprintf("/buckets/%s/keys/%s", link.Bucket, link.Key))
 					wr, err := phasepartWriter.CreatePart(textproto.MIMEHeader(partHeader))
 					if err != nil {
 						w.WriteHeader(500)
 						return
 					}
-					wr.Write(body)
+					value, err := openValue(link.Bucket, meta, body)
+					if err != nil {
+						w.WriteHeader(500)
+						mainLogger.Println("ERROR: Opening chunks failed with err", err)
+						return
+					}
+					// The response is only sent once it is complete, so a
+					// part that cannot be read whole fails all of it.
+					_, err = io.Copy(wr, value)
+					value.Close()
+					if err != nil {
+						w.WriteHeader(500)
+						mainLogger.Println("ERROR: Reading", link.Bucket+"/"+link.Key, "failed with err", err)
+						return
+					}
 				}
 
 				if i+1 < len(walks) {
@@ -175,6 +200,7 @@ func walkLink(w http.ResponseWriter, req *http.Request, bucket string, key strin
 		}
 
 		wr.Write(phasepartBuffer.Bytes())
+		walked()
 	}
 
 	w.Header().Set("Content-Type", "multipart/mixed; boundary="+multipartWriter.Boundary())
@@ -0,0 +1,315 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"levelupdb/backend"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Only this many differences are kept for /admin/reindex; they are all
+// counted.
+const maxReportedDiffs = 1000
+
+type reindexStatus struct {
+	Running      bool                `json:"running"`
+	Mode         string              `json:"mode"`             // report, repair or rebuild
+	Bucket       string              `json:"bucket,omitempty"` // The one being reindexed.
+	BucketsDone  int                 `json:"buckets_done"`
+	BucketsTotal int                 `json:"buckets_total"`
+	Scanned      int                 `json:"scanned"`
+	Entries      int                 `json:"entries"`
+	Differences  int                 `json:"differences"`
+	Diffs        []backend.IndexDiff `json:"diffs"`
+	Error        string              `json:"error,omitempty"`
+	Started      string              `json:"started,omitempty"`
+	Finished     string              `json:"finished,omitempty"`
+}
+
+var reindexModes = map[string]int{
+	"report":  backend.ReindexReport,
+	"repair":  backend.ReindexRepair,
+	"rebuild": backend.ReindexRebuild,
+}
+
+var reindexing struct {
+	lock   sync.Mutex
+	status reindexStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func updateReindex(update func(status *reindexStatus)) {
+	reindexing.lock.Lock()
+	update(&reindexing.status)
+	reindexing.lock.Unlock()
+}
+
+// Reindexes buckets, or all of them when there are none, in mode. progress
+// gets what was found in each bucket.
+func reindexAll(ctx context.Context, buckets []string, mode string, progress func(*backend.ReindexResult)) error {
+	if len(buckets) == 0 {
+		var err error
+		if buckets, err = database.GetAllBucketNames(); err != nil {
+			return err
+		}
+	}
+	updateReindex(func(status *reindexStatus) { status.BucketsTotal = len(buckets) })
+
+	for _, bucket := range buckets {
+		updateReindex(func(status *reindexStatus) { status.Bucket = bucket })
+		result, err := database.ReindexBucket(ctx, bucket, reindexModes[mode])
+		updateReindex(func(status *reindexStatus) {
+			status.Scanned += result.Scanned
+			status.Entries += result.Entries
+			status.Differences += len(result.Diffs)
+			for _, diff := range result.Diffs {
+				if len(status.Diffs) == maxReportedDiffs {
+					break
+				}
+				status.Diffs = append(status.Diffs, diff)
+			}
+			if err == nil {
+				status.BucketsDone++
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("bucket %s: %s", bucket, err)
+		}
+		if progress != nil {
+			progress(result)
+		}
+	}
+	return nil
+}
+
+// Marks a reindex as started. Returns false if one already is.
+func beginReindex(mode string) (context.Context, bool) {
+	reindexing.lock.Lock()
+	defer reindexing.lock.Unlock()
+	if reindexing.status.Running {
+		return nil, false
+	}
+	reindexing.status = reindexStatus{Running: true, Mode: mode, Diffs: []backend.IndexDiff{}, Started: time.Now().UTC().Format(time.RFC3339)}
+	ctx, cancel := context.WithCancel(context.Background())
+	reindexing.cancel = cancel
+	reindexing.done = make(chan struct{})
+	return ctx, true
+}
+
+func endReindex(err error) reindexStatus {
+	var status reindexStatus
+	updateReindex(func(s *reindexStatus) {
+		s.Running = false
+		s.Bucket = ""
+		s.Finished = time.Now().UTC().Format(time.RFC3339)
+		if err != nil {
+			s.Error = err.Error()
+		}
+		status = *s
+	})
+	return status
+}
+
+// Starts reindexing bucket, or every bucket when it is empty, in the
+// background. Only report and repair can run while serving.
+func startReindex(bucket, mode string) bool {
+	ctx, ok := beginReindex(mode)
+	if !ok {
+		return false
+	}
+
+	var buckets []string
+	if bucket != "" {
+		buckets = []string{bucket}
+	}
+	go func() {
+		defer close(reindexing.done)
+		err := reindexAll(ctx, buckets, mode, nil)
+		status := endReindex(err)
+		if err != nil {
+			mainLogger.Println("ERROR: Reindex failed with", err)
+		} else {
+			mainLogger.Println("NOTICE: Reindex found", status.Differences, "index entries that differ from the objects")
+		}
+	}()
+	return true
+}
+
+// Stops a reindex running in the server so the databases can be closed.
+// Returns false if it did not stop before ctx was done.
+func stopReindex(ctx context.Context) bool {
+	reindexing.lock.Lock()
+	cancel, done := reindexing.cancel, reindexing.done
+	reindexing.lock.Unlock()
+	if done == nil {
+		return true
+	}
+	cancel()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GET  /admin/reindex shows the progress of the last reindex and what it found
+// POST /admin/reindex[?bucket=<bucket>][&mode=report|repair] starts one
+func reindexOps(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		reindexing.lock.Lock()
+		status := reindexing.status
+		status.Diffs = append([]backend.IndexDiff(nil), status.Diffs...)
+		reindexing.lock.Unlock()
+		writeJSON(w, status)
+	case "POST":
+		query := req.URL.Query()
+		mode := query.Get("mode")
+		if mode == "" {
+			mode = "repair"
+		}
+		if mode != "report" && mode != "repair" {
+			w.WriteHeader(400)
+			w.Write([]byte("mode must be report or repair\n"))
+			return
+		}
+		if !startReindex(query.Get("bucket"), mode) {
+			w.WriteHeader(409)
+			w.Write([]byte("A reindex is already running\n"))
+			return
+		}
+		mainLogger.Println("NOTICE: Reindex started by", requestUser(req))
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+const reindexUsage = `usage: levelupdb reindex [flags] [bucket]
+       levelupdb reindex -online [-url http://localhost:8198] [-token token] [flags] [bucket]
+
+Rebuilds the secondary indexes of a bucket, or of every bucket, from the
+indexes its objects were stored with. Without -online the server must be
+stopped and the index databases are dropped and written anew; with it, the
+running server at -url rewrites the entries that differ while it keeps
+serving, holding off writes to the bucket being reindexed. -report only
+lists the differences.
+`
+
+func reindexCommand(args []string) int {
+	flags := newConfigFlags("reindex")
+	report := flags.set.Bool("report", false, "only report the index entries that differ")
+	online := flags.set.Bool("online", false, "have a running server reindex itself")
+	serverUrl := flags.set.String("url", "http://localhost:8198", "the server to reindex with -online")
+	token := flags.set.String("token", "", "API token for -online when auth is enabled ($"+envPrefix+"TOKEN)")
+	flags.set.Usage = func() {
+		fmt.Fprint(os.Stderr, reindexUsage+"\nflags:\n")
+		flags.set.PrintDefaults()
+	}
+	if err := flags.set.Parse(args); err != nil {
+		return 2
+	}
+	if flags.set.NArg() > 1 {
+		flags.set.Usage()
+		return 2
+	}
+	bucket := flags.set.Arg(0)
+
+	if *online {
+		if *token == "" {
+			*token = os.Getenv(envPrefix + "TOKEN")
+		}
+		query := url.Values{"mode": {"repair"}}
+		if *report {
+			query.Set("mode", "report")
+		}
+		if bucket != "" {
+			query.Set("bucket", bucket)
+		}
+		var status reindexStatus
+		return runOnline(strings.TrimSuffix(*serverUrl, "/")+"/admin/reindex?"+query.Encode(), *token, "reindex", &status, func() (bool, string) {
+			printReindex(status)
+			if !status.Running {
+				for _, diff := range status.Diffs {
+					printIndexDiff(diff)
+				}
+				if status.Differences > len(status.Diffs) {
+					fmt.Println("and", status.Differences-len(status.Diffs), "more")
+				}
+			}
+			return status.Running, status.Error
+		})
+	}
+
+	var err error
+	if globalConfig, err = initializeConfig(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+	mainLogger = initializeLogger()
+	openDatabases()
+	defer closeDatabases()
+
+	mode := "rebuild"
+	if *report {
+		mode = "report"
+	}
+	ctx, _ := beginReindex(mode)
+	var buckets []string
+	if bucket != "" {
+		buckets = []string{bucket}
+	}
+	err = reindexAll(ctx, buckets, mode, func(result *backend.ReindexResult) {
+		for _, diff := range result.Diffs {
+			printIndexDiff(diff)
+		}
+	})
+	status := endReindex(err)
+	close(reindexing.done)
+	printReindex(status)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Reindex failed:", err)
+		return 1
+	}
+	fmt.Println("Done.")
+	return 0
+}
+
+func printReindex(status reindexStatus) {
+	fmt.Printf("%d/%d buckets, %d objects scanned, %d index entries, %d differ\n",
+		status.BucketsDone, status.BucketsTotal, status.Scanned, status.Entries, status.Differences)
+}
+
+func printIndexDiff(diff backend.IndexDiff) {
+	fmt.Printf("%s %s=%s", diff.Bucket, diff.Field, diff.Value)
+	if len(diff.Missing) > 0 {
+		fmt.Printf(" missing %s", strings.Join(diff.Missing, ","))
+	}
+	if len(diff.Extra) > 0 {
+		fmt.Printf(" extra %s", strings.Join(diff.Extra, ","))
+	}
+	fmt.Println()
+}
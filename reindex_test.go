@@ -0,0 +1,76 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForReindex(t *testing.T, url string) reindexStatus {
+	var status reindexStatus
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, body := do(t, "GET", url+"/admin/reindex", "", nil)
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reindex did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnlineReindex(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, key := range []string{"a", "b"} {
+		resp, _ := do(t, "PUT", server.URL+"/buckets/b/keys/"+key, key, map[string]string{"X-Riak-Index-Colour_bin": "purple"})
+		expectStatus(t, resp, 204)
+	}
+	indexDb := indexDatabase.GetBucketNoCreate("b")
+	indexDb.Put([]byte("colour_bin~purple"), []byte("a"), false)
+
+	resp, _ := do(t, "POST", server.URL+"/admin/reindex?mode=sideways", "", nil)
+	expectStatus(t, resp, 400)
+
+	resp, _ = do(t, "POST", server.URL+"/admin/reindex?bucket=b&mode=report", "", nil)
+	expectStatus(t, resp, 202)
+	status := waitForReindex(t, server.URL)
+	if status.Error != "" || status.Scanned != 2 || status.Differences != 1 || strings.Join(status.Diffs[0].Missing, ",") != "b" {
+		t.Fatalf("unexpected reindex status %+v", status)
+	}
+	if keys, _ := indexDb.Get([]byte("colour_bin~purple")); string(keys) != "a" {
+		t.Fatalf("report changed the index to %q", keys)
+	}
+
+	resp, _ = do(t, "POST", server.URL+"/admin/reindex", "", nil)
+	expectStatus(t, resp, 202)
+	if status = waitForReindex(t, server.URL); status.Error != "" || status.Mode != "repair" || status.Differences != 1 {
+		t.Fatalf("unexpected reindex status %+v", status)
+	}
+	resp, body := do(t, "GET", server.URL+"/buckets/b/index/colour_bin/purple", "", nil)
+	expectStatus(t, resp, 200)
+	if !strings.Contains(body, `"b"`) {
+		t.Fatalf("expected the repaired index to find b, got %s", body)
+	}
+}
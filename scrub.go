@@ -0,0 +1,286 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"levelupdb/backend"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// What the last scrub found. It is written to the report file when a scrub
+// finishes and served by /admin/scrub.
+type scrubReport struct {
+	Running      bool             `json:"running"`
+	Bucket       string           `json:"bucket,omitempty"` // The one being scrubbed.
+	BucketsDone  int              `json:"buckets_done"`
+	BucketsTotal int              `json:"buckets_total"`
+	Scanned      int              `json:"scanned"`
+	Damaged      []backend.Damage `json:"damaged"`
+	Error        string           `json:"error,omitempty"`
+	Started      string           `json:"started,omitempty"`
+	Finished     string           `json:"finished,omitempty"`
+}
+
+var scrub struct {
+	lock   sync.Mutex
+	report scrubReport
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func updateScrub(update func(report *scrubReport)) {
+	scrub.lock.Lock()
+	update(&scrub.report)
+	scrub.lock.Unlock()
+}
+
+func scrubReportPath() string {
+	if globalConfig.ScrubReport != "" {
+		return globalConfig.ScrubReport
+	}
+	return path.Join(globalConfig.DatabaseLocation, "scrub-report.json")
+}
+
+// Keeps reads at or below rate bytes per second on average.
+type throttle struct {
+	rate  float64
+	start time.Time
+	bytes int64
+}
+
+func (t *throttle) wait(ctx context.Context, n int) {
+	t.bytes += int64(n)
+	ahead := time.Duration(float64(t.bytes)/t.rate*float64(time.Second)) - time.Since(t.start)
+	if ahead <= 0 {
+		return
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Scrubs buckets, or all of them when there are none, reading at most
+// rate megabytes per second (zero for no limit). found is called with
+// every damaged object as it turns up.
+func scrubAll(ctx context.Context, buckets []string, rate int, found func(backend.Damage)) error {
+	if len(buckets) == 0 {
+		var err error
+		if buckets, err = database.GetAllBucketNames(); err != nil {
+			return err
+		}
+	}
+	updateScrub(func(report *scrubReport) { report.BucketsTotal = len(buckets) })
+
+	var read func(n int)
+	if rate > 0 {
+		limit := &throttle{rate: float64(rate) * 1024 * 1024, start: time.Now()}
+		read = func(n int) { limit.wait(ctx, n) }
+	}
+	damaged := func(damage backend.Damage) {
+		updateScrub(func(report *scrubReport) { report.Damaged = append(report.Damaged, damage) })
+		if found != nil {
+			found(damage)
+		}
+	}
+
+	for _, bucket := range buckets {
+		updateScrub(func(report *scrubReport) { report.Bucket = bucket })
+		scanned, err := database.ScrubBucket(ctx, bucket, read, damaged)
+		updateScrub(func(report *scrubReport) {
+			report.Scanned += scanned
+			if err == nil {
+				report.BucketsDone++
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("bucket %s: %s", bucket, err)
+		}
+	}
+	return nil
+}
+
+// Marks a scrub as started. Returns false if one already is.
+func beginScrub() (context.Context, bool) {
+	scrub.lock.Lock()
+	defer scrub.lock.Unlock()
+	if scrub.report.Running {
+		return nil, false
+	}
+	scrub.report = scrubReport{Running: true, Damaged: []backend.Damage{}, Started: time.Now().UTC().Format(time.RFC3339)}
+	ctx, cancel := context.WithCancel(context.Background())
+	scrub.cancel = cancel
+	scrub.done = make(chan struct{})
+	return ctx, true
+}
+
+// Marks the scrub as finished and writes its report.
+func endScrub(err error) scrubReport {
+	var report scrubReport
+	updateScrub(func(r *scrubReport) {
+		r.Running = false
+		r.Bucket = ""
+		r.Finished = time.Now().UTC().Format(time.RFC3339)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		report = *r
+	})
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	reportPath := scrubReportPath()
+	if werr := ioutil.WriteFile(reportPath+".tmp", append(data, '\n'), 0644); werr != nil {
+		mainLogger.Println("ERROR: Writing the scrub report failed with", werr)
+	} else if werr = os.Rename(reportPath+".tmp", reportPath); werr != nil {
+		mainLogger.Println("ERROR: Writing the scrub report failed with", werr)
+	}
+	return report
+}
+
+// Starts a scrub of every bucket in the background.
+func startScrub() bool {
+	ctx, ok := beginScrub()
+	if !ok {
+		return false
+	}
+
+	go func() {
+		defer close(scrub.done)
+		err := scrubAll(ctx, nil, globalConfig.ScrubRate, func(damage backend.Damage) {
+			mainLogger.Println("ERROR: Scrub found", damage.Bucket+"/"+damage.Key, "damaged:", damage.Problem)
+		})
+		report := endScrub(err)
+		if err != nil {
+			mainLogger.Println("ERROR: Scrub failed with", err)
+		} else {
+			mainLogger.Println("NOTICE: Scrub checked", report.Scanned, "records and found", len(report.Damaged), "damaged")
+		}
+	}()
+	return true
+}
+
+// Scrubs every ScrubInterval hours until the server shuts down.
+func scheduleScrubs() {
+	// Memory has no disk under it to rot, but backends may keep buckets
+	// on one.
+	if globalConfig.ScrubInterval == 0 || (globalConfig.Engine == "memory" && len(globalConfig.Backends) == 0) {
+		return
+	}
+	interval := time.Duration(globalConfig.ScrubInterval) * time.Hour
+	go func() {
+		for range time.Tick(interval) {
+			startScrub()
+		}
+	}()
+}
+
+// Stops a scrub running in the server so the databases can be closed.
+// Returns false if it did not stop before ctx was done.
+func stopScrub(ctx context.Context) bool {
+	scrub.lock.Lock()
+	cancel, done := scrub.cancel, scrub.done
+	scrub.lock.Unlock()
+	if done == nil {
+		return true
+	}
+	cancel()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GET  /admin/scrub shows the progress of the last scrub and what it found
+// POST /admin/scrub starts one
+func scrubOps(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		scrub.lock.Lock()
+		report := scrub.report
+		report.Damaged = append([]backend.Damage(nil), report.Damaged...)
+		scrub.lock.Unlock()
+		writeJSON(w, report)
+	case "POST":
+		if !startScrub() {
+			w.WriteHeader(409)
+			w.Write([]byte("A scrub is already running\n"))
+			return
+		}
+		mainLogger.Println("NOTICE: Scrub started by", requestUser(req))
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+const scrubUsage = `usage: levelupdb scrub [flags] [bucket ...]
+
+Reads every object, or those of the given buckets, and checks that none was
+damaged after it was written. The server must be stopped; a running one
+scrubs itself every ScrubInterval hours or on POST /admin/scrub. Damaged
+objects are printed and written to the report file. Exits with 1 if any
+were found.
+`
+
+func scrubCommand(args []string) int {
+	flags := newConfigFlags("scrub")
+	rate := flags.set.Int("rate", 0, "megabytes to read per second, 0 for no limit")
+	flags.set.Usage = func() {
+		fmt.Fprint(os.Stderr, scrubUsage+"\nflags:\n")
+		flags.set.PrintDefaults()
+	}
+	if err := flags.set.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if globalConfig, err = initializeConfig(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+	mainLogger = initializeLogger()
+	openDatabases()
+	defer closeDatabases()
+
+	ctx, _ := beginScrub()
+	err = scrubAll(ctx, flags.set.Args(), *rate, func(damage backend.Damage) {
+		fmt.Printf("%s/%s: %s\n", damage.Bucket, damage.Key, damage.Problem)
+	})
+	report := endScrub(err)
+	close(scrub.done)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Scrub failed:", err)
+		return 1
+	}
+	fmt.Printf("%d records checked, %d damaged. Report written to %s\n", report.Scanned, len(report.Damaged), scrubReportPath())
+	if len(report.Damaged) > 0 {
+		return 1
+	}
+	return 0
+}
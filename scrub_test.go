@@ -0,0 +1,72 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, key := range []string{"good", "damaged"} {
+		resp, _ := do(t, "PUT", server.URL+"/buckets/b/keys/"+key, "value", map[string]string{"Content-Type": "text/plain"})
+		expectStatus(t, resp, 204)
+	}
+	db := database.GetBucketNoCreate("b")
+	record, _ := db.Get([]byte("damaged"))
+	record[len(record)-1] ^= 1
+	db.Put([]byte("damaged"), record, false)
+
+	resp, _ := do(t, "GET", server.URL+"/buckets/b/keys/damaged", "", nil)
+	expectStatus(t, resp, 500)
+	resp, _ = do(t, "GET", server.URL+"/buckets/b/keys/good", "", nil)
+	expectStatus(t, resp, 200)
+
+	resp, _ = do(t, "POST", server.URL+"/admin/scrub", "", nil)
+	expectStatus(t, resp, 202)
+
+	var report scrubReport
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, body := do(t, "GET", server.URL+"/admin/scrub", "", nil)
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatal(err)
+		}
+		if !report.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the scrub did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if report.Error != "" || report.Scanned != 2 || len(report.Damaged) != 1 || report.Damaged[0].Key != "damaged" {
+		t.Fatalf("unexpected scrub report %+v", report)
+	}
+
+	data, err := ioutil.ReadFile(scrubReportPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written scrubReport
+	if err := json.Unmarshal(data, &written); err != nil || len(written.Damaged) != 1 || written.Finished == "" {
+		t.Fatalf("unexpected report file %s", data)
+	}
+}
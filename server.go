@@ -18,84 +18,242 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"levelupdb/backend"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
 const VERSION = "0.1"
 const SERVER_STRING = "levelupdb/" + VERSION + " (someone painted it purple)"
 
-func standardHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, request *http.Request) {
-		header := w.Header()
-		header.Add("Server", SERVER_STRING)
-		fn(w, request)
-		mainLogger.Println("-", request.RemoteAddr, "-", request.Method, request.URL.Path)
-	}
+// Remembers the status code and body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	timer  *phaseTimer
 }
 
-type Config struct {
-	DatabaseLocation string
-	Logging          string
-	HttpPort         string
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
 
-func initializeConfig() *Config {
-	data, err := ioutil.ReadFile("config.json")
-	if err != nil {
-		panic(fmt.Sprintln("Config file error: ", err))
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
 	}
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(data)
+	w.timer.add(phaseResponseWrite, time.Since(start))
+	w.bytes += n
+	return n, err
+}
 
-	config := new(Config)
-	err = json.Unmarshal(data, config)
-
-	if err != nil {
-		panic(fmt.Sprintln("Config file error: ", err))
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
-	return config
 }
 
-func initializeLogger() *log.Logger {
-	var writer io.Writer
-	if globalConfig.Logging == "stdout" {
-		writer = os.Stdout
-	} else if globalConfig.Logging == "none" {
-		writer = ioutil.Discard
-	} else {
-		writer = os.Stdout // TODO: change this to files.
-	}
+func standardHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: rw}
+		id := requestId(request)
+		if slowRequests != nil {
+			w.timer = &phaseTimer{phases: make(map[string]time.Duration)}
+			request = withPhaseTimer(request, w.timer)
+		}
+		var authed *http.Request
+		defer func() {
+			if w.status == 0 {
+				w.status = 200
+			}
+			// A denied request is logged as it came in, without a user.
+			logged := request
+			if authed != nil {
+				logged = authed
+			}
+			duration := time.Since(start)
+			httpMetrics.observe(requestOperation(logged), w.status, duration)
+			logAccess(logged, id, w.status, w.bytes, duration)
+			observeSlowRequest(logged, w.timer, id, w.status, duration)
+		}()
 
-	return log.New(writer, "[levelupdb "+VERSION+"] ", log.Ldate|log.Ltime)
+		header := w.Header()
+		header.Add("Server", SERVER_STRING)
+		header.Set("X-Request-Id", id)
+		if authed = authorize(w, request); authed == nil {
+			return
+		}
+		fn(w, authed)
+		mainLogger.Println("-", authed.RemoteAddr, "-", authed.Method, authed.URL.Path)
+	}
 }
 
 var mainLogger *log.Logger
 var globalConfig *Config
 var database *backend.Database
 var indexDatabase *backend.Database
+var chunkDatabase *backend.Database
+var webhooks *webhookDispatcher
+var props *backend.PropsStore
+var queue *backend.Queue
+
+var commands = map[string]func(args []string) int{
+	"serve":   serveCommand,
+	"config":  configCommand,
+	"migrate": migrateCommand,
+	"scrub":   scrubCommand,
+	"reindex": reindexCommand,
+	"fsck":    fsckCommand,
+}
+
+const usage = `usage: levelupdb [command] [flags]
+
+commands:
+  serve          run the server (default)
+  config print   show the effective configuration
+  migrate        rewrite records stored in an old format
+  scrub          check stored objects for damage
+  reindex        rebuild secondary indexes from the objects
+  fsck           check indexes, links and chunks for consistency
+
+Run "levelupdb <command> -h" for the flags of a command.
+`
 
 func main() {
-	backend.Initialize()
-	globalConfig = initializeConfig()
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	os.Exit(command(args))
+}
+
+func serveCommand(args []string) int {
+	flags := newConfigFlags("serve")
+	if err := flags.set.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if globalConfig, err = initializeConfig(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Config error:", err)
+		return 1
+	}
+
 	mainLogger = initializeLogger()
+	initializeAccessLog()
+	go watchLogFiles()
+	if globalConfig.SlowRequestThreshold > 0 {
+		slowRequests = newSlowRequestLog(globalConfig.SlowRequestLogSize)
+	}
+	initializeACL()
+
+	openDatabases()
+	webhooks.start()
+	scheduleScrubs()
+	registerHandlers(http.DefaultServeMux)
+
+	var servers []*http.Server
+	errs := make(chan error, 2)
+	if globalConfig.TLS.enabled() {
+		server := tlsServer()
+		servers = append(servers, server)
+		go func() { errs <- server.ListenAndServeTLS("", "") }()
+	}
+
+	// Leaving HttpPort empty turns plain HTTP off, which only makes sense
+	// when HTTPS is on.
+	if globalConfig.HttpPort != "" {
+		server := &http.Server{Addr: ":" + globalConfig.HttpPort}
+		servers = append(servers, server)
+		mainLogger.Println("NOTICE: Server started. Serving port " + globalConfig.HttpPort)
+		go func() { errs <- server.ListenAndServe() }()
+	}
+
+	return waitForShutdown(servers, errs)
+}
+
+// Opens everything under DatabaseLocation. closeDatabases undoes it.
+func openDatabases() {
+	backend.Initialize()
+	backends := &backend.Backends{Default: backend.DriverNamed(globalConfig.Engine), Named: globalConfig.Backends}
+	// Bucket properties say which backend each bucket is kept in, and the
+	// webhook queue promises not to lose events, so both have to outlive a
+	// restart even when the buckets do not.
+	durableDriver := backends.Default
+	if durableDriver == backend.Memory {
+		durableDriver = backend.LevelDB
+	}
+	var err error
+	props, err = backend.OpenPropsStore(durableDriver, path.Join(globalConfig.DatabaseLocation, "_props"))
+	if err != nil {
+		panic(fmt.Sprintln("Bucket properties error: ", err))
+	}
+	backends.Props = props
 
-	database = backend.NewDatabase(globalConfig.DatabaseLocation)
-	indexDatabase = backend.NewDatabase(path.Join(globalConfig.DatabaseLocation, "_indexes"))
+	// Index and chunk buckets are kept in the backend of the bucket they
+	// belong to, but without the bucket's own options: they are small.
+	options := backend.EngineOptions{LevelDB: globalConfig.LevelDB, Bitcask: globalConfig.Bitcask}
+	database = backend.NewDatabase(globalConfig.DatabaseLocation, backends, options, props)
+	indexDatabase = backend.NewDatabase(path.Join(globalConfig.DatabaseLocation, "_indexes"), backends, options, nil)
+	chunkDatabase = backend.NewDatabase(path.Join(globalConfig.DatabaseLocation, "_chunks"), backends, options, nil)
 	database.IndexDatabase = indexDatabase
+	database.ChunkDatabase = chunkDatabase
+	if globalConfig.GroupCommit {
+		database.GroupCommit = backend.NewGroupCommitter(time.Duration(globalConfig.GroupCommitWindow) * time.Microsecond)
+	}
+
+	queue, err = backend.OpenQueue(durableDriver, path.Join(globalConfig.DatabaseLocation, "_webhooks"))
+	if err != nil {
+		panic(fmt.Sprintln("Webhook queue error: ", err))
+	}
+	webhooks = newWebhookDispatcher(queue, globalConfig.Webhooks)
+}
 
+func registerHandlers(mux *http.ServeMux) {
 	// Server Operations
-	http.HandleFunc("/ping", standardHandler(ping))
-	http.HandleFunc("/", standardHandler(listResources))
-	http.HandleFunc("/buckets/", standardHandler(bucketsOps))
-	http.HandleFunc("/buckets", standardHandler(listBuckets))
-	http.HandleFunc("/stats", standardHandler(stats))
-
-	mainLogger.Println("NOTICE: Server started. Serving port " + globalConfig.HttpPort)
-	http.ListenAndServe(":"+globalConfig.HttpPort, nil)
+	mux.HandleFunc("/ping", standardHandler(ping))
+	mux.HandleFunc("/", standardHandler(listResources))
+	mux.HandleFunc("/buckets/", standardHandler(bucketsOps))
+	mux.HandleFunc("/buckets", standardHandler(listBuckets))
+	mux.HandleFunc("/stats", standardHandler(stats))
+	mux.HandleFunc("/metrics", standardHandler(prometheusMetrics))
+
+	// Admin Operations
+	mux.HandleFunc("/admin/webhooks/", standardHandler(webhookOps))
+	mux.HandleFunc("/admin/users", standardHandler(userOps))
+	mux.HandleFunc("/admin/users/", standardHandler(userOps))
+	mux.HandleFunc("/admin/grants", standardHandler(grantOps))
+	mux.HandleFunc("/admin/slow-requests", standardHandler(slowRequestOps))
+	mux.HandleFunc("/admin/migrate", standardHandler(migrateOps))
+	mux.HandleFunc("/admin/scrub", standardHandler(scrubOps))
+	mux.HandleFunc("/admin/reindex", standardHandler(reindexOps))
+}
+
+func tlsServer() *http.Server {
+	certificates, err := newCertificateStore(globalConfig.TLS)
+	if err != nil {
+		panic(fmt.Sprintln("TLS certificate error: ", err))
+	}
+	certificates.watch()
+
+	port := globalConfig.TLS.Port
+	mainLogger.Println("NOTICE: Serving HTTPS on port " + port)
+	return &http.Server{Addr: ":" + port, TLSConfig: certificates.tlsConfig()}
 }
@@ -18,9 +18,20 @@ package main
 
 import (
 	"encoding/json"
+	"levelupdb/backend"
 	"net/http"
+	"os"
+	"runtime"
 )
 
+var nodename = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "levelupdb@" + host
+}()
+
 func ping(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("OK"))
 }
@@ -66,6 +77,102 @@ func listResources(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+var riakBackends = map[string]string{
+	"leveldb": "riak_kv_eleveldb_backend",
+	"bitcask": "riak_kv_bitcask_backend",
+	"memory":  "riak_kv_memory_backend",
+}
+
+// What Riak would call the way buckets are stored.
+func storageBackend() string {
+	if len(globalConfig.Backends) > 0 {
+		return "riak_kv_multi_backend"
+	}
+	return riakBackends[globalConfig.Engine]
+}
+
+// The open buckets and the space they take per backend. Buckets without
+// one count for the engine they are kept in.
+func backendUsage() map[string]*backend.BackendUsage {
+	usage := make(map[string]*backend.BackendUsage)
+	for name, used := range database.BackendUsage() {
+		if name == "" {
+			name = globalConfig.Engine
+		}
+		if usage[name] == nil {
+			usage[name] = new(backend.BackendUsage)
+		}
+		usage[name].Buckets += used.Buckets
+		usage[name].Size += used.Size
+	}
+	return usage
+}
+
+// Field names follow Riak's /stats so existing dashboards keep working.
+// Everything prefixed with leveldb_ is levelupdb's own.
 func stats(w http.ResponseWriter, req *http.Request) {
-	w.Write([]byte("{\"riak_kv_version\":\"1.3.1\",\"riak_api_version\":\"1.3.1\"}"))
+	r := make(map[string]interface{})
+	r["riak_kv_version"] = "1.3.1"
+	r["riak_api_version"] = "1.3.1"
+	r["nodename"] = nodename
+	r["connected_nodes"] = []string{}
+	r["ring_members"] = []string{nodename}
+	r["ring_num_partitions"] = 1
+	r["storage_backend"] = storageBackend()
+
+	gets, getsTotal := nodeMetrics.gets.lastMinute()
+	puts, putsTotal := nodeMetrics.puts.lastMinute()
+	indexReads, indexReadsTotal := nodeMetrics.indexQueries.lastMinute()
+
+	// There is a single vnode, so the vnode counters are the node ones.
+	r["node_gets"], r["vnode_gets"] = gets, gets
+	r["node_gets_total"], r["vnode_gets_total"] = getsTotal, getsTotal
+	r["node_puts"], r["vnode_puts"] = puts, puts
+	r["node_puts_total"], r["vnode_puts_total"] = putsTotal, putsTotal
+	r["vnode_index_reads"] = indexReads
+	r["vnode_index_reads_total"] = indexReadsTotal
+
+	nodeMetrics.getTime.summary().addTo(r, "node_get_fsm_time")
+	nodeMetrics.putTime.summary().addTo(r, "node_put_fsm_time")
+	nodeMetrics.indexTime.summary().addTo(r, "node_index_fsm_time")
+	nodeMetrics.getSize.summary().addTo(r, "node_get_fsm_objsize")
+	nodeMetrics.putSize.summary().addTo(r, "node_put_fsm_objsize")
+	summary{}.addTo(r, "node_get_fsm_siblings") // Never any siblings.
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	r["memory_total"] = mem.Sys
+	r["memory_processes"] = mem.HeapAlloc
+	r["sys_process_count"] = runtime.NumGoroutine()
+	r["cpu_nprocs"] = runtime.NumCPU()
+
+	r["leveldb_open_buckets"] = database.OpenBucketCount()
+	r["leveldb_open_index_buckets"] = indexDatabase.OpenBucketCount()
+	r["leveldb_memory_usage"] = database.ApproximateMemoryUsage() + indexDatabase.ApproximateMemoryUsage() +
+		chunkDatabase.ApproximateMemoryUsage()
+	r["leveldb_block_cache_capacity"] = database.BlockCacheCapacity() + indexDatabase.BlockCacheCapacity() +
+		chunkDatabase.BlockCacheCapacity()
+
+	// Not a Riak stat either.
+	r["backends"] = backendUsage()
+
+	// Not a Riak stat. Ratios are raw size over stored size.
+	compression := make(map[string]interface{})
+	_, counts := backend.CompressionCounts()
+	for bucket, count := range counts {
+		compression[bucket] = map[string]interface{}{
+			"raw_bytes":    count.Raw,
+			"stored_bytes": count.Stored,
+			"ratio":        count.Ratio(),
+		}
+	}
+	r["compression"] = compression
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
@@ -0,0 +1,97 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Blocks until SIGTERM or SIGINT (or a listener dying), then stops taking
+// connections, drains in-flight requests and closes every database.
+// Returns the exit code: 0 only if all of that went cleanly.
+func waitForShutdown(servers []*http.Server, errs <-chan error) int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	clean := true
+	select {
+	case sig := <-signals:
+		mainLogger.Println("NOTICE: Got", sig, "shutting down")
+	case err := <-errs:
+		mainLogger.Println("ERROR: Listener failed with", err, "shutting down")
+		clean = false
+	}
+
+	// Whoever sends a second signal does not want to wait.
+	go func() {
+		<-signals
+		mainLogger.Println("WARNING: Got a second signal, exiting without draining")
+		os.Exit(1)
+	}()
+
+	timeout := time.Duration(globalConfig.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	drained := true
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			drained = false
+		}
+	}
+	if !webhooks.stop(ctx) {
+		drained = false
+	}
+	if !stopMigration(ctx) {
+		drained = false
+	}
+	if !stopScrub(ctx) {
+		drained = false
+	}
+	if !stopReindex(ctx) {
+		drained = false
+	}
+
+	// Closing a leveldb under a request that is still using it would crash
+	// in C, so if anything is still running leave them to the OS. leveldb's
+	// log keeps every finished write safe either way.
+	if !drained {
+		mainLogger.Println("ERROR: Requests did not drain within", timeout, "exiting without closing databases")
+		return 1
+	}
+
+	closeDatabases()
+	if clean {
+		mainLogger.Println("NOTICE: Shut down cleanly")
+		return 0
+	}
+	return 1
+}
+
+// Closes everything openDatabases opened, in reverse order.
+func closeDatabases() {
+	queue.Close()
+	chunkDatabase.Close()
+	indexDatabase.Close()
+	database.Close()
+	props.Close()
+}
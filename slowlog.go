@@ -0,0 +1,184 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the phases a request's time is split into. Link walks also
+// record one "link_walk_<n>" phase per step, which includes the reads that
+// step made.
+const (
+	phaseLevelDBRead   = "leveldb_read"
+	phaseLevelDBWrite  = "leveldb_write"
+	phaseIndexScan     = "index_scan"
+	phaseDecompress    = "decompress"
+	phaseJSONEncode    = "json_encode"
+	phaseResponseWrite = "response_write"
+)
+
+// Adds up how long a request spent in each phase.
+type phaseTimer struct {
+	lock   sync.Mutex
+	phases map[string]time.Duration
+	order  []string // Phases in the order they first happened.
+}
+
+type phaseTimerKey struct{}
+
+func withPhaseTimer(req *http.Request, timer *phaseTimer) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), phaseTimerKey{}, timer))
+}
+
+func (timer *phaseTimer) add(phase string, duration time.Duration) {
+	if timer == nil {
+		return
+	}
+	timer.lock.Lock()
+	if _, ok := timer.phases[phase]; !ok {
+		timer.order = append(timer.order, phase)
+	}
+	timer.phases[phase] += duration
+	timer.lock.Unlock()
+}
+
+// Starts timing a phase of req and returns the function that stops it:
+//
+//	done := timePhase(req, phaseLevelDBRead)
+//	meta, data, err := database.GetObject(bucket, key)
+//	done()
+//
+// It does nothing when the slow request log is off.
+func timePhase(req *http.Request, phase string) func() {
+	timer, _ := req.Context().Value(phaseTimerKey{}).(*phaseTimer)
+	if timer == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { timer.add(phase, time.Since(start)) }
+}
+
+type slowPhase struct {
+	Phase      string  `json:"phase"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type slowRequest struct {
+	Time       string      `json:"time"`
+	RequestId  string      `json:"request_id"`
+	Remote     string      `json:"remote"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Status     int         `json:"status"`
+	DurationMs float64     `json:"duration_ms"`
+	Phases     []slowPhase `json:"phases"`
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// A ring buffer of the most recent slow requests.
+type slowRequestLog struct {
+	lock     sync.Mutex
+	requests []slowRequest
+	next     int
+	filled   bool
+}
+
+var slowRequests *slowRequestLog
+
+func newSlowRequestLog(size int) *slowRequestLog {
+	return &slowRequestLog{requests: make([]slowRequest, size)}
+}
+
+func (log *slowRequestLog) add(request slowRequest) {
+	log.lock.Lock()
+	log.requests[log.next] = request
+	log.next++
+	if log.next == len(log.requests) {
+		log.next = 0
+		log.filled = true
+	}
+	log.lock.Unlock()
+}
+
+// Newest first.
+func (log *slowRequestLog) recent() []slowRequest {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	n := log.next
+	if log.filled {
+		n = len(log.requests)
+	}
+	recent := make([]slowRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, log.requests[(log.next-i+len(log.requests))%len(log.requests)])
+	}
+	return recent
+}
+
+// Called by standardHandler once a request is done. Requests under the
+// threshold are forgotten.
+func observeSlowRequest(req *http.Request, timer *phaseTimer, id string, status int, duration time.Duration) {
+	if timer == nil || duration < time.Duration(globalConfig.SlowRequestThreshold)*time.Millisecond {
+		return
+	}
+
+	request := slowRequest{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		RequestId:  id,
+		Remote:     req.RemoteAddr,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Query:      req.URL.RawQuery,
+		Status:     status,
+		DurationMs: milliseconds(duration),
+		Phases:     []slowPhase{},
+	}
+	timer.lock.Lock()
+	breakdown := make([]string, 0, len(timer.order))
+	for _, phase := range timer.order {
+		request.Phases = append(request.Phases, slowPhase{phase, milliseconds(timer.phases[phase])})
+		breakdown = append(breakdown, fmt.Sprintf("%s=%.3fms", phase, milliseconds(timer.phases[phase])))
+	}
+	timer.lock.Unlock()
+
+	slowRequests.add(request)
+	mainLogger.Printf("WARNING: Slow request %s %s %s took %.3fms: %s", id, req.Method, req.URL.Path,
+		request.DurationMs, strings.Join(breakdown, " "))
+}
+
+// GET /admin/slow-requests lists the most recent slow requests.
+func slowRequestOps(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if slowRequests == nil {
+		writeJSON(w, []slowRequest{})
+		return
+	}
+	writeJSON(w, slowRequests.recent())
+}
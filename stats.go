@@ -0,0 +1,157 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Like Riak, the rates and percentiles cover the last minute.
+const statsWindow = 60
+
+// Counts events per second over a sliding minute, plus an all time total.
+type meter struct {
+	lock   sync.Mutex
+	counts [statsWindow]uint64
+	stamps [statsWindow]int64 // The second each slot was last used for.
+	total  uint64
+}
+
+func (m *meter) mark(n uint64) {
+	now := time.Now().Unix()
+	slot := now % statsWindow
+	m.lock.Lock()
+	if m.stamps[slot] != now {
+		m.stamps[slot] = now
+		m.counts[slot] = 0
+	}
+	m.counts[slot] += n
+	m.total += n
+	m.lock.Unlock()
+}
+
+func (m *meter) lastMinute() (count uint64, total uint64) {
+	since := time.Now().Unix() - statsWindow
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, stamp := range m.stamps {
+		if stamp > since {
+			count += m.counts[i]
+		}
+	}
+	return count, m.total
+}
+
+// Keeps the most recent samples (at most histogramSize of them) so
+// percentiles can be computed over the last minute.
+const histogramSize = 1028
+
+type sample struct {
+	value int64
+	stamp int64
+}
+
+type histogram struct {
+	lock    sync.Mutex
+	samples [histogramSize]sample
+	next    int
+	filled  bool
+}
+
+func (h *histogram) update(value int64) {
+	h.lock.Lock()
+	h.samples[h.next] = sample{value, time.Now().Unix()}
+	h.next++
+	if h.next == histogramSize {
+		h.next = 0
+		h.filled = true
+	}
+	h.lock.Unlock()
+}
+
+type summary struct {
+	mean, median, p95, p99, p100 int64
+}
+
+func (h *histogram) summary() (s summary) {
+	since := time.Now().Unix() - statsWindow
+	h.lock.Lock()
+	n := h.next
+	if h.filled {
+		n = histogramSize
+	}
+	values := make([]int64, 0, n)
+	for _, sample := range h.samples[:n] {
+		if sample.stamp > since {
+			values = append(values, sample.value)
+		}
+	}
+	h.lock.Unlock()
+
+	if len(values) == 0 {
+		return
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var sum int64
+	for _, v := range values {
+		sum += v
+	}
+	// Nearest rank.
+	percentile := func(p int) int64 {
+		return values[(len(values)*p+99)/100-1]
+	}
+	return summary{sum / int64(len(values)), percentile(50), percentile(95), percentile(99), values[len(values)-1]}
+}
+
+// Adds name_mean, name_median, name_95, name_99 and name_100 to stats.
+func (s summary) addTo(stats map[string]interface{}, name string) {
+	stats[name+"_mean"] = s.mean
+	stats[name+"_median"] = s.median
+	stats[name+"_95"] = s.p95
+	stats[name+"_99"] = s.p99
+	stats[name+"_100"] = s.p100
+}
+
+// What /stats reports. Times are in microseconds and sizes in bytes, the
+// same units Riak uses.
+type nodeStats struct {
+	gets, puts, indexQueries meter
+	getTime, putTime         histogram
+	indexTime                histogram
+	getSize, putSize         histogram
+}
+
+var nodeMetrics = new(nodeStats)
+
+func (s *nodeStats) observeGet(start time.Time, size int) {
+	s.gets.mark(1)
+	s.getTime.update(int64(time.Since(start) / time.Microsecond))
+	s.getSize.update(int64(size))
+}
+
+func (s *nodeStats) observePut(start time.Time, size int) {
+	s.puts.mark(1)
+	s.putTime.update(int64(time.Since(start) / time.Microsecond))
+	s.putSize.update(int64(size))
+}
+
+func (s *nodeStats) observeIndexQuery(start time.Time) {
+	s.indexQueries.mark(1)
+	s.indexTime.update(int64(time.Since(start) / time.Microsecond))
+}
@@ -0,0 +1,129 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type TLSConfig struct {
+	Port              string
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string // PEM bundle used to verify client certificates.
+	RequireClientCert bool
+}
+
+func (config *TLSConfig) enabled() bool {
+	return config.CertFile != "" && config.KeyFile != ""
+}
+
+// Holds the certificate and client CAs currently in use. Every handshake
+// asks for them again, so swapping them out affects new connections only
+// and established ones carry on undisturbed.
+type certificateStore struct {
+	config    TLSConfig
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertificateStore(config TLSConfig) (*certificateStore, error) {
+	store := &certificateStore{config: config}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// On failure the previous certificate stays in place, so a botched renewal
+// does not take the server down.
+func (store *certificateStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(store.config.CertFile, store.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if store.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(store.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + store.config.ClientCAFile)
+		}
+	}
+
+	store.lock.Lock()
+	store.cert = &cert
+	store.clientCAs = pool
+	store.lock.Unlock()
+	return nil
+}
+
+func (store *certificateStore) tlsConfig() *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		store.lock.RLock()
+		defer store.lock.RUnlock()
+		return store.cert, nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		store.lock.RLock()
+		defer store.lock.RUnlock()
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.GetCertificate = nil
+		config.Certificates = []tls.Certificate{*store.cert}
+		if store.clientCAs != nil {
+			config.ClientCAs = store.clientCAs
+			if store.config.RequireClientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		return config, nil
+	}
+	return base
+}
+
+// Reloads the certificates whenever the process gets a SIGHUP, which is
+// what certificate renewal hooks usually send. The signal is caught from
+// the moment watch returns.
+func (store *certificateStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := store.reload(); err != nil {
+				mainLogger.Println("ERROR: Reloading TLS certificate failed, keeping the old one:", err)
+			} else {
+				mainLogger.Println("NOTICE: Reloaded TLS certificate from", store.config.CertFile)
+			}
+		}
+	}()
+}
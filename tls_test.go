@@ -0,0 +1,232 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Makes a certificate for name, signed by parent, or self signed when
+// parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// Writes the certificate and key as PEM files in dir, named after prefix.
+func (c *testCert) write(t *testing.T, dir, prefix string) (certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, prefix+".crt")
+	keyFile = filepath.Join(dir, prefix+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// Starts a TLS server using store, and returns its address.
+func newTLSTestServer(t *testing.T, store *certificateStore) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = store.tlsConfig()
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// Handshakes with the server at addr, presenting clientCert if it is not
+// nil, and returns the certificate the server presented.
+func handshake(addr string, roots *x509.CertPool, clientCert *testCert) (*x509.Certificate, error) {
+	config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if clientCert != nil {
+		// Presented even when its issuer is not one the server asks for,
+		// so that the server has to verify it.
+		cert := clientCert.tlsCertificate()
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// With TLS 1.3 the server only checks the client certificate after the
+	// client considers the handshake done, so a rejection shows up on the
+	// first read.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "levelupdb test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+
+	store, err := newCertificateStore(TLSConfig{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      caFile,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := newTLSTestServer(t, store)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if _, err := handshake(addr, roots, newTestCert(t, "client", ca)); err != nil {
+		t.Errorf("client certificate signed by the CA: %s", err)
+	}
+	if _, err := handshake(addr, roots, nil); err == nil {
+		t.Error("no client certificate was accepted")
+	}
+	other := newTestCert(t, "another CA", nil)
+	if _, err := handshake(addr, roots, newTestCert(t, "client", other)); err == nil {
+		t.Error("client certificate signed by an unknown CA was accepted")
+	}
+	if _, err := handshake(addr, roots, other); err == nil {
+		t.Error("self signed client certificate was accepted")
+	}
+}
+
+func TestTLSReloadOnSIGHUP(t *testing.T) {
+	if mainLogger == nil {
+		mainLogger = log.New(ioutil.Discard, "", 0)
+	}
+	dir := t.TempDir()
+	ca := newTestCert(t, "levelupdb test CA", nil)
+	old := newTestCert(t, "old", ca)
+	certFile, keyFile := old.write(t, dir, "server")
+
+	store, err := newCertificateStore(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.watch()
+	addr := newTLSTestServer(t, store)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	served, err := handshake(addr, roots, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.Subject.CommonName != "old" {
+		t.Fatalf("served %q before the reload", served.Subject.CommonName)
+	}
+
+	// A renewal that only got halfway keeps the old certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err == nil {
+		t.Error("reloading a broken key pair succeeded")
+	}
+	if served, err = handshake(addr, roots, nil); err != nil || served.Subject.CommonName != "old" {
+		t.Fatalf("after a failed reload: %v, %v", served, err)
+	}
+
+	newTestCert(t, "new", ca).write(t, dir, "server")
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	// The reload happens in the background, so keep asking until the new
+	// certificate shows up.
+	deadline := time.Now().Add(5 * time.Second)
+	for served.Subject.CommonName != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP did not reload the certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if served, err = handshake(addr, roots, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
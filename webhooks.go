@@ -0,0 +1,384 @@
+/*
+ * This file is part of levelupdb.
+ *
+ * levelupdb is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * levelupdb is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with levelupdb.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"levelupdb/backend"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WebhookTarget struct {
+	Bucket string // "*" matches every bucket.
+	Url    string
+}
+
+type WebhookConfig struct {
+	Targets        []WebhookTarget
+	MaxAttempts    int // Attempts before an event goes to the dead letters.
+	InitialBackoff int // Seconds.
+	MaxBackoff     int // Seconds.
+	Timeout        int // Seconds per delivery attempt.
+	Workers        int
+}
+
+// This is what gets POSTed to the webhook url.
+type postcommitEvent struct {
+	Event       string            `json:"event"` // "put" or "delete"
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	ContentType string            `json:"content_type,omitempty"`
+	Indexes     [][2]string       `json:"indexes,omitempty"`
+	Links       string            `json:"links,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Value       []byte            `json:"value,omitempty"` // base64
+	Timestamp   int64             `json:"timestamp"`
+}
+
+type webhookDispatcher struct {
+	queue    *backend.Queue
+	config   WebhookConfig
+	client   *http.Client
+	wake     chan bool
+	slots    chan bool
+	inflight map[string]bool
+	lock     sync.Mutex
+	stopping chan bool
+	running  sync.WaitGroup // The run loop and every delivery.
+}
+
+func newWebhookDispatcher(queue *backend.Queue, config WebhookConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		queue:    queue,
+		config:   config,
+		client:   &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		wake:     make(chan bool, 1),
+		slots:    make(chan bool, config.Workers),
+		inflight: make(map[string]bool),
+		stopping: make(chan bool),
+	}
+}
+
+// Queues the event for every target that matches the bucket. Events are
+// persisted before this returns so they survive a restart.
+func (d *webhookDispatcher) postcommit(event, bucket, key string, meta *backend.Meta, data []byte) {
+	var payload []byte
+	for _, target := range d.config.Targets {
+		if target.Bucket != "*" && target.Bucket != bucket {
+			continue
+		}
+
+		if payload == nil {
+			e := postcommitEvent{Event: event, Bucket: bucket, Key: key, Value: data, Timestamp: time.Now().Unix()}
+			if meta != nil {
+				e.ContentType = meta.ContentType
+				e.Indexes = meta.Indexes
+				e.Links = meta.Links
+				e.Meta = meta.Meta
+			}
+			var err error
+			if payload, err = json.Marshal(e); err != nil {
+				mainLogger.Println("ERROR: Encoding postcommit event failed with", err)
+				return
+			}
+		}
+
+		entry := &backend.QueueEntry{
+			Lane:    target.Url + " " + bucket + "/" + key,
+			Target:  target.Url,
+			Payload: payload,
+			Created: time.Now().UnixNano(),
+		}
+		if err := d.queue.Push(entry); err != nil {
+			mainLogger.Println("ERROR: Queueing postcommit event failed with", err)
+		}
+	}
+	d.poke()
+}
+
+func (d *webhookDispatcher) poke() {
+	select {
+	case d.wake <- true:
+	default:
+	}
+}
+
+func (d *webhookDispatcher) start() {
+	d.running.Add(1)
+	go d.run()
+}
+
+func (d *webhookDispatcher) run() {
+	defer d.running.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		case <-d.stopping:
+			return
+		}
+		d.dispatch()
+	}
+}
+
+// Stops dispatching and waits for deliveries in progress. Whatever is still
+// pending stays in the queue for the next start. Returns false if the
+// deliveries did not finish before ctx expired.
+func (d *webhookDispatcher) stop(ctx context.Context) bool {
+	close(d.stopping)
+	done := make(chan bool)
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Only the oldest pending entry of each lane is eligible, which is what
+// keeps delivery ordered per key: a failing entry holds back everything
+// queued after it for the same target and key until it succeeds or dies.
+func (d *webhookDispatcher) dispatch() {
+	now := time.Now().UnixNano()
+	seen := make(map[string]bool)
+	err := d.queue.ForEachPending(func(entry *backend.QueueEntry) bool {
+		if seen[entry.Lane] {
+			return true
+		}
+		seen[entry.Lane] = true
+		if entry.NextAttempt > now {
+			return true
+		}
+
+		d.lock.Lock()
+		busy := d.inflight[entry.Lane]
+		if !busy {
+			// The scan reads a snapshot, so a delivery that finished since
+			// it started may have removed, buried or rescheduled the entry.
+			// Deliveries finish before they leave inflight, so the entry as
+			// stored now is up to date.
+			current, err := d.queue.Pending(entry.Id)
+			if err != nil || current == nil || current.NextAttempt > now {
+				d.lock.Unlock()
+				if err != nil {
+					mainLogger.Println("ERROR: Reading the webhook queue failed with", err)
+				}
+				return true
+			}
+			entry = current
+			select {
+			case d.slots <- true:
+				d.inflight[entry.Lane] = true
+			default:
+				d.lock.Unlock()
+				return false // All workers are busy.
+			}
+		}
+		d.lock.Unlock()
+
+		if !busy {
+			d.running.Add(1)
+			go d.deliver(entry)
+		}
+		return true
+	})
+
+	if err != nil {
+		mainLogger.Println("ERROR: Reading the webhook queue failed with", err)
+	}
+}
+
+func (d *webhookDispatcher) deliver(entry *backend.QueueEntry) {
+	defer func() {
+		defer d.running.Done()
+		d.lock.Lock()
+		delete(d.inflight, entry.Lane)
+		d.lock.Unlock()
+		<-d.slots
+		d.poke()
+	}()
+
+	err := d.post(entry)
+	if err == nil {
+		if err = d.queue.Remove(entry.Id); err != nil {
+			mainLogger.Println("ERROR: Removing delivered webhook event failed with", err)
+		}
+		return
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if entry.Attempts >= d.config.MaxAttempts {
+		mainLogger.Printf("WARNING: Webhook event %d to %s failed %d times, moving to dead letters: %s", entry.Id, entry.Target, entry.Attempts, err)
+		_, err = d.queue.Bury(entry)
+	} else {
+		entry.NextAttempt = time.Now().Add(d.backoff(entry.Attempts)).UnixNano()
+		_, err = d.queue.Update(entry)
+	}
+
+	if err != nil {
+		mainLogger.Println("ERROR: Updating webhook queue failed with", err)
+	}
+}
+
+func (d *webhookDispatcher) post(entry *backend.QueueEntry) error {
+	resp, err := d.client.Post(entry.Target, "application/json", bytes.NewReader(entry.Payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Exponential backoff, capped at MaxBackoff.
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := time.Duration(d.config.InitialBackoff) * time.Second
+	max := time.Duration(d.config.MaxBackoff) * time.Second
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+type queueEntries struct {
+	Entries []*backend.QueueEntry `json:"entries"`
+}
+
+const lenWebhooksPath = len("/admin/webhooks/")
+
+// GET  /admin/webhooks/pending
+// GET  /admin/webhooks/dead
+// POST /admin/webhooks/dead/replay
+// POST /admin/webhooks/dead/<id>/replay
+// DELETE /admin/webhooks/dead/<id>
+func webhookOps(w http.ResponseWriter, req *http.Request) {
+	splitted := strings.Split(strings.Trim(req.URL.Path[lenWebhooksPath:], "/"), "/")
+	length := len(splitted)
+
+	switch {
+	case length == 1 && req.Method == "GET" && (splitted[0] == "pending" || splitted[0] == "dead"):
+		listQueueEntries(w, splitted[0] == "dead")
+	case length == 2 && req.Method == "POST" && splitted[0] == "dead" && splitted[1] == "replay":
+		replayDeadEntries(w, nil)
+	case length == 3 && req.Method == "POST" && splitted[0] == "dead" && splitted[2] == "replay":
+		id, err := strconv.ParseUint(splitted[1], 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		replayDeadEntries(w, []uint64{id})
+	case length == 2 && req.Method == "DELETE" && splitted[0] == "dead":
+		id, err := strconv.ParseUint(splitted[1], 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if err := webhooks.queue.DeleteDead(id); err != nil {
+			mainLogger.Println("ERROR: Deleting dead webhook event failed with", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func listQueueEntries(w http.ResponseWriter, dead bool) {
+	var r queueEntries
+	r.Entries = make([]*backend.QueueEntry, 0)
+	collect := func(entry *backend.QueueEntry) bool {
+		r.Entries = append(r.Entries, entry)
+		return true
+	}
+
+	var err error
+	if dead {
+		err = webhooks.queue.ForEachDead(collect)
+	} else {
+		err = webhooks.queue.ForEachPending(collect)
+	}
+	if err != nil {
+		mainLogger.Println("ERROR: Reading the webhook queue failed with", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if data, err := json.Marshal(r); err == nil {
+		w.Write(data)
+	} else {
+		w.WriteHeader(500)
+	}
+}
+
+// Replays the given dead entries, or all of them if ids is nil.
+func replayDeadEntries(w http.ResponseWriter, ids []uint64) {
+	if ids == nil {
+		err := webhooks.queue.ForEachDead(func(entry *backend.QueueEntry) bool {
+			ids = append(ids, entry.Id)
+			return true
+		})
+		if err != nil {
+			mainLogger.Println("ERROR: Reading the webhook queue failed with", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	replayed := 0
+	for _, id := range ids {
+		ok, err := webhooks.queue.Replay(id)
+		if err != nil {
+			mainLogger.Println("ERROR: Replaying webhook event failed with", err)
+			w.WriteHeader(500)
+			return
+		}
+		if ok {
+			replayed++
+		}
+	}
+
+	if len(ids) == 1 && replayed == 0 {
+		w.WriteHeader(404)
+		return
+	}
+
+	webhooks.poke()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"replayed\":%d}", replayed)))
+}